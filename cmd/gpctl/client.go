@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// apiClient talks to the server's REST API and client WebSocket
+type apiClient struct {
+	base    *url.URL
+	token   string
+	timeout time.Duration // how long to wait for a measurement to finish
+	http    *http.Client
+}
+
+func newAPIClient(server, token string, timeout time.Duration) (*apiClient, error) {
+	base, err := url.Parse(strings.TrimSuffix(server, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q, expected http:// or https://", server)
+	}
+	return &apiClient{
+		base:    base,
+		token:   token,
+		timeout: timeout,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// header returns the headers sent with every request
+func (a *apiClient) header() http.Header {
+	header := http.Header{}
+	if a.token != "" {
+		header.Set("Authorization", "Bearer "+a.token)
+	}
+	return header
+}
+
+// do sends a request and decodes a JSON response into out, turning error
+// responses into errors carrying the server's message
+func (a *apiClient) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, a.base.String()+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header = a.header()
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		if apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		if retry := resp.Header.Get("Retry-After"); retry != "" {
+			return fmt.Errorf("%s: %s (retry after %ss)", path, apiErr.Error, retry)
+		}
+		return fmt.Errorf("%s: %s", path, apiErr.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (a *apiClient) get(path string, out interface{}) error {
+	return a.do(http.MethodGet, path, nil, out)
+}
+
+// probes fetches the probe list
+func (a *apiClient) probes() ([]model.ProbeInfo, error) {
+	var resp struct {
+		Probes []model.ProbeInfo `json:"probes"`
+	}
+	err := a.get("/api/probes", &resp)
+	return resp.Probes, err
+}
+
+// measurement fetches a measurement by ID
+func (a *apiClient) measurement(id string) (model.Measurement, error) {
+	var m model.Measurement
+	err := a.get("/api/measurements/"+url.PathEscape(id), &m)
+	return m, err
+}
+
+// dial opens the client WebSocket used to stream results
+func (a *apiClient) dial() (*websocket.Conn, error) {
+	u := *a.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/ws/client"
+	u.RawQuery = url.Values{"features": {strings.Join([]string{protocol.FeatureBatch, protocol.FeatureLineInfo, protocol.FeatureResultData}, ",")}}.Encode()
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = true
+	conn, resp, err := dialer.Dial(u.String(), a.header())
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %s", u.String(), resp.Status)
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %w", u.String(), err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,237 @@
+// Command gpctl runs measurements on a globalping server from a terminal.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// Exit codes: 0 when every probe reached the target, 1 when any probe
+// failed, 2 when the measurement could not be run at all
+const (
+	exitOK          = 0
+	exitUnreachable = 1
+	exitError       = 2
+)
+
+// errUsage is returned after a command printed its own usage message
+var errUsage = errors.New("usage error")
+
+const usage = `Usage: gpctl [global flags] <command> [flags] [args]
+
+Commands:
+  probes                     List connected probes
+  commands                   List the custom commands probes offer
+  ping <target>              Ping a target
+  traceroute <target>        Trace the route to a target
+  mtr <target>               Run mtr against a target
+  run -type <type> [target]  Run any task type the probes support
+  get <id>                   Show a past measurement
+
+Global flags:
+`
+
+func main() {
+	global := flag.NewFlagSet("gpctl", flag.ContinueOnError)
+	server := global.String("server", envOr("GPCTL_SERVER", "http://localhost:8080"), "Server URL (env GPCTL_SERVER)")
+	token := global.String("token", os.Getenv("GPCTL_TOKEN"), "API key or session token (env GPCTL_TOKEN)")
+	jsonOut := global.Bool("json", false, "Print JSON instead of text")
+	timeout := global.Duration("timeout", 5*time.Minute, "Give up waiting for results after this long")
+	global.Usage = func() {
+		fmt.Fprint(global.Output(), usage)
+		global.PrintDefaults()
+	}
+	if err := global.Parse(os.Args[1:]); err != nil {
+		os.Exit(exitError)
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(exitError)
+	}
+
+	api, err := newAPIClient(*server, *token, *timeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gpctl:", err)
+		os.Exit(exitError)
+	}
+	out := &printer{json: *jsonOut}
+
+	command, args := global.Arg(0), global.Args()[1:]
+	var code int
+	switch command {
+	case "probes":
+		code, err = cmdProbes(api, out, args)
+	case "commands":
+		code, err = cmdCommands(api, out, args)
+	case "ping", "traceroute", "mtr":
+		code, err = cmdRun(api, out, command, args)
+	case "run":
+		code, err = cmdRun(api, out, "", args)
+	case "get":
+		code, err = cmdGet(api, out, args)
+	default:
+		fmt.Fprintf(os.Stderr, "gpctl: unknown command %q\n\n", command)
+		global.Usage()
+		os.Exit(exitError)
+	}
+	if err != nil {
+		if !errors.Is(err, errUsage) {
+			fmt.Fprintln(os.Stderr, "gpctl:", err)
+		}
+		os.Exit(exitError)
+	}
+	os.Exit(code)
+}
+
+// cmdProbes lists connected probes
+func cmdProbes(api *apiClient, out *printer, args []string) (int, error) {
+	fs := flag.NewFlagSet("probes", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 0, errUsage
+	}
+
+	probes, err := api.probes()
+	if err != nil {
+		return 0, err
+	}
+	return exitOK, out.probes(probes)
+}
+
+// cmdCommands lists the custom commands of connected probes
+func cmdCommands(api *apiClient, out *printer, args []string) (int, error) {
+	fs := flag.NewFlagSet("commands", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 0, errUsage
+	}
+
+	probes, err := api.probes()
+	if err != nil {
+		return 0, err
+	}
+	return exitOK, out.commands(probes)
+}
+
+// cmdRun creates a measurement and streams its output. taskType is empty
+// for the generic run command, which takes it from -type.
+func cmdRun(api *apiClient, out *printer, taskType string, args []string) (int, error) {
+	name := taskType
+	if name == "" {
+		name = "run"
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	from := fs.String("from", "any:1", "Comma-separated probe selectors, e.g. region:eu,tag:bird or name:tokyo")
+	limit := fs.Int("limit", 0, "Maximum number of probes chosen from the selectors (0 for all)")
+	strategy := fs.String("strategy", "", "How to pick among more matching probes: random or load")
+	options := fs.String("options", "", "Extra options passed to the tool")
+	columns := fs.Bool("columns", false, "Print each probe's output side by side once all have finished")
+	width := fs.Int("width", terminalWidth(), "Total width of -columns output")
+	timestamps := fs.Bool("timestamps", false, "Prefix streamed lines with the time the probe read them")
+	taskTimeout := fs.Duration("task-timeout", 0, "Stop the task on a probe after this long, in whole seconds (0 for the server's limit)")
+	maxLines := fs.Int("max-lines", 0, "Stop the task on a probe after this many lines of output (0 for the server's limit)")
+	maxBytes := fs.Int("max-bytes", 0, "Stop the task on a probe after this many bytes of output (0 for the server's limit)")
+	params := paramFlag{}
+	fs.Var(params, "param", "Parameter of a custom command as name=value (repeatable)")
+	if taskType == "" {
+		fs.StringVar(&taskType, "type", "", "Task type to run (required)")
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gpctl %s [flags] [target]\n", name)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 0, errUsage
+	}
+	// Custom commands may take no target
+	if fs.NArg() > 1 || taskType == "" {
+		fs.Usage()
+		return 0, errUsage
+	}
+
+	req := model.TaskCreatePayload{
+		Selectors: splitList(*from),
+		Limit:     *limit,
+		Strategy:  *strategy,
+		Type:      taskType,
+		Target:    fs.Arg(0),
+		Options:   *options,
+	}
+	if len(params) > 0 {
+		req.Params = params
+	}
+	if *taskTimeout%time.Second != 0 {
+		fmt.Fprintln(fs.Output(), "-task-timeout must be whole seconds")
+		return 0, errUsage
+	}
+	limits := model.TaskLimits{Timeout: int(*taskTimeout / time.Second), MaxLines: *maxLines, MaxBytes: *maxBytes}
+	if limits != (model.TaskLimits{}) {
+		req.Limits = &limits
+	}
+	out.columns, out.width, out.timestamps = *columns, *width, *timestamps
+	return runMeasurement(api, out, req)
+}
+
+// cmdGet prints a past measurement
+func cmdGet(api *apiClient, out *printer, args []string) (int, error) {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	columns := fs.Bool("columns", false, "Print each probe's output side by side")
+	width := fs.Int("width", terminalWidth(), "Total width of -columns output")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gpctl get [flags] <id>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 0, errUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 0, errUsage
+	}
+
+	m, err := api.measurement(fs.Arg(0))
+	if err != nil {
+		return 0, err
+	}
+	out.columns, out.width = *columns, *width
+	if err := out.measurement(m); err != nil {
+		return 0, err
+	}
+	return exitCode(m), nil
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// paramFlag collects repeated -param name=value flags
+type paramFlag map[string]string
+
+func (p paramFlag) String() string { return "" }
+
+func (p paramFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("%q is not name=value", s)
+	}
+	p[name] = value
+	return nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// runMeasurement creates the task over the client WebSocket, streams its
+// output until every selected probe has finished, then prints the stored
+// measurement in the requested format
+func runMeasurement(api *apiClient, out *printer, req model.TaskCreatePayload) (int, error) {
+	conn, err := api.dial()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	data, err := protocol.ClientToServer.Encode(model.Message{Type: model.MsgTypeTaskCreate, Payload: req})
+	if err != nil {
+		return 0, err
+	}
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return 0, fmt.Errorf("failed to send task: %w", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(api.timeout))
+
+	var taskID string
+	pending := make(map[string]bool)
+	for taskID == "" || len(pending) > 0 {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, fmt.Errorf("no result from %d probe(s) after %s, see gpctl get %s", len(pending), api.timeout, taskID)
+			}
+			return 0, fmt.Errorf("connection lost: %w", err)
+		}
+
+		// Skip message types this version does not know, and fields a
+		// newer server added; anything else is a broken server
+		msg, err := protocol.ServerToClient.DecodeLenient(message)
+		if errors.Is(err, protocol.ErrUnknownType) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("invalid message from server: %w", err)
+		}
+
+		switch msg.Type {
+		case model.MsgTypeTaskCreated:
+			created, err := protocol.DecodePayload[model.TaskCreatedPayload](msg)
+			if err != nil {
+				return 0, fmt.Errorf("invalid message from server: %w", err)
+			}
+			if taskID != "" || len(created.ProbeIDs) == 0 {
+				continue
+			}
+			taskID = created.TaskID
+			for _, id := range created.ProbeIDs {
+				pending[id] = true
+			}
+			out.started(taskID, len(created.ProbeIDs))
+		case model.MsgTypeError:
+			payload, err := protocol.DecodePayload[model.ErrorPayload](msg)
+			if err != nil {
+				return 0, fmt.Errorf("invalid message from server: %w", err)
+			}
+			if taskID != "" {
+				fmt.Fprintln(os.Stderr, "gpctl:", payload.Message)
+				continue
+			}
+			if payload.RetryAfter > 0 {
+				return 0, fmt.Errorf("%s, retry after %ds", payload.Message, payload.RetryAfter)
+			}
+			return 0, errors.New(payload.Message)
+		case model.MsgTypeTaskStream:
+			stream, err := protocol.DecodePayload[model.TaskStreamPayload](msg)
+			if err != nil {
+				return 0, fmt.Errorf("invalid message from server: %w", err)
+			}
+			if stream.TaskID != taskID || !pending[stream.ProbeID] {
+				continue
+			}
+			out.stream(stream)
+			if stream.IsEnd {
+				delete(pending, stream.ProbeID)
+			}
+		case model.MsgTypeTaskStatus:
+			status, err := protocol.DecodePayload[model.TaskStatusPayload](msg)
+			if err != nil {
+				return 0, fmt.Errorf("invalid message from server: %w", err)
+			}
+			if status.TaskID == taskID && status.Status == model.TaskStatusQueued {
+				out.queued(status)
+			}
+		case model.MsgTypeShutdown:
+			shutdown, err := protocol.DecodePayload[model.ShutdownPayload](msg)
+			if err != nil {
+				return 0, fmt.Errorf("invalid message from server: %w", err)
+			}
+			fmt.Fprintln(os.Stderr, "gpctl:", shutdown.Message)
+		}
+	}
+
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+
+	m, err := api.measurement(taskID)
+	if err != nil {
+		return 0, err
+	}
+	if err := out.finished(m); err != nil {
+		return 0, err
+	}
+	return exitCode(m), nil
+}
+
+// exitCode is exitUnreachable if any probe failed; results still in
+// progress do not count as failures
+func exitCode(m model.Measurement) int {
+	for _, r := range m.Results {
+		if r.Status == model.MeasurementFailed {
+			return exitUnreachable
+		}
+	}
+	return exitOK
+}
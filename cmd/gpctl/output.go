@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+const (
+	defaultWidth   = 160
+	minColumnWidth = 20
+	columnGap      = " | "
+)
+
+// printer writes results as prefixed lines, side-by-side columns or JSON.
+// Progress notes go to stderr so stdout only carries results.
+type printer struct {
+	json       bool
+	columns    bool
+	width      int
+	timestamps bool
+}
+
+// live reports whether output is printed as it streams in
+func (p *printer) live() bool {
+	return !p.json && !p.columns
+}
+
+func (p *printer) probes(probes []model.ProbeInfo) error {
+	if p.json {
+		return p.writeJSON(probes)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tLOCATION\tASN\tCOUNTRY\tSTATUS\tTASKS\tVERSION")
+	for _, probe := range probes {
+		asn := ""
+		if probe.ASN != 0 {
+			asn = strconv.FormatUint(uint64(probe.ASN), 10)
+		}
+		version := fmt.Sprintf("%s (protocol %d)", probe.Capabilities.Version, probe.ProtocolVersion)
+		if probe.Outdated {
+			version += " outdated"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", probe.ID, probe.Name, probe.Location, asn,
+			probe.Country, probe.Status, strings.Join(probe.Capabilities.TaskTypes, ","), version)
+	}
+	return w.Flush()
+}
+
+// commands lists every custom command once, with the probes offering it.
+// Probes may define a command differently; the first definition is shown.
+func (p *printer) commands(probes []model.ProbeInfo) error {
+	var infos []model.CommandInfo
+	offeredBy := make(map[string][]string)
+	for _, probe := range probes {
+		if probe.Status == model.ProbeStatusOffline {
+			continue
+		}
+		for _, cmd := range probe.Capabilities.Commands {
+			if _, seen := offeredBy[cmd.Name]; !seen {
+				infos = append(infos, cmd)
+			}
+			offeredBy[cmd.Name] = append(offeredBy[cmd.Name], probe.Name)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	if p.json {
+		return p.writeJSON(infos)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMAND\tTARGET\tPARAMETERS\tPROBES\tDESCRIPTION")
+	for _, cmd := range infos {
+		target := "no"
+		if cmd.Target {
+			target = "yes"
+		}
+		params := make([]string, len(cmd.Params))
+		for i, param := range cmd.Params {
+			params[i] = param.Name + ":" + param.Type
+			if param.Optional {
+				params[i] += "?"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", cmd.Name, target, strings.Join(params, " "),
+			strings.Join(offeredBy[cmd.Name], ","), cmd.Description)
+	}
+	return w.Flush()
+}
+
+func (p *printer) started(taskID string, probes int) {
+	if !p.json {
+		fmt.Fprintf(os.Stderr, "Measurement %s on %d probe(s)\n", taskID, probes)
+	}
+}
+
+func (p *printer) queued(status model.TaskStatusPayload) {
+	if p.live() {
+		fmt.Fprintf(os.Stderr, "[%s] queued at position %d\n", probeLabel(status.ProbeName, status.ProbeID), status.QueuePosition)
+	}
+}
+
+func (p *printer) stream(s model.TaskStreamPayload) {
+	if !p.live() {
+		return
+	}
+	label := probeLabel(s.ProbeName, s.ProbeID)
+	if s.Dropped > 0 {
+		fmt.Printf("[%s] (%d lines dropped, the full output is kept in the measurement)\n", label, s.Dropped)
+	}
+	for _, line := range s.Output {
+		p.line(label, line)
+	}
+	for _, line := range s.Lines {
+		fmt.Printf("[%s] %s\n", label, line)
+	}
+	if s.Error != "" {
+		fmt.Printf("[%s] error: %s\n", label, s.Error)
+	}
+	if len(s.Data) > 0 {
+		fmt.Printf("[%s] result: %s\n", label, s.Data)
+	}
+}
+
+// line prints a streamed line, with the time the probe read it if asked.
+// Notes from the probe itself, such as an over-long line, are marked.
+func (p *printer) line(label string, line model.OutputLine) {
+	if p.timestamps {
+		label += " " + line.Time.Local().Format("15:04:05.000")
+	}
+	if line.Stream == model.StreamMeta {
+		fmt.Printf("[%s] note: %s\n", label, line.Text)
+		return
+	}
+	fmt.Printf("[%s] %s\n", label, line.Text)
+}
+
+// finished prints a measurement whose output was not already streamed
+func (p *printer) finished(m model.Measurement) error {
+	if p.live() {
+		p.summary(m)
+		return nil
+	}
+	return p.measurement(m)
+}
+
+// measurement prints a whole measurement
+func (p *printer) measurement(m model.Measurement) error {
+	if p.json {
+		return p.writeJSON(m)
+	}
+	if p.columns {
+		p.printColumns(m)
+	} else {
+		for _, r := range m.Results {
+			label := probeLabel(r.ProbeName, r.ProbeID)
+			for _, line := range outputLines(r) {
+				fmt.Printf("[%s] %s\n", label, line)
+			}
+		}
+	}
+	p.summary(m)
+	return nil
+}
+
+// summary tells how many probes reached the target
+func (p *printer) summary(m model.Measurement) {
+	ok := 0
+	for _, r := range m.Results {
+		if r.Status == model.MeasurementFinished {
+			ok++
+		}
+	}
+	task := strings.TrimSpace(m.Type + " " + m.Target)
+	fmt.Fprintf(os.Stderr, "%s: %d/%d probe(s) succeeded (%s)\n", task, ok, len(m.Results), m.Status)
+}
+
+// printColumns prints each probe's output in its own column
+func (p *printer) printColumns(m model.Measurement) {
+	if len(m.Results) == 0 {
+		return
+	}
+	n := len(m.Results)
+	width := (p.width - len(columnGap)*(n-1)) / n
+	if width < minColumnWidth {
+		width = minColumnWidth
+	}
+
+	columns := make([][]string, n)
+	rows := 0
+	for i, r := range m.Results {
+		columns[i] = outputLines(r)
+		rows = max(rows, len(columns[i]))
+	}
+
+	cells := make([]string, n)
+	for i, r := range m.Results {
+		cells[i] = fit(probeLabel(r.ProbeName, r.ProbeID), width)
+	}
+	fmt.Println(strings.TrimRight(strings.Join(cells, columnGap), " "))
+	for i := range cells {
+		cells[i] = strings.Repeat("-", width)
+	}
+	fmt.Println(strings.Join(cells, columnGap))
+	for row := 0; row < rows; row++ {
+		for i, lines := range columns {
+			cells[i] = ""
+			if row < len(lines) {
+				cells[i] = lines[row]
+			}
+			cells[i] = fit(cells[i], width)
+		}
+		fmt.Println(strings.TrimRight(strings.Join(cells, columnGap), " "))
+	}
+}
+
+func (p *printer) writeJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// outputLines returns a result's output followed by its error, if any
+func outputLines(r model.MeasurementResult) []string {
+	var lines []string
+	if r.Output != "" {
+		lines = strings.Split(strings.TrimSuffix(r.Output, "\n"), "\n")
+	}
+	if r.Error != "" {
+		lines = append(lines, "error: "+r.Error)
+	}
+	return lines
+}
+
+// probeLabel names a probe, falling back to a short ID when it disconnected
+// before its name was known
+func probeLabel(name, id string) string {
+	if name != "" {
+		return name
+	}
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+// fit truncates or pads s to exactly width characters
+func fit(s string, width int) string {
+	r := []rune(strings.ReplaceAll(s, "\t", "    "))
+	if len(r) > width {
+		return string(r[:width-1]) + "…"
+	}
+	return string(r) + strings.Repeat(" ", width-len(r))
+}
+
+// terminalWidth reads $COLUMNS, which most shells export
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultWidth
+}
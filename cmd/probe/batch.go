@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// maxBatchBytes is how much output of one task is held back at most; a
+// batch reaching it is sent before the flush interval ends
+const maxBatchBytes = 32 << 10
+
+// pendingLines is the output of one task not sent yet
+type pendingLines struct {
+	lines []model.OutputLine
+	size  int
+}
+
+// batcher coalesces a link's task output into one task_result per task
+// and flush interval instead of one per line. It is used with servers that
+// negotiated the batch feature.
+type batcher struct {
+	link *link
+
+	mu      sync.Mutex
+	pending map[string]*pendingLines // task ID -> unsent output
+}
+
+func newBatcher(l *link) *batcher {
+	return &batcher{
+		link:    l,
+		pending: make(map[string]*pendingLines),
+	}
+}
+
+// add queues a line of output, sending the batch early if it grew too big
+func (b *batcher) add(taskID string, line model.OutputLine) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	p := b.pending[taskID]
+	if p == nil {
+		p = &pendingLines{}
+		b.pending[taskID] = p
+	}
+	p.lines = append(p.lines, line)
+	p.size += len(line.Text) + 1
+	if p.size >= maxBatchBytes {
+		b.sendLocked(model.TaskResultPayload{TaskID: taskID})
+	}
+}
+
+// end sends the task's remaining output together with its final result
+func (b *batcher) end(final model.TaskResultPayload) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sendLocked(final)
+}
+
+// flush sends the pending output of every task
+func (b *batcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for taskID := range b.pending {
+		b.sendLocked(model.TaskResultPayload{TaskID: taskID})
+	}
+}
+
+// sendLocked queues result with the task's pending lines; callers hold mu
+// so results of a task stay in order
+func (b *batcher) sendLocked(result model.TaskResultPayload) {
+	p := b.pending[result.TaskID]
+	delete(b.pending, result.TaskID)
+	if p == nil && !result.IsEnd {
+		return
+	}
+	if p != nil {
+		result.Output = p.lines
+	}
+	b.link.emit(result)
+}
+
+// run flushes pending output every interval until ctx is done
+func (b *batcher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
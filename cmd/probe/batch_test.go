@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+)
+
+// benchTraceLines is the output of a typical mtr run
+const benchTraceLines = 30
+
+// newTestLink returns a link to a session that queues up to queue
+// messages instead of sending them, with the given features negotiated
+func newTestLink(cfg *probeConfig, queue int, features ...string) (*link, *session) {
+	l := newLink(&ProbeClient{cfg: cfg}, serverConfig{Name: "test"})
+	s := &session{
+		link:    l,
+		sendCh:  make(chan []byte, queue),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	l.session, l.features = s, features
+	return l, s
+}
+
+// deflated is the size of data compressed with permessage-deflate, which
+// compresses every message on its own
+func deflated(w *flate.Writer, data []byte) int {
+	var buf bytes.Buffer
+	w.Reset(&buf)
+	w.Write(data)
+	w.Flush()
+	return buf.Len()
+}
+
+// benchmarkOutput sends the output of one task through a link and reports
+// the messages and bytes sent for it, uncompressed and deflated
+func benchmarkOutput(b *testing.B, batchInterval time.Duration, features ...string) {
+	b.ReportAllocs()
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	var messages, raw, compressed int
+	for i := 0; i < b.N; i++ {
+		l, s := newTestLink(&probeConfig{BatchInterval: batchInterval}, benchTraceLines+1, features...)
+		out := newTaskOutput(l, "0b6f1c9e-8a4e-4f0a-9d1e-2c3b4a5d6e7f")
+		for n := 1; n <= benchTraceLines; n++ {
+			out.Line("stdout", fmt.Sprintf("%2d. 172.20.%d.%d  0.0%%  10  %d.1  %d.4  %d.0  %d.9  0.8",
+				n, n, n*7, n, n+1, n-1, n+3))
+		}
+		out.finish("")
+		close(s.sendCh)
+		for data := range s.sendCh {
+			messages++
+			raw += len(data)
+			compressed += deflated(w, data)
+		}
+	}
+	b.ReportMetric(float64(messages)/float64(b.N), "msgs/task")
+	b.ReportMetric(float64(raw)/float64(b.N), "bytes/task")
+	b.ReportMetric(float64(compressed)/float64(b.N), "deflated-bytes/task")
+}
+
+// BenchmarkOutputPerLine is a server without batching: one message per line
+func BenchmarkOutputPerLine(b *testing.B) {
+	benchmarkOutput(b, 0)
+}
+
+// BenchmarkOutputPerLineInfo sends one message per line with sequence
+// numbers and timestamps
+func BenchmarkOutputPerLineInfo(b *testing.B) {
+	benchmarkOutput(b, 0, protocol.FeatureLineInfo)
+}
+
+// BenchmarkOutputBatched holds the whole output back until the task ends,
+// as it does for a task finishing within one batch interval
+func BenchmarkOutputBatched(b *testing.B) {
+	benchmarkOutput(b, time.Hour, protocol.FeatureBatch, protocol.FeatureLineInfo)
+}
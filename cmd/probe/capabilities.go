@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// DN42 anycast resolvers, used only to ask the kernel for a route
+const (
+	ipv4ProbeAddr = "172.20.0.53:53"
+	ipv6ProbeAddr = "[fd42:d42:d42:54::1]:53"
+)
+
+var birdSockets = []string{"/run/bird/bird.ctl", "/var/run/bird/bird.ctl", "/run/bird.ctl", "/var/run/bird.ctl"}
+
+// detectCapabilities inspects the local system for connectivity; the task
+// types offered are those of the enabled executors
+func detectCapabilities(executors map[string]Executor) model.ProbeCapabilities {
+	return model.ProbeCapabilities{
+		TaskTypes: taskTypes(executors),
+		Commands:  commandInfos(executors),
+		IPv4:      hasRoute("udp4", ipv4ProbeAddr),
+		IPv6:      hasRoute("udp6", ipv6ProbeAddr),
+		Bird:      hasBird(),
+		Version:   version,
+	}
+}
+
+// hasRoute reports whether the kernel has a route to addr. Connecting a UDP
+// socket performs the route lookup without sending any packet.
+func hasRoute(network, addr string) bool {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// hasBird reports whether birdc is installed and a BIRD control socket exists
+func hasBird() bool {
+	if _, err := exec.LookPath("birdc"); err != nil {
+		return false
+	}
+	for _, path := range birdSockets {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"gopkg.in/yaml.v3"
+)
+
+// commandConfig defines a custom command offered as an extra task type.
+// The command is run directly from argv, never through a shell; {target}
+// and {param} placeholders are replaced by validated values, and elements
+// referring to an optional parameter that was not given are left out. A
+// group of elements written as a list, such as a flag and its value, is
+// left out as a whole.
+type commandConfig struct {
+	Name        string               `yaml:"name"` // task type
+	Description string               `yaml:"description"`
+	Argv        []argvGroup          `yaml:"argv"`   // program and arguments
+	Target      bool                 `yaml:"target"` // whether the command takes a target
+	Params      []model.CommandParam `yaml:"params"`
+}
+
+// argvGroup is an argv element, or a list of elements that are passed or
+// left out together
+type argvGroup []string
+
+// UnmarshalYAML accepts a single string or a list of strings
+func (g *argvGroup) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var arg string
+		if err := value.Decode(&arg); err != nil {
+			return err
+		}
+		*g = argvGroup{arg}
+		return nil
+	}
+	var args []string
+	if err := value.Decode(&args); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("line %d: argv: empty list", value.Line)
+	}
+	*g = args
+	return nil
+}
+
+var (
+	commandNameRe = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+	paramNameRe   = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+	placeholderRe = regexp.MustCompile(`\{([a-z][a-z0-9_]*)\}`)
+
+	// Values of the host and name types; neither may start with "-", so a
+	// value can never be taken for an option
+	hostRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]{0,251}[A-Za-z0-9])?$`)
+	nameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:@-]{0,63}$`)
+)
+
+// validate checks a command definition
+func (c commandConfig) validate() error {
+	if !commandNameRe.MatchString(c.Name) {
+		return fmt.Errorf("name %q must be lowercase letters, digits, - and _", c.Name)
+	}
+	if _, ok := registry[c.Name]; ok {
+		return fmt.Errorf("name %q is a built-in task type", c.Name)
+	}
+	if len(c.Argv) == 0 || len(c.Argv[0]) != 1 || c.Argv[0][0] == "" {
+		return errors.New("argv must name a program")
+	}
+	if placeholderRe.MatchString(c.Argv[0][0]) {
+		return errors.New("argv: the program must not contain placeholders")
+	}
+
+	params := make(map[string]model.CommandParam)
+	for _, p := range c.Params {
+		if !paramNameRe.MatchString(p.Name) || p.Name == "target" {
+			return fmt.Errorf("params: invalid name %q", p.Name)
+		}
+		if _, dup := params[p.Name]; dup {
+			return fmt.Errorf("params: duplicate name %q", p.Name)
+		}
+		params[p.Name] = p
+		switch p.Type {
+		case model.ParamIP, model.ParamPrefix, model.ParamHost, model.ParamName:
+		case model.ParamInt:
+			if (p.Min != nil && *p.Min < 0) || (p.Max != nil && *p.Max < 0) {
+				return fmt.Errorf("params.%s: min and max must not be negative", p.Name)
+			}
+			if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+				return fmt.Errorf("params.%s: min is greater than max", p.Name)
+			}
+		case model.ParamEnum:
+			if len(p.Values) == 0 {
+				return fmt.Errorf("params.%s: enum needs values", p.Name)
+			}
+		default:
+			return fmt.Errorf("params.%s: unknown type %q", p.Name, p.Type)
+		}
+	}
+
+	used := make(map[string]bool)
+	for i, group := range c.Argv {
+		for _, arg := range group {
+			for _, m := range placeholderRe.FindAllStringSubmatch(arg, -1) {
+				name := m[1]
+				if name == "target" && !c.Target {
+					return errors.New("argv uses {target}, but target is not set")
+				}
+				if _, ok := params[name]; !ok && name != "target" {
+					return fmt.Errorf("argv uses {%s}, which is not a parameter", name)
+				}
+				used[name] = true
+			}
+		}
+		// A flag on its own would be passed without the value that follows
+		if i > 1 && len(group) == 1 && len(c.Argv[i-1]) == 1 {
+			flag := c.Argv[i-1][0]
+			if strings.HasPrefix(flag, "-") && !placeholderRe.MatchString(flag) && optionalArg(group[0], params) {
+				return fmt.Errorf("argv: %q would be passed without %q when its parameter is not given; write them as one list, [%q, %q]",
+					flag, group[0], flag, group[0])
+			}
+		}
+	}
+	if c.Target && !used["target"] {
+		return errors.New("target is set, but argv does not use {target}")
+	}
+	for _, p := range c.Params {
+		if !used[p.Name] {
+			return fmt.Errorf("params.%s: not used in argv", p.Name)
+		}
+	}
+	return nil
+}
+
+// optionalArg reports whether arg refers to an optional parameter, and so
+// may be left out
+func optionalArg(arg string, params map[string]model.CommandParam) bool {
+	for _, m := range placeholderRe.FindAllStringSubmatch(arg, -1) {
+		if p, ok := params[m[1]]; ok && p.Optional {
+			return true
+		}
+	}
+	return false
+}
+
+// checkParam validates the value of a parameter
+func checkParam(p model.CommandParam, value string) error {
+	switch p.Type {
+	case model.ParamIP:
+		if _, err := netip.ParseAddr(value); err != nil {
+			return fmt.Errorf("parameter %s: %q is not an IP address", p.Name, value)
+		}
+	case model.ParamPrefix:
+		if _, err := netip.ParsePrefix(value); err != nil {
+			return fmt.Errorf("parameter %s: %q is not a CIDR prefix", p.Name, value)
+		}
+	case model.ParamHost:
+		if _, err := netip.ParseAddr(value); err != nil && !hostRe.MatchString(value) {
+			return fmt.Errorf("parameter %s: %q is not an IP address or hostname", p.Name, value)
+		}
+	case model.ParamName:
+		if !nameRe.MatchString(value) {
+			return fmt.Errorf("parameter %s: %q is not a valid name", p.Name, value)
+		}
+	case model.ParamInt:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("parameter %s: %q is not a non-negative integer", p.Name, value)
+		}
+		if (p.Min != nil && n < *p.Min) || (p.Max != nil && n > *p.Max) {
+			return fmt.Errorf("parameter %s: %d is out of range", p.Name, n)
+		}
+	case model.ParamEnum:
+		if !slices.Contains(p.Values, value) {
+			return fmt.Errorf("parameter %s: must be one of %s", p.Name, strings.Join(p.Values, ", "))
+		}
+	}
+	return nil
+}
+
+// customCommand runs a command from the probe's configuration
+type customCommand struct {
+	cfg commandConfig
+	run *commandExecutor
+}
+
+func newCustomCommand(cfg commandConfig) *customCommand {
+	c := &customCommand{cfg: cfg}
+	c.run = &commandExecutor{
+		taskType: cfg.Name,
+		binary:   cfg.Argv[0][0],
+		args:     c.args,
+	}
+	return c
+}
+
+// Info describes the command to servers and clients
+func (c *customCommand) Info() model.CommandInfo {
+	return model.CommandInfo{
+		Name:        c.cfg.Name,
+		Description: c.cfg.Description,
+		Target:      c.cfg.Target,
+		Params:      c.cfg.Params,
+	}
+}
+
+func (c *customCommand) Type() string { return c.cfg.Name }
+
+func (c *customCommand) Available() bool { return c.run.Available() }
+
+func (c *customCommand) Validate(task model.TaskPayload) error {
+	if c.cfg.Target {
+		if err := validateTarget(task.Target); err != nil {
+			return err
+		}
+	} else if task.Target != "" {
+		return fmt.Errorf("%s takes no target", c.cfg.Name)
+	}
+	if task.Options != "" {
+		return fmt.Errorf("%s takes no options, only parameters", c.cfg.Name)
+	}
+
+	for name := range task.Params {
+		if !slices.ContainsFunc(c.cfg.Params, func(p model.CommandParam) bool { return p.Name == name }) {
+			return fmt.Errorf("%s has no parameter %s", c.cfg.Name, name)
+		}
+	}
+	for _, p := range c.cfg.Params {
+		value, ok := task.Params[p.Name]
+		if !ok || value == "" {
+			if !p.Optional {
+				return fmt.Errorf("%s requires parameter %s", c.cfg.Name, p.Name)
+			}
+			continue
+		}
+		if err := checkParam(p, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *customCommand) Run(ctx context.Context, task model.TaskPayload, out Output) error {
+	return c.run.Run(ctx, task, out)
+}
+
+// args expands the argv template after the program. Each element stays a
+// single argument whatever the values contain. A group with an element
+// referring to a missing optional parameter is left out entirely.
+func (c *customCommand) args(task model.TaskPayload) []string {
+	values := make(map[string]string, len(task.Params)+1)
+	for name, value := range task.Params {
+		values[name] = value
+	}
+	if c.cfg.Target {
+		values["target"] = task.Target
+	}
+
+	var args []string
+	for _, group := range c.cfg.Argv[1:] {
+		missing := false
+		expanded := make([]string, len(group))
+		for i, arg := range group {
+			expanded[i] = placeholderRe.ReplaceAllStringFunc(arg, func(m string) string {
+				value, ok := values[m[1:len(m)-1]]
+				if !ok || value == "" {
+					missing = true
+				}
+				return value
+			})
+		}
+		if !missing {
+			args = append(args, expanded...)
+		}
+	}
+	return args
+}
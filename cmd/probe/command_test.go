@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"gopkg.in/yaml.v3"
+)
+
+func parseCommand(t *testing.T, src string) commandConfig {
+	t.Helper()
+	var cfg commandConfig
+	if err := yaml.Unmarshal([]byte(src), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestCommandArgs(t *testing.T) {
+	cfg := parseCommand(t, `
+name: route-get
+argv: [ip, route, get, "{target}", [from, "{src}"], "--table={table}"]
+target: true
+params:
+  - {name: src, type: ip, optional: true}
+  - {name: table, type: int, optional: true}
+`)
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	cmd := newCustomCommand(cfg)
+	tests := []struct {
+		params map[string]string
+		want   []string
+	}{
+		{nil, []string{"route", "get", "172.20.0.53"}},
+		{map[string]string{"src": "172.20.0.1"}, []string{"route", "get", "172.20.0.53", "from", "172.20.0.1"}},
+		{map[string]string{"table": "42"}, []string{"route", "get", "172.20.0.53", "--table=42"}},
+		{map[string]string{"src": ""}, []string{"route", "get", "172.20.0.53"}},
+	}
+	for _, tt := range tests {
+		task := model.TaskPayload{Type: "route-get", Target: "172.20.0.53", Params: tt.params}
+		if err := cmd.Validate(task); err != nil {
+			t.Errorf("Validate(%v): %v", tt.params, err)
+			continue
+		}
+		if got := cmd.args(task); !slices.Equal(got, tt.want) {
+			t.Errorf("args(%v) = %q, want %q", tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestCommandValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		err  string
+	}{
+		{"dangling flag", `
+name: c
+argv: [tool, --from, "{src}"]
+params: [{name: src, type: ip, optional: true}]`, `"--from" would be passed without "{src}"`},
+		{"flag with required value", `
+name: c
+argv: [tool, --from, "{src}"]
+params: [{name: src, type: ip}]`, ""},
+		{"grouped flag", `
+name: c
+argv: [tool, [--from, "{src}"]]
+params: [{name: src, type: ip, optional: true}]`, ""},
+		{"program in a group", `
+name: c
+argv: [[tool, x]]`, "argv must name a program"},
+		{"unknown placeholder in a group", `
+name: c
+argv: [tool, [-x, "{y}"]]`, "argv uses {y}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseCommand(t, tt.src).validate()
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+		})
+	}
+	var cfg commandConfig
+	if err := yaml.Unmarshal([]byte("argv: [tool, []]"), &cfg); err == nil {
+		t.Error("empty group accepted")
+	}
+}
+
+func TestCommandParamsFollowTargetPolicy(t *testing.T) {
+	cfg := parseCommand(t, `
+name: route-get
+argv: [ip, route, get, "{target}", [from, "{src}"], [match, "{net}"]]
+target: true
+params:
+  - {name: src, type: ip, optional: true}
+  - {name: net, type: prefix, optional: true}
+`)
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	policy := newTargetPolicy(targetPolicyConfig{Allow: []string{"172.20.0.0/14"}, Deny: []string{"172.20.1.0/24"}})
+
+	tests := []struct {
+		params map[string]string
+		err    string
+	}{
+		{nil, ""},
+		{map[string]string{"src": "172.20.0.1", "net": "172.20.0.0/24"}, ""},
+		{map[string]string{"src": "172.20.1.1"}, "parameter src 172.20.1.1"},
+		{map[string]string{"src": "10.0.0.1"}, "parameter src 10.0.0.1"},
+		{map[string]string{"net": "172.20.0.0/16"}, "parameter net 172.20.0.0/16"}, // overlaps the denied /24
+		{map[string]string{"net": "172.16.0.0/12"}, "parameter net 172.16.0.0/12"}, // wider than the allowed /14
+	}
+	for _, tt := range tests {
+		err := policy.CheckParams(cfg.Params, tt.params)
+		if tt.err == "" && err != nil {
+			t.Errorf("CheckParams(%v): %v", tt.params, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("CheckParams(%v) = %v, want error about %s", tt.params, err, tt.err)
+		}
+	}
+
+	// A disallowed parameter fails the task before the command runs
+	probeCfg := &probeConfig{}
+	c := &ProbeClient{cfg: probeCfg, policy: policy, executors: map[string]Executor{"route-get": newCustomCommand(cfg)}, taskCtx: context.Background()}
+	l, s := newTestLink(probeCfg, 8)
+	c.executeTask(job{link: l, task: model.TaskPayload{TaskID: "t1", Type: "route-get", Target: "172.20.0.53", Params: map[string]string{"src": "172.20.1.1"}}})
+	results := sentResults(t, s)
+	if len(results) != 1 || !results[0].IsEnd || !strings.Contains(results[0].Error, "not allowed by this probe's policy") {
+		t.Fatalf("results = %+v, want the task rejected by the policy", results)
+	}
+}
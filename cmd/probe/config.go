@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// serverConfig is one globalping server the probe connects to
+type serverConfig struct {
+	Name  string    `yaml:"name"`  // label used in logs, defaults to the URL host
+	URL   string    `yaml:"url"`   // WebSocket URL of the server's /ws/probe endpoint
+	Token string    `yaml:"token"` // sent as a bearer token when connecting
+	TLS   serverTLS `yaml:"tls"`
+}
+
+// toolConfig enables or restricts a single task type. Zero limits fall
+// back to the probe's task_timeout, max_lines and max_output.
+type toolConfig struct {
+	Enabled        *bool         `yaml:"enabled"`         // overrides tasks if set
+	MaxConcurrency int           `yaml:"max_concurrency"` // 0 means only the global limit applies
+	Timeout        time.Duration `yaml:"timeout"`
+	MaxLines       int           `yaml:"max_lines"`
+	MaxOutput      int           `yaml:"max_output"`
+}
+
+// targetPolicyConfig lists networks the probe will or will not measure
+type targetPolicyConfig struct {
+	Allow []string `yaml:"allow"` // IPs/CIDRs; empty allows every target not denied
+	Deny  []string `yaml:"deny"`
+}
+
+// probeConfig holds all probe settings. Values are resolved in order of
+// increasing precedence: defaults, config file, explicitly set flags.
+type probeConfig struct {
+	Name      string   `yaml:"name"`
+	Location  string   `yaml:"location"`
+	Latitude  float64  `yaml:"lat"`
+	Longitude float64  `yaml:"lon"`
+	ASN       uint32   `yaml:"asn"`
+	Country   string   `yaml:"country"`
+	Region    string   `yaml:"region"`
+	Tags      []string `yaml:"tags"`
+	Addresses []string `yaml:"addresses"` // addresses advertised to servers
+
+	Tasks        []string              `yaml:"tasks"` // enabled task types, empty for every installed tool
+	Tools        map[string]toolConfig `yaml:"tools"`
+	Commands     []commandConfig       `yaml:"commands"` // custom task types
+	TargetPolicy targetPolicyConfig    `yaml:"target_policy"`
+	Sandbox      sandboxConfig         `yaml:"sandbox"`
+
+	TaskTimeout time.Duration `yaml:"task_timeout"` // 0 for no limit
+	MaxLines    int           `yaml:"max_lines"`    // lines of output per task, 0 for no limit
+	MaxOutput   int           `yaml:"max_output"`   // bytes of output per task, 0 for no limit
+
+	MaxConcurrency int `yaml:"max_concurrency"`
+	QueueSize      int `yaml:"queue_size"`
+
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	BatchInterval time.Duration `yaml:"batch_interval"` // 0 sends every output line at once
+	Compression   bool          `yaml:"compression"`
+	JournalSize   int           `yaml:"journal_size"` // bytes of output kept for replay, 0 disables replay
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // how long running tasks may take to finish on shutdown
+
+	Servers []serverConfig `yaml:"servers"`
+}
+
+// loadConfig builds the configuration from flag defaults, the -config file
+// and the flags given on the command line, then validates it
+func loadConfig() (*probeConfig, error) {
+	cfg := &probeConfig{
+		Name:            *probeName,
+		Location:        *location,
+		Latitude:        *latitude,
+		Longitude:       *longitude,
+		MaxConcurrency:  *maxConcurrency,
+		QueueSize:       *queueSize,
+		ReadTimeout:     *readTimeout,
+		WriteTimeout:    *writeTimeout,
+		BatchInterval:   *batchInterval,
+		Compression:     *compression,
+		JournalSize:     *journalSize,
+		ShutdownTimeout: *shutdownTimeout,
+		Sandbox: sandboxConfig{
+			Enabled:   *sandboxTools,
+			CPUTime:   30 * time.Second,
+			MaxMemory: 512 << 20,
+		},
+		TaskTimeout: *taskTimeout,
+		MaxLines:    *maxLines,
+		MaxOutput:   *maxOutput,
+		Servers:     []serverConfig{{URL: *serverURL}},
+	}
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "server":
+			cfg.Servers = []serverConfig{{URL: *serverURL}}
+		case "name":
+			cfg.Name = *probeName
+		case "location":
+			cfg.Location = *location
+		case "lat":
+			cfg.Latitude = *latitude
+		case "lon":
+			cfg.Longitude = *longitude
+		case "asn":
+			cfg.ASN = uint32(*asn)
+		case "country":
+			cfg.Country = *country
+		case "region":
+			cfg.Region = *region
+		case "tags":
+			cfg.Tags = splitTags(*tags)
+		case "max-concurrency":
+			cfg.MaxConcurrency = *maxConcurrency
+		case "queue-size":
+			cfg.QueueSize = *queueSize
+		case "read-timeout":
+			cfg.ReadTimeout = *readTimeout
+		case "write-timeout":
+			cfg.WriteTimeout = *writeTimeout
+		case "batch-interval":
+			cfg.BatchInterval = *batchInterval
+		case "compression":
+			cfg.Compression = *compression
+		case "journal-size":
+			cfg.JournalSize = *journalSize
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = *shutdownTimeout
+		case "sandbox":
+			cfg.Sandbox.Enabled = *sandboxTools
+		case "task-timeout":
+			cfg.TaskTimeout = *taskTimeout
+		case "max-lines":
+			cfg.MaxLines = *maxLines
+		case "max-output":
+			cfg.MaxOutput = *maxOutput
+		}
+	})
+
+	flagTLS := serverTLS{
+		CAFile:   *tlsCA,
+		CertFile: *tlsCert,
+		KeyFile:  *tlsKey,
+		Pins:     splitTags(*tlsPins),
+	}
+	for i := range cfg.Servers {
+		cfg.Servers[i].TLS = cfg.Servers[i].TLS.withDefaults(flagTLS)
+		if cfg.Servers[i].Name == "" {
+			if u, err := url.Parse(cfg.Servers[i].URL); err == nil {
+				cfg.Servers[i].Name = u.Host
+			}
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+// loadFile merges a YAML file into c, rejecting unknown keys
+func (c *probeConfig) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate checks the configuration and reports every problem at once
+func (c *probeConfig) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Name != "", "name: must not be empty")
+	for _, addr := range c.Addresses {
+		check(net.ParseIP(addr) != nil, "addresses: %q is not an IP address", addr)
+	}
+	commands := make(map[string]bool)
+	for i, cmd := range c.Commands {
+		if err := cmd.validate(); err != nil {
+			check(false, "commands[%d]: %v", i, err)
+		}
+		check(!commands[cmd.Name], "commands[%d]: duplicate name %q", i, cmd.Name)
+		commands[cmd.Name] = true
+	}
+	knownTask := func(task string) bool {
+		_, ok := registry[task]
+		return ok || commands[task]
+	}
+	for _, task := range c.Tasks {
+		check(knownTask(task), "tasks: unknown task type %q", task)
+	}
+	for task, tool := range c.Tools {
+		check(knownTask(task), "tools: unknown task type %q", task)
+		check(tool.MaxConcurrency >= 0, "tools.%s.max_concurrency: must not be negative", task)
+		check(tool.Timeout >= 0, "tools.%s.timeout: must not be negative", task)
+		check(tool.MaxLines >= 0, "tools.%s.max_lines: must not be negative", task)
+		check(tool.MaxOutput >= 0, "tools.%s.max_output: must not be negative", task)
+	}
+	for _, list := range [][]string{c.TargetPolicy.Allow, c.TargetPolicy.Deny} {
+		for _, entry := range list {
+			_, err := parsePrefix(entry)
+			check(err == nil, "target_policy: %v", err)
+		}
+	}
+	if err := c.Sandbox.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	check(c.TaskTimeout >= 0, "task_timeout: must not be negative")
+	check(c.MaxLines >= 0, "max_lines: must not be negative")
+	check(c.MaxOutput >= 0, "max_output: must not be negative")
+
+	check(c.MaxConcurrency >= 0, "max_concurrency: must not be negative")
+	check(c.QueueSize >= 0, "queue_size: must not be negative")
+	check(c.ReadTimeout > 0, "read_timeout: must be positive")
+	check(c.WriteTimeout > 0, "write_timeout: must be positive")
+	check(c.BatchInterval >= 0, "batch_interval: must not be negative")
+	check(c.JournalSize >= 0, "journal_size: must not be negative")
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout: must not be negative")
+
+	check(len(c.Servers) > 0, "servers: at least one server is required")
+	names := make(map[string]bool)
+	for i, s := range c.Servers {
+		u, err := url.Parse(s.URL)
+		check(err == nil && (u.Scheme == "ws" || u.Scheme == "wss") && u.Host != "",
+			"servers[%d].url: %q must be a ws:// or wss:// URL", i, s.URL)
+		check(!names[s.Name], "servers[%d].name: duplicate name %q", i, s.Name)
+		names[s.Name] = true
+		tlsErr := s.TLS.validate()
+		check(tlsErr == nil, "servers[%d].tls: %v", i, tlsErr)
+		check(s.TLS.empty() || (err == nil && u.Scheme == "wss"), "servers[%d].tls: requires a wss:// URL", i)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// Executor runs one type of task. Executors are registered by task type,
+// and the probe offers those that are enabled and available.
+type Executor interface {
+	// Type is the task type the executor runs
+	Type() string
+	// Available reports whether the executor can run here, e.g. whether
+	// its tool is installed
+	Available() bool
+	// Validate checks a task's target and options before it is queued
+	Validate(task model.TaskPayload) error
+	// Run executes the task until it ends or ctx is cancelled, sending its
+	// output to out. A returned error fails the task.
+	Run(ctx context.Context, task model.TaskPayload, out Output) error
+}
+
+// Output receives what a running task produces
+type Output interface {
+	// Line sends a line read from the given stream
+	Line(stream, text string)
+	// Result sets the task's structured result, sent with its final result
+	Result(v interface{})
+}
+
+var (
+	registry = make(map[string]Executor)
+	optIn    = make(map[string]bool) // executors offered only when enabled explicitly
+)
+
+// registerExecutor adds an executor to the registry. Opt-in executors are
+// left out unless the configuration enables them.
+func registerExecutor(e Executor, optInOnly bool) {
+	if _, dup := registry[e.Type()]; dup {
+		panic("duplicate executor for task type " + e.Type())
+	}
+	registry[e.Type()] = e
+	optIn[e.Type()] = optInOnly
+}
+
+func init() {
+	registerExecutor(&commandExecutor{
+		taskType: "ping",
+		binary:   "ping",
+		args:     toolArgs("-c", "10"),
+		summary:  func() summary { return &pingSummary{} },
+	}, false)
+	registerExecutor(&commandExecutor{
+		taskType: "traceroute",
+		binary:   "traceroute",
+		args:     toolArgs(),
+	}, false)
+	registerExecutor(&commandExecutor{
+		taskType: "mtr",
+		binary:   "mtr",
+		args:     toolArgs("-r", "-c", "10", "--no-dns"),
+	}, false)
+}
+
+// registerCommands adds the custom commands of the configuration to the
+// registry
+func registerCommands(cfg *probeConfig) {
+	for _, cmd := range cfg.Commands {
+		registerExecutor(newCustomCommand(cmd), false)
+	}
+}
+
+// useSandbox makes every registered command executor, custom commands
+// included, start its tool through the sandbox
+func useSandbox(sb *sandbox) {
+	for _, e := range registry {
+		switch e := e.(type) {
+		case *commandExecutor:
+			e.sandbox = sb
+		case *customCommand:
+			e.run.sandbox = sb
+		}
+	}
+}
+
+// enabledExecutors returns the registered executors the configuration
+// enables and that can run here. tools.<type>.enabled decides if set;
+// otherwise custom commands are enabled, a non-empty tasks list decides
+// for the rest, and without one every executor that is not opt-in is.
+func enabledExecutors(cfg *probeConfig) map[string]Executor {
+	enabled := make(map[string]Executor)
+	for taskType, e := range registry {
+		if tool := cfg.Tools[taskType]; tool.Enabled != nil {
+			if !*tool.Enabled {
+				continue
+			}
+		} else if _, custom := e.(*customCommand); custom {
+			// defined by the operator, so wanted
+		} else if len(cfg.Tasks) > 0 {
+			if !slices.Contains(cfg.Tasks, taskType) {
+				continue
+			}
+		} else if optIn[taskType] {
+			continue
+		}
+		if !e.Available() {
+			log.Printf("Task type %s is enabled but cannot run here", taskType)
+			continue
+		}
+		enabled[taskType] = e
+	}
+	return enabled
+}
+
+// taskTypes returns the task types of executors, sorted
+func taskTypes(executors map[string]Executor) []string {
+	types := make([]string, 0, len(executors))
+	for taskType := range executors {
+		types = append(types, taskType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// commandInfos describes the custom commands among executors, sorted by name
+func commandInfos(executors map[string]Executor) []model.CommandInfo {
+	var infos []model.CommandInfo
+	for _, taskType := range taskTypes(executors) {
+		if cmd, ok := executors[taskType].(*customCommand); ok {
+			infos = append(infos, cmd.Info())
+		}
+	}
+	return infos
+}
+
+// validateTarget rejects targets a tool could mistake for options
+func validateTarget(target string) error {
+	if target == "" {
+		return errors.New("target must not be empty")
+	}
+	if strings.HasPrefix(target, "-") {
+		return fmt.Errorf("invalid target %q", target)
+	}
+	if strings.IndexFunc(target, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return fmt.Errorf("invalid target %q", target)
+	}
+	return nil
+}
+
+// waitDelay is how long processes a tool started may keep writing its
+// output after it exited
+const waitDelay = time.Second
+
+// summary builds a structured result from a tool's standard output
+type summary interface {
+	line(text string)
+	// result returns nil if the output held nothing to summarize
+	result() interface{}
+}
+
+// commandExecutor runs a program and streams its stdout and stderr line
+// by line
+type commandExecutor struct {
+	taskType string
+	binary   string
+	args     func(task model.TaskPayload) []string // every argument after the program
+	summary  func() summary                        // may be nil
+	sandbox  *sandbox
+}
+
+// toolArgs passes fixed arguments, then the task's options and the target
+func toolArgs(fixed ...string) func(model.TaskPayload) []string {
+	return func(task model.TaskPayload) []string {
+		args := append([]string(nil), fixed...)
+		args = append(args, strings.Fields(task.Options)...)
+		return append(args, task.Target)
+	}
+}
+
+func (e *commandExecutor) Type() string { return e.taskType }
+
+func (e *commandExecutor) Available() bool {
+	_, err := exec.LookPath(e.binary)
+	return err == nil
+}
+
+func (e *commandExecutor) Validate(task model.TaskPayload) error {
+	if len(task.Params) > 0 {
+		return fmt.Errorf("%s takes no parameters", e.taskType)
+	}
+	return validateTarget(task.Target)
+}
+
+func (e *commandExecutor) Run(ctx context.Context, task model.TaskPayload, out Output) error {
+	cmd, err := e.sandbox.command(ctx, e.binary, e.args(task))
+	if err != nil {
+		return err
+	}
+
+	// The tool writes into pipes of our own, so Wait returns once it has
+	// exited even if processes it started keep its output open; they get
+	// waitDelay to finish writing
+	stdout, stdoutW := io.Pipe()
+	stderr, stderrW := io.Pipe()
+	cmd.Stdout, cmd.Stderr = stdoutW, stderrW
+	cmd.WaitDelay = waitDelay
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var sum summary
+	if e.summary != nil {
+		sum = e.summary()
+	}
+
+	// Read stdout and stderr line by line and send
+	var outOfMemory atomic.Bool
+	var readers sync.WaitGroup
+	for stream, pipe := range map[string]io.Reader{model.StreamStdout: stdout, model.StreamStderr: stderr} {
+		readers.Add(1)
+		go func(stream string, pipe io.Reader) {
+			defer readers.Done()
+			scanner := bufio.NewScanner(pipe)
+			for scanner.Scan() {
+				out.Line(stream, scanner.Text())
+				if sum != nil && stream == model.StreamStdout {
+					sum.line(scanner.Text())
+				}
+				if stream == model.StreamStderr && outOfMemoryRe.MatchString(scanner.Text()) {
+					outOfMemory.Store(true)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				// Keep draining so the tool does not block on a full pipe
+				out.Line(model.StreamMeta, fmt.Sprintf("%s: %v, the rest of the stream was discarded", stream, err))
+				io.Copy(io.Discard, pipe)
+			}
+		}(stream, pipe)
+	}
+
+	err = cmd.Wait()
+	stdoutW.Close()
+	stderrW.Close()
+	readers.Wait()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// The tool itself succeeded
+		out.Line(model.StreamMeta, "processes started by the tool still held its output open and were cut off")
+		err = nil
+	}
+
+	// A summary is kept even if the tool fails, e.g. ping when no reply arrived
+	if sum != nil {
+		if result := sum.result(); result != nil {
+			out.Result(result)
+		}
+	}
+	if ctx.Err() != nil {
+		// Killed on cancellation, not by a resource limit
+		return err
+	}
+	return e.sandbox.explain(err, outOfMemory.Load())
+}
+
+// marshalResult encodes a structured result, logging what cannot be encoded
+func marshalResult(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode task result: %v", err)
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+)
+
+func TestRegistryLookup(t *testing.T) {
+	for _, taskType := range []string{"ping", "traceroute", "mtr", "fake"} {
+		e, ok := registry[taskType]
+		if !ok {
+			t.Errorf("no executor for %s", taskType)
+			continue
+		}
+		if e.Type() != taskType {
+			t.Errorf("registry[%s].Type() = %s", taskType, e.Type())
+		}
+	}
+	if _, ok := registry["nonexistent"]; ok {
+		t.Error("unknown task type found")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a duplicate did not panic")
+		}
+	}()
+	registerExecutor(fakeExecutor{}, true)
+}
+
+func TestEnabledExecutors(t *testing.T) {
+	registerCommands(&probeConfig{Commands: []commandConfig{{Name: "test-echo", Argv: []argvGroup{{"echo"}}}}})
+	t.Cleanup(func() { delete(registry, "test-echo") })
+
+	on, off := true, false
+	tests := []struct {
+		name    string
+		cfg     probeConfig
+		want    []string
+		notWant []string
+	}{
+		{"opt-in left out by default", probeConfig{}, []string{"test-echo"}, []string{"fake"}},
+		{"tasks list", probeConfig{Tasks: []string{"fake"}}, []string{"fake", "test-echo"}, []string{"ping", "traceroute", "mtr"}},
+		{"enabled explicitly", probeConfig{Tools: map[string]toolConfig{"fake": {Enabled: &on}}}, []string{"fake"}, nil},
+		{"disabled overrides tasks", probeConfig{Tasks: []string{"fake"}, Tools: map[string]toolConfig{"fake": {Enabled: &off}}}, nil, []string{"fake"}},
+		{"custom command disabled", probeConfig{Tools: map[string]toolConfig{"test-echo": {Enabled: &off}}}, nil, []string{"test-echo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enabled := enabledExecutors(&tt.cfg)
+			for _, taskType := range tt.want {
+				if _, ok := enabled[taskType]; !ok {
+					t.Errorf("%s not enabled", taskType)
+				}
+			}
+			for _, taskType := range tt.notWant {
+				if _, ok := enabled[taskType]; ok {
+					t.Errorf("%s enabled", taskType)
+				}
+			}
+		})
+	}
+}
+
+func TestCapabilitiesReportEnabledExecutors(t *testing.T) {
+	cmd := newCustomCommand(commandConfig{Name: "test-echo", Description: "Echo", Argv: []argvGroup{{"echo"}}})
+	caps := detectCapabilities(map[string]Executor{
+		"test-echo": cmd,
+		"fake":      fakeExecutor{},
+		"ping":      registry["ping"],
+	})
+	if want := []string{"fake", "ping", "test-echo"}; !slices.Equal(caps.TaskTypes, want) {
+		t.Errorf("TaskTypes = %v, want %v", caps.TaskTypes, want)
+	}
+	if len(caps.Commands) != 1 || caps.Commands[0].Name != "test-echo" {
+		t.Errorf("Commands = %+v, want test-echo only", caps.Commands)
+	}
+	if caps.Version != version {
+		t.Errorf("Version = %q, want %q", caps.Version, version)
+	}
+}
+
+// sentResults decodes the task results queued on a test session
+func sentResults(t *testing.T, s *session) []model.TaskResultPayload {
+	t.Helper()
+	var results []model.TaskResultPayload
+	for {
+		select {
+		case data := <-s.sendCh:
+			msg, err := protocol.ProbeToServer.Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != model.MsgTypeTaskResult {
+				continue
+			}
+			result, err := protocol.DecodePayload[model.TaskResultPayload](msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, result)
+		default:
+			return results
+		}
+	}
+}
+
+func TestExecuteTask(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		lines   int
+		err     string
+	}{
+		{"succeeds", "-lines 3 -interval 0", 3, ""},
+		{"fails", "-lines 2 -interval 0 -fail boom", 2, "boom"},
+		{"line limit", "-lines 10 -interval 0", 5, "Task stopped: output limit of 5 lines exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &probeConfig{MaxLines: 5}
+			c := &ProbeClient{cfg: cfg, executors: map[string]Executor{"fake": fakeExecutor{}}, taskCtx: context.Background()}
+			l, s := newTestLink(cfg, 32, protocol.FeatureLineInfo, protocol.FeatureResultData)
+			c.executeTask(job{link: l, task: model.TaskPayload{TaskID: "t1", Type: "fake", Target: "example", Options: tt.options}})
+
+			results := sentResults(t, s)
+			if len(results) != tt.lines+1 {
+				t.Fatalf("got %d results, want %d lines and the final result", len(results), tt.lines)
+			}
+			final := results[len(results)-1]
+			if !final.IsEnd || final.Error != tt.err {
+				t.Errorf("final result = %+v, want error %q", final, tt.err)
+			}
+		})
+	}
+}
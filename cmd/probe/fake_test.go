@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// fakeExecutor runs the "fake" task type, which prints made-up output
+// without any tool installed. It is registered as opt-in, for tests only.
+type fakeExecutor struct{}
+
+func init() {
+	registerExecutor(fakeExecutor{}, true)
+}
+
+// fakeOptions are the options of a fake task
+type fakeOptions struct {
+	lines    int
+	interval time.Duration
+	stderr   int // every stderr-th line goes to stderr, 0 for none
+	fail     string
+}
+
+// fakeResult is the structured result of a fake task
+type fakeResult struct {
+	Target string `json:"target"`
+	Lines  int    `json:"lines"`
+}
+
+func parseFakeOptions(options string) (fakeOptions, error) {
+	var opts fakeOptions
+	fs := flag.NewFlagSet("fake", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.IntVar(&opts.lines, "lines", 10, "")
+	fs.DurationVar(&opts.interval, "interval", 100*time.Millisecond, "")
+	fs.IntVar(&opts.stderr, "stderr", 0, "")
+	fs.StringVar(&opts.fail, "fail", "", "")
+	if err := fs.Parse(strings.Fields(options)); err != nil {
+		return opts, fmt.Errorf("invalid options: %v", err)
+	}
+	switch {
+	case fs.NArg() > 0:
+		return opts, fmt.Errorf("invalid options: unexpected %q", fs.Arg(0))
+	case opts.lines < 0 || opts.lines > 100000:
+		return opts, errors.New("invalid options: -lines must be between 0 and 100000")
+	case opts.interval < 0 || opts.interval > time.Minute:
+		return opts, errors.New("invalid options: -interval must be between 0 and 1m")
+	case opts.stderr < 0:
+		return opts, errors.New("invalid options: -stderr must not be negative")
+	}
+	return opts, nil
+}
+
+func (fakeExecutor) Type() string { return "fake" }
+
+func (fakeExecutor) Available() bool { return true }
+
+func (fakeExecutor) Validate(task model.TaskPayload) error {
+	if len(task.Params) > 0 {
+		return errors.New("fake takes no parameters")
+	}
+	if err := validateTarget(task.Target); err != nil {
+		return err
+	}
+	_, err := parseFakeOptions(task.Options)
+	return err
+}
+
+func (fakeExecutor) Run(ctx context.Context, task model.TaskPayload, out Output) error {
+	opts, err := parseFakeOptions(task.Options)
+	if err != nil {
+		return err
+	}
+	for i := 1; i <= opts.lines; i++ {
+		if i > 1 {
+			select {
+			case <-time.After(opts.interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		stream := model.StreamStdout
+		if opts.stderr > 0 && i%opts.stderr == 0 {
+			stream = model.StreamStderr
+		}
+		out.Line(stream, fmt.Sprintf("fake %s line %d/%d", task.Target, i, opts.lines))
+	}
+	out.Result(fakeResult{Target: task.Target, Lines: opts.lines})
+	if opts.fail != "" {
+		return errors.New(opts.fail)
+	}
+	return nil
+}
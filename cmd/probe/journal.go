@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// journal keeps the results sent to one server until the server
+// acknowledges them, so they can be replayed after a reconnect. Results are
+// numbered per task. At most maxBytes of output is kept; beyond that the
+// oldest output is discarded, but final results are always kept.
+type journal struct {
+	maxBytes int
+
+	mu        sync.Mutex
+	seq       map[string]uint64 // task ID -> last sequence number assigned
+	entries   []model.TaskResultPayload
+	size      int
+	discarded int // lines discarded since the last call to takeDiscarded
+}
+
+func newJournal(maxBytes int) *journal {
+	return &journal{
+		maxBytes: maxBytes,
+		seq:      make(map[string]uint64),
+	}
+}
+
+// record numbers a result and keeps it until it is acknowledged
+func (j *journal) record(result *model.TaskResultPayload) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq[result.TaskID]++
+	result.Seq = j.seq[result.TaskID]
+	j.entries = append(j.entries, *result)
+	j.size += resultSize(*result)
+
+	for i := 0; j.size > j.maxBytes && i < len(j.entries); {
+		if j.entries[i].IsEnd {
+			i++
+			continue
+		}
+		j.size -= resultSize(j.entries[i])
+		j.discarded += len(j.entries[i].Output) + len(j.entries[i].Lines)
+		if j.entries[i].Line != "" {
+			j.discarded++
+		}
+		j.entries = append(j.entries[:i], j.entries[i+1:]...)
+	}
+}
+
+// ack forgets every result of the task up to and including seq, and the
+// task itself once its final result has been acknowledged
+func (j *journal) ack(taskID string, seq uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	kept := j.entries[:0]
+	for _, entry := range j.entries {
+		if entry.TaskID != taskID || entry.Seq > seq {
+			kept = append(kept, entry)
+			continue
+		}
+		j.size -= resultSize(entry)
+		if entry.IsEnd {
+			delete(j.seq, taskID)
+		}
+	}
+	clear(j.entries[len(kept):])
+	j.entries = kept
+}
+
+// unacknowledged returns the results still waiting for an acknowledgement,
+// in the order they were recorded
+func (j *journal) unacknowledged() []model.TaskResultPayload {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]model.TaskResultPayload(nil), j.entries...)
+}
+
+// reset forgets every result, for a server that no longer knows the tasks
+func (j *journal) reset() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seq = make(map[string]uint64)
+	j.entries = nil
+	j.size = 0
+}
+
+// takeDiscarded returns and clears the number of lines discarded for lack of room
+func (j *journal) takeDiscarded() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	n := j.discarded
+	j.discarded = 0
+	return n
+}
+
+// resultSize approximates the memory a result holds
+func resultSize(result model.TaskResultPayload) int {
+	n := len(result.TaskID) + len(result.Line) + len(result.Error) + len(result.Data)
+	for _, line := range result.Lines {
+		n += len(line)
+	}
+	for _, line := range result.Output {
+		n += len(line.Text) + len(line.Stream) + 32
+	}
+	return n
+}
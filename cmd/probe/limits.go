@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// taskLimits bound a running task; zero fields set no limit
+type taskLimits struct {
+	timeout  time.Duration
+	maxLines int
+	maxBytes int
+}
+
+// limitsFor returns the limits a task runs with: the probe's own for its
+// type, lowered by the limits the server sent with the task
+func (c *probeConfig) limitsFor(task model.TaskPayload) taskLimits {
+	limits := taskLimits{timeout: c.TaskTimeout, maxLines: c.MaxLines, maxBytes: c.MaxOutput}
+	tool := c.Tools[task.Type]
+	if tool.Timeout > 0 {
+		limits.timeout = tool.Timeout
+	}
+	if tool.MaxLines > 0 {
+		limits.maxLines = tool.MaxLines
+	}
+	if tool.MaxOutput > 0 {
+		limits.maxBytes = tool.MaxOutput
+	}
+	if l := task.Limits; l != nil {
+		limits.timeout = time.Duration(lowerLimit(int(limits.timeout), int(time.Duration(l.Timeout)*time.Second)))
+		limits.maxLines = lowerLimit(limits.maxLines, l.MaxLines)
+		limits.maxBytes = lowerLimit(limits.maxBytes, l.MaxBytes)
+	}
+	return limits
+}
+
+// lowerLimit returns the lower of two limits, where 0 means no limit
+func lowerLimit(a, b int) int {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// limitedOutput passes a task's output on until it exceeds its line or
+// byte limit, then drops the rest and cancels the task
+type limitedOutput struct {
+	Output
+	limits taskLimits
+	cancel context.CancelCauseFunc
+
+	mu       sync.Mutex
+	lines    int
+	bytes    int
+	exceeded bool
+}
+
+func (o *limitedOutput) Line(stream, text string) {
+	o.mu.Lock()
+	if o.exceeded {
+		o.mu.Unlock()
+		return
+	}
+	o.lines++
+	o.bytes += len(text) + 1
+	var cause error
+	switch {
+	case o.limits.maxLines > 0 && o.lines > o.limits.maxLines:
+		cause = fmt.Errorf("Task stopped: output limit of %d lines exceeded", o.limits.maxLines)
+	case o.limits.maxBytes > 0 && o.bytes > o.limits.maxBytes:
+		cause = fmt.Errorf("Task stopped: output limit of %d bytes exceeded", o.limits.maxBytes)
+	}
+	o.exceeded = cause != nil
+	o.mu.Unlock()
+
+	if cause != nil {
+		o.cancel(cause)
+		return
+	}
+	o.Output.Line(stream, text)
+}
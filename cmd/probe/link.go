@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+)
+
+// link is the probe's relationship with one server across reconnects.
+// Tasks report to the link rather than to a session, so they keep running
+// while the probe reconnects. With servers that negotiated the resume
+// feature, results are journaled until acknowledged and replayed to the
+// next session.
+type link struct {
+	probe   *ProbeClient
+	server  serverConfig
+	journal *journal
+	batch   *batcher
+
+	mu       sync.Mutex // keeps results in order, also against replays
+	session  *session   // nil while disconnected
+	probeID  string     // assigned by the server, offered again when reconnecting
+	token    string     // resume token issued with probeID
+	features []string   // negotiated with the latest session
+}
+
+func newLink(c *ProbeClient, server serverConfig) *link {
+	l := &link{
+		probe:   c,
+		server:  server,
+		journal: newJournal(c.cfg.JournalSize),
+	}
+	l.batch = newBatcher(l)
+	return l
+}
+
+// resumeID returns the probe ID to continue with when reconnecting, if
+// any, and the resume token proving the probe owns it
+func (l *link) resumeID() (string, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !protocol.HasFeature(l.features, protocol.FeatureResume) {
+		return "", ""
+	}
+	return l.probeID, l.token
+}
+
+// attach makes s the session results are sent to, and calls start once
+// it is. If the server resumed the previous probe ID, unacknowledged
+// results are replayed before any new ones; otherwise the server does not
+// know the tasks and the journal is dropped.
+func (l *link) attach(s *session, start func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	resumed := l.probeID != "" && s.probeID == l.probeID && protocol.HasFeature(s.features, protocol.FeatureResume)
+	l.session = s
+	l.probeID = s.probeID
+	l.token = s.resumeToken
+	l.features = s.features
+	start()
+	if !resumed {
+		l.journal.reset()
+		return
+	}
+
+	pending := l.journal.unacknowledged()
+	if n := l.journal.takeDiscarded(); n > 0 {
+		log.Printf("[%s] Journal was full, %d lines of output were lost", l.server.Name, n)
+	}
+	if len(pending) > 0 {
+		log.Printf("[%s] Resumed as %s, replaying %d results", l.server.Name, l.probeID, len(pending))
+	}
+	for _, result := range pending {
+		s.sendResult(result)
+	}
+}
+
+// detach stops sending results to s
+func (l *link) detach(s *session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.session == s {
+		l.session = nil
+	}
+}
+
+// deliverable reports whether results of a task would still reach the
+// server: over the current session, or later by replaying the journal
+func (l *link) deliverable() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return (l.session != nil && l.session.alive()) || l.journaling()
+}
+
+// journaling reports whether results are kept for replay; callers hold mu
+func (l *link) journaling() bool {
+	return l.probe.cfg.JournalSize > 0 && protocol.HasFeature(l.features, protocol.FeatureResume)
+}
+
+// batching reports whether output is collected and sent in batches
+func (l *link) batching() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.probe.cfg.BatchInterval > 0 && protocol.HasFeature(l.features, protocol.FeatureBatch)
+}
+
+// sendLine sends a line of task output. With batching, lines are collected
+// and sent together.
+func (l *link) sendLine(taskID string, line model.OutputLine) {
+	if l.batching() {
+		l.batch.add(taskID, line)
+		return
+	}
+	l.emit(model.TaskResultPayload{
+		TaskID: taskID,
+		Output: []model.OutputLine{line},
+	})
+}
+
+// finish sends a task's final result, failed if errMsg is not empty and
+// with its structured result if any, together with output still held back
+func (l *link) finish(taskID, errMsg string, data json.RawMessage) {
+	final := model.TaskResultPayload{
+		TaskID: taskID,
+		IsEnd:  true,
+		Error:  errMsg,
+		Data:   data,
+	}
+	if l.batching() {
+		l.batch.end(final)
+		return
+	}
+	l.emit(final)
+}
+
+// emit journals a result if the server supports resuming, and sends it
+// if connected. Servers without the line_info feature get the output as
+// plain text, and those without result_data no structured result.
+func (l *link) emit(result model.TaskResultPayload) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !protocol.HasFeature(l.features, protocol.FeatureLineInfo) {
+		for _, line := range result.Output {
+			result.Lines = append(result.Lines, line.Text)
+		}
+		if !protocol.HasFeature(l.features, protocol.FeatureBatch) && len(result.Lines) == 1 {
+			result.Line, result.Lines = result.Lines[0], nil
+		}
+		result.Output = nil
+	}
+	if !protocol.HasFeature(l.features, protocol.FeatureResultData) {
+		result.Data = nil
+	}
+	if l.journaling() {
+		l.journal.record(&result)
+	}
+	if l.session != nil {
+		l.session.sendResult(result)
+	}
+}
+
+// taskOutput numbers and timestamps the output of one task, and is the
+// Output its executor writes to. Lines are read from stdout and stderr
+// concurrently; numbering and sending them under one lock keeps the
+// sequence numbers in the order the lines are sent.
+type taskOutput struct {
+	link   *link
+	taskID string
+
+	mu   sync.Mutex
+	seq  uint64
+	data json.RawMessage
+}
+
+func newTaskOutput(l *link, taskID string) *taskOutput {
+	return &taskOutput{link: l, taskID: taskID}
+}
+
+// Line sends a line read from the given stream
+func (o *taskOutput) Line(stream, text string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.seq++
+	o.link.sendLine(o.taskID, model.OutputLine{
+		Seq:    o.seq,
+		Time:   time.Now(),
+		Stream: stream,
+		Text:   text,
+	})
+}
+
+// Result sets the structured result sent with the final result
+func (o *taskOutput) Result(v interface{}) {
+	data := marshalResult(v)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.data = data
+}
+
+// finish sends the task's final result, failed if errMsg is not empty
+func (o *taskOutput) finish(errMsg string) {
+	o.mu.Lock()
+	data := o.data
+	o.mu.Unlock()
+	o.link.finish(o.taskID, errMsg, data)
+}
+
+// sendStatus reports a task's queue status, if connected and the server
+// wants it
+func (l *link) sendStatus(status model.TaskStatusPayload) {
+	l.mu.Lock()
+	s := l.session
+	l.mu.Unlock()
+	if s != nil {
+		s.sendStatus(status)
+	}
+}
@@ -1,252 +1,203 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/bingxin666/dn42-globalping/internal/model"
-	"github.com/gorilla/websocket"
 )
 
 var (
+	configPath = flag.String("config", "", "Path to a YAML config file; flags given on the command line override it")
+
 	serverURL = flag.String("server", "ws://localhost:8080/ws/probe", "WebSocket server URL")
+	tlsCA     = flag.String("tls-ca", "", "CA bundle for verifying wss:// servers instead of the system roots")
+	tlsCert   = flag.String("tls-cert", "", "Client certificate for mutual TLS (CN must match -name)")
+	tlsKey    = flag.String("tls-key", "", "Private key of the client certificate")
+	tlsPins   = flag.String("tls-pin", "", "Comma-separated base64 SHA-256 pins of accepted server public keys")
 	probeName = flag.String("name", "probe-1", "Probe name")
 	location  = flag.String("location", "Beijing, China", "Probe location")
 	latitude  = flag.Float64("lat", 39.9042, "Latitude")
 	longitude = flag.Float64("lon", 116.4074, "Longitude")
-)
+	asn       = flag.Uint("asn", 0, "DN42 ASN the probe is located in")
+	country   = flag.String("country", "", "ISO 3166-1 alpha-2 country code")
+	region    = flag.String("region", "", "Region code (e.g. eu, na, as)")
+	tags      = flag.String("tags", "", "Comma-separated list of free-form tags")
 
-type ProbeClient struct {
-	conn    *websocket.Conn
-	probeID string
-	sendCh  chan []byte
-}
+	maxConcurrency = flag.Int("max-concurrency", 2, "Maximum number of tasks run at once (0 for unlimited)")
+	queueSize      = flag.Int("queue-size", 8, "Maximum number of tasks waiting for a free slot")
 
-func main() {
-	flag.Parse()
+	readTimeout  = flag.Duration("read-timeout", 75*time.Second, "Consider the server dead after this long without any frame")
+	writeTimeout = flag.Duration("write-timeout", 10*time.Second, "WebSocket write timeout")
 
-	client := &ProbeClient{
-		sendCh: make(chan []byte, 256),
-	}
+	batchInterval = flag.Duration("batch-interval", 50*time.Millisecond, "Collect task output for this long before sending it (0 sends every line at once)")
+	compression   = flag.Bool("compression", true, "Offer permessage-deflate compression to servers")
 
-	// Connect to server
-	if err := client.connect(); err != nil {
-		log.Fatal(err)
-	}
-	defer client.conn.Close()
+	journalSize = flag.Int("journal-size", 1<<20, "Bytes of task output kept for replay after a reconnect (0 disables replay)")
 
-	// Setup signal handling
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sandboxTools = flag.Bool("sandbox", sandboxSupported, "Run tools through the sandbox helper with resource limits (Linux only)")
+	taskTimeout  = flag.Duration("task-timeout", 2*time.Minute, "Kill tasks running longer than this (0 for no limit)")
+	maxLines     = flag.Int("max-lines", 10000, "Kill tasks producing more than this many lines of output (0 for no limit)")
+	maxOutput    = flag.Int("max-output", 1<<20, "Kill tasks producing more than this many bytes of output (0 for no limit)")
 
-	// Start writer goroutine
-	go client.writer()
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second, "How long running tasks may take to finish on shutdown")
+)
 
-	// Start heartbeat goroutine
-	go client.heartbeat()
+// ProbeClient holds state shared by the connections to every server
+type ProbeClient struct {
+	cfg          *probeConfig
+	capabilities model.ProbeCapabilities
+	executors    map[string]Executor // by the task type they run
+	policy       targetPolicy
+	pool         *taskPool
 
-	// Start reader in main goroutine
-	go client.reader()
+	taskCtx     context.Context // cancelled to kill running tasks on shutdown
+	cancelTasks context.CancelFunc
 
-	// Wait for signal
-	<-sigCh
-	log.Println("Shutting down...")
+	sessionsMu sync.Mutex
+	sessions   map[*session]bool
 }
 
-func (c *ProbeClient) connect() error {
-	log.Printf("Connecting to %s", *serverURL)
-
-	conn, _, err := websocket.DefaultDialer.Dial(*serverURL, nil)
-	if err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
-	}
-	c.conn = conn
-
-	// Send registration message
-	registerMsg := model.Message{
-		Type: model.MsgTypeRegister,
-		Payload: model.RegisterPayload{
-			Name:      *probeName,
-			Location:  *location,
-			Latitude:  *latitude,
-			Longitude: *longitude,
-		},
-	}
-	data, _ := json.Marshal(registerMsg)
-	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
-		return fmt.Errorf("failed to send registration: %w", err)
+func main() {
+	// The probe re-executes itself as the sandbox helper to start tools
+	if len(os.Args) > 1 && os.Args[1] == sandboxArg {
+		runSandboxHelper(os.Args[2:])
 	}
+	flag.Parse()
 
-	// Wait for registration response
-	_, message, err := conn.ReadMessage()
+	cfg, err := loadConfig()
 	if err != nil {
-		return fmt.Errorf("failed to read registration response: %w", err)
-	}
-
-	var msg model.Message
-	if err := json.Unmarshal(message, &msg); err != nil {
-		return fmt.Errorf("failed to parse registration response: %w", err)
+		log.Fatal(err)
 	}
 
-	if msg.Type == model.MsgTypeRegister {
-		payloadBytes, _ := json.Marshal(msg.Payload)
-		var payload map[string]string
-		json.Unmarshal(payloadBytes, &payload)
-		c.probeID = payload["probe_id"]
-		log.Printf("Registered with ID: %s", c.probeID)
+	registerCommands(cfg)
+	useSandbox(newSandbox(cfg.Sandbox))
+	executors := enabledExecutors(cfg)
+	client := &ProbeClient{
+		cfg:          cfg,
+		capabilities: detectCapabilities(executors),
+		executors:    executors,
+		policy:       newTargetPolicy(cfg.TargetPolicy),
+		sessions:     make(map[*session]bool),
+	}
+	client.taskCtx, client.cancelTasks = context.WithCancel(context.Background())
+	client.capabilities.MaxConcurrency = cfg.MaxConcurrency
+	client.capabilities.QueueSize = cfg.QueueSize
+	toolLimits := make(map[string]int)
+	for taskType, tool := range cfg.Tools {
+		toolLimits[taskType] = tool.MaxConcurrency
+	}
+	client.pool = newTaskPool(cfg.MaxConcurrency, cfg.QueueSize, toolLimits, client.executeTask,
+		func(j job, status model.TaskStatusPayload) { j.link.sendStatus(status) })
+	log.Printf("Capabilities: tasks=%v ipv4=%t ipv6=%t bird=%t version=%s",
+		client.capabilities.TaskTypes, client.capabilities.IPv4, client.capabilities.IPv6,
+		client.capabilities.Bird, client.capabilities.Version)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Connect to every server independently
+	for _, server := range cfg.Servers {
+		dialer, err := server.TLS.dialer()
+		if err != nil {
+			log.Fatalf("[%s] %v", server.Name, err)
+		}
+		dialer.EnableCompression = cfg.Compression
+		go client.runServer(ctx, server, dialer)
 	}
 
-	return nil
+	<-ctx.Done()
+	stop() // a second signal kills the probe immediately
+	client.shutdown()
 }
 
-func (c *ProbeClient) reader() {
-	for {
-		_, message, err := c.conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Connection error: %v", err)
-			}
-			return
-		}
+// shutdown stops accepting tasks, gives running ones until the shutdown
+// timeout to finish, cancels the rest, and closes every connection
+func (c *ProbeClient) shutdown() {
+	log.Printf("Shutting down, waiting up to %s for running tasks", c.cfg.ShutdownTimeout)
 
-		var msg model.Message
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("Failed to parse message: %v", err)
-			continue
-		}
+	for _, j := range c.pool.Close() {
+		j.link.finish(j.task.TaskID, "Task cancelled: probe is shutting down", nil)
+	}
 
-		switch msg.Type {
-		case model.MsgTypeTask:
-			payloadBytes, _ := json.Marshal(msg.Payload)
-			var taskPayload model.TaskPayload
-			if err := json.Unmarshal(payloadBytes, &taskPayload); err != nil {
-				log.Printf("Failed to parse task payload: %v", err)
-				continue
-			}
-			log.Printf("Received task: %s - %s %s", taskPayload.TaskID, taskPayload.Type, taskPayload.Target)
-			go c.executeTask(taskPayload)
-		}
+	waitCtx, cancel := context.WithTimeout(context.Background(), c.cfg.ShutdownTimeout)
+	defer cancel()
+	if !c.pool.Wait(waitCtx) {
+		log.Println("Cancelling tasks that are still running")
+		c.cancelTasks()
+		killCtx, cancelKill := context.WithTimeout(context.Background(), c.cfg.WriteTimeout)
+		defer cancelKill()
+		c.pool.Wait(killCtx)
 	}
-}
 
-func (c *ProbeClient) writer() {
-	for message := range c.sendCh {
-		if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Printf("Failed to send message: %v", err)
-			return
-		}
+	var wg sync.WaitGroup
+	for _, s := range c.liveSessions() {
+		wg.Add(1)
+		go func(s *session) {
+			defer wg.Done()
+			s.close(c.cfg.WriteTimeout)
+		}(s)
 	}
+	wg.Wait()
+	log.Println("Probe stopped")
 }
 
-func (c *ProbeClient) heartbeat() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		msg := model.Message{
-			Type:    model.MsgTypeHeartbeat,
-			Payload: nil,
+// splitTags parses the comma-separated -tags flag
+func splitTags(s string) []string {
+	var result []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			result = append(result, tag)
 		}
-		data, _ := json.Marshal(msg)
-		c.sendCh <- data
 	}
+	return result
 }
 
-func (c *ProbeClient) executeTask(task model.TaskPayload) {
-	var cmd *exec.Cmd
-
-	switch task.Type {
-	case "ping":
-		// Use -c flag for count on Linux/Mac
-		args := []string{"-c", "10"}
-		if task.Options != "" {
-			args = append(args, strings.Fields(task.Options)...)
-		}
-		args = append(args, task.Target)
-		cmd = exec.Command("ping", args...)
-	case "traceroute":
-		args := []string{}
-		if task.Options != "" {
-			args = append(args, strings.Fields(task.Options)...)
-		}
-		args = append(args, task.Target)
-		cmd = exec.Command("traceroute", args...)
-	case "mtr":
-		args := []string{"-r", "-c", "10", "--no-dns"}
-		if task.Options != "" {
-			args = append(args, strings.Fields(task.Options)...)
+// executeTask runs a job with the executor of its task type and sends
+// the final result
+func (c *ProbeClient) executeTask(j job) {
+	task := j.task
+	out := newTaskOutput(j.link, task.TaskID)
+	if task.Target != "" {
+		if err := c.policy.Check(task.Target); err != nil {
+			out.finish(err.Error())
+			return
 		}
-		args = append(args, task.Target)
-		cmd = exec.Command("mtr", args...)
-	default:
-		c.sendResult(task.TaskID, "", true, fmt.Sprintf("Unknown task type: %s", task.Type))
-		return
-	}
-
-	// Create pipe for stdout and stderr
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		c.sendResult(task.TaskID, "", true, err.Error())
-		return
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		c.sendResult(task.TaskID, "", true, err.Error())
-		return
 	}
-
-	// Start the command
-	if err := cmd.Start(); err != nil {
-		c.sendResult(task.TaskID, "", true, err.Error())
-		return
-	}
-
-	// Read stdout line by line and send
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			line := scanner.Text()
-			c.sendResult(task.TaskID, line, false, "")
-		}
-	}()
-
-	// Read stderr
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			line := scanner.Text()
-			c.sendResult(task.TaskID, line, false, "")
+	if cmd, ok := c.executors[task.Type].(*customCommand); ok {
+		if err := c.policy.CheckParams(cmd.cfg.Params, task.Params); err != nil {
+			out.finish(err.Error())
+			return
 		}
-	}()
-
-	// Wait for command to finish
-	err = cmd.Wait()
-	if err != nil {
-		c.sendResult(task.TaskID, "", true, err.Error())
-	} else {
-		c.sendResult(task.TaskID, "", true, "")
 	}
-}
 
-func (c *ProbeClient) sendResult(taskID, line string, isEnd bool, errMsg string) {
-	msg := model.Message{
-		Type: model.MsgTypeTaskResult,
-		Payload: model.TaskResultPayload{
-			TaskID: taskID,
-			Line:   line,
-			IsEnd:  isEnd,
-			Error:  errMsg,
-		},
+	limits := c.cfg.limitsFor(task)
+	ctx, cancel := context.WithCancelCause(c.taskCtx)
+	defer cancel(nil)
+	if limits.timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeoutCause(ctx, limits.timeout,
+			fmt.Errorf("Task stopped: time limit of %s exceeded", limits.timeout))
+		defer cancelTimeout()
+	}
+	limited := &limitedOutput{Output: out, limits: limits, cancel: cancel}
+
+	err := c.executors[task.Type].Run(ctx, task, limited)
+	if c.taskCtx.Err() != nil {
+		out.finish("Task cancelled: probe is shutting down")
+	} else if ctx.Err() != nil {
+		out.finish(context.Cause(ctx).Error())
+	} else if err != nil {
+		out.finish(err.Error())
+	} else {
+		out.finish("")
 	}
-	data, _ := json.Marshal(msg)
-	c.sendCh <- data
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// Summary lines of iputils, BSD and busybox ping
+var (
+	pingStatsRe = regexp.MustCompile(`^(\d+) packets transmitted, (\d+) (?:packets )?received,.*?([\d.]+)% packet loss`)
+	pingRTTRe   = regexp.MustCompile(`^(?:rtt|round-trip) min/avg/max(?:/(?:mdev|stddev))? = ([\d.]+)/([\d.]+)/([\d.]+)(?:/([\d.]+))? ms`)
+)
+
+// pingSummary reads packet counts and round-trip times from the summary
+// ping prints when it is done
+type pingSummary struct {
+	summary model.PingSummary
+	found   bool
+}
+
+func (s *pingSummary) line(text string) {
+	if m := pingStatsRe.FindStringSubmatch(text); m != nil {
+		s.summary.Transmitted, _ = strconv.Atoi(m[1])
+		s.summary.Received, _ = strconv.Atoi(m[2])
+		s.summary.Loss, _ = strconv.ParseFloat(m[3], 64)
+		s.found = true
+	} else if m := pingRTTRe.FindStringSubmatch(text); m != nil {
+		s.summary.Min, _ = strconv.ParseFloat(m[1], 64)
+		s.summary.Avg, _ = strconv.ParseFloat(m[2], 64)
+		s.summary.Max, _ = strconv.ParseFloat(m[3], 64)
+		if m[4] != "" {
+			s.summary.StdDev, _ = strconv.ParseFloat(m[4], 64)
+		}
+	}
+}
+
+func (s *pingSummary) result() interface{} {
+	if !s.found {
+		return nil
+	}
+	return s.summary
+}
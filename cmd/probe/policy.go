@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+const resolveTimeout = 5 * time.Second
+
+// targetPolicy decides which targets the probe is willing to measure
+type targetPolicy struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// parsePrefix accepts a CIDR or a bare IP address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%q is not an IP or CIDR", s)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an IP or CIDR", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// newTargetPolicy builds the policy from validated configuration
+func newTargetPolicy(cfg targetPolicyConfig) targetPolicy {
+	var p targetPolicy
+	for _, s := range cfg.Allow {
+		prefix, _ := parsePrefix(s)
+		p.allow = append(p.allow, prefix)
+	}
+	for _, s := range cfg.Deny {
+		prefix, _ := parsePrefix(s)
+		p.deny = append(p.deny, prefix)
+	}
+	return p
+}
+
+// Check resolves the target and fails unless every address it resolves to
+// is permitted. Deny entries win over allow entries.
+func (p targetPolicy) Check(target string) error {
+	return p.check("target", target)
+}
+
+// CheckParams applies the policy to the ip, prefix and host parameters of
+// a custom command, which may name addresses as much as a target does. A
+// prefix must lie within an allowed prefix and overlap no denied one.
+func (p targetPolicy) CheckParams(params []model.CommandParam, values map[string]string) error {
+	for _, param := range params {
+		value := values[param.Name]
+		if value == "" {
+			continue
+		}
+		what := "parameter " + param.Name
+		var err error
+		switch param.Type {
+		case model.ParamIP, model.ParamHost:
+			err = p.check(what, value)
+		case model.ParamPrefix:
+			err = p.checkPrefix(what, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p targetPolicy) check(what, target string) error {
+	if len(p.allow) == 0 && len(p.deny) == 0 {
+		return nil
+	}
+
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(target); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", target)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", target, err)
+		}
+		addrs = ips
+	}
+
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if matchAny(p.deny, addr) || (len(p.allow) > 0 && !matchAny(p.allow, addr)) {
+			return fmt.Errorf("%s %s (%s) is not allowed by this probe's policy", what, target, addr)
+		}
+	}
+	return nil
+}
+
+func (p targetPolicy) checkPrefix(what, s string) error {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return fmt.Errorf("%s: %q is not a CIDR prefix", what, s)
+	}
+	prefix = prefix.Masked()
+	within := func(allow netip.Prefix) bool {
+		return allow.Bits() <= prefix.Bits() && allow.Contains(prefix.Addr())
+	}
+	if slices.ContainsFunc(p.deny, prefix.Overlaps) || (len(p.allow) > 0 && !slices.ContainsFunc(p.allow, within)) {
+		return fmt.Errorf("%s %s is not allowed by this probe's policy", what, s)
+	}
+	return nil
+}
+
+func matchAny(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+var (
+	errQueueFull    = errors.New("probe task queue is full, try again later")
+	errShuttingDown = errors.New("probe is shutting down")
+)
+
+// job is a task together with the server link it came from, so results
+// go back to the right server even though all servers share one pool
+type job struct {
+	link *link
+	task model.TaskPayload
+}
+
+// taskPool runs at most maxConcurrency tasks at once, and at most
+// toolLimits[type] of one task type, keeping up to queueSize more waiting.
+// Status changes are reported through notify.
+type taskPool struct {
+	maxConcurrency int // 0 means unlimited
+	queueSize      int
+	toolLimits     map[string]int // 0 or missing means only the global limit applies
+	run            func(job)
+	notify         func(job, model.TaskStatusPayload)
+
+	mu          sync.Mutex
+	running     int
+	runningTool map[string]int
+	queue       []job
+	closed      bool
+
+	workers sync.WaitGroup
+}
+
+func newTaskPool(maxConcurrency, queueSize int, toolLimits map[string]int, run func(job), notify func(job, model.TaskStatusPayload)) *taskPool {
+	return &taskPool{
+		maxConcurrency: maxConcurrency,
+		queueSize:      queueSize,
+		toolLimits:     toolLimits,
+		run:            run,
+		notify:         notify,
+		runningTool:    make(map[string]int),
+	}
+}
+
+// toolFree reports whether another task of the type may start; callers hold mu
+func (p *taskPool) toolFree(taskType string) bool {
+	limit := p.toolLimits[taskType]
+	return limit <= 0 || p.runningTool[taskType] < limit
+}
+
+// Submit starts the task if a slot is free, queues it otherwise, and
+// returns errQueueFull when the queue has no room left
+func (p *taskPool) Submit(j job) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return errShuttingDown
+	}
+	if (p.maxConcurrency <= 0 || p.running < p.maxConcurrency) && p.toolFree(j.task.Type) {
+		p.running++
+		p.runningTool[j.task.Type]++
+		p.workers.Add(1)
+		p.mu.Unlock()
+		go p.work(j)
+		return nil
+	}
+	if len(p.queue) >= p.queueSize {
+		p.mu.Unlock()
+		return errQueueFull
+	}
+	p.queue = append(p.queue, j)
+	position := len(p.queue)
+	p.mu.Unlock()
+
+	p.notify(j, model.TaskStatusPayload{
+		TaskID:        j.task.TaskID,
+		Status:        model.TaskStatusQueued,
+		QueuePosition: position,
+	})
+	return nil
+}
+
+// work runs the job, then keeps pulling the first runnable job from the
+// queue. Jobs held back by a tool limit are picked up by the worker of the
+// running task of the same type once it finishes.
+func (p *taskPool) work(j job) {
+	defer p.workers.Done()
+	for {
+		if j.link.deliverable() {
+			p.notify(j, model.TaskStatusPayload{
+				TaskID: j.task.TaskID,
+				Status: model.TaskStatusRunning,
+			})
+			p.run(j)
+		}
+
+		p.mu.Lock()
+		p.runningTool[j.task.Type]--
+		next := -1
+		for i, queued := range p.queue {
+			if p.toolFree(queued.task.Type) {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			p.running--
+			p.mu.Unlock()
+			return
+		}
+		j = p.queue[next]
+		p.queue = append(p.queue[:next], p.queue[next+1:]...)
+		p.runningTool[j.task.Type]++
+		waiting := make([]job, len(p.queue)-next)
+		copy(waiting, p.queue[next:])
+		p.mu.Unlock()
+
+		// Everyone queued behind the started job moved up by one
+		for i, queued := range waiting {
+			p.notify(queued, model.TaskStatusPayload{
+				TaskID:        queued.task.TaskID,
+				Status:        model.TaskStatusQueued,
+				QueuePosition: next + i + 1,
+			})
+		}
+	}
+}
+
+// Close stops accepting tasks and returns the jobs that were still queued,
+// which will never run. Running tasks are not affected.
+func (p *taskPool) Close() []job {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	queued := p.queue
+	p.queue = nil
+	return queued
+}
+
+// Wait blocks until no task is running or ctx is done, and reports whether
+// every task finished
+func (p *taskPool) Wait(ctx context.Context) bool {
+	idle := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(idle)
+	}()
+
+	select {
+	case <-idle:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// testPool runs jobs until released and records the status notifications
+type testPool struct {
+	*taskPool
+	link    *link
+	started chan string
+	release chan struct{}
+
+	mu       sync.Mutex
+	statuses []model.TaskStatusPayload
+}
+
+func newTestPool(maxConcurrency, queueSize int, toolLimits map[string]int) *testPool {
+	tp := &testPool{started: make(chan string, 16), release: make(chan struct{})}
+	tp.link, _ = newTestLink(&probeConfig{}, 16)
+	tp.taskPool = newTaskPool(maxConcurrency, queueSize, toolLimits,
+		func(j job) {
+			tp.started <- j.task.TaskID
+			<-tp.release
+		},
+		func(j job, status model.TaskStatusPayload) {
+			tp.mu.Lock()
+			defer tp.mu.Unlock()
+			tp.statuses = append(tp.statuses, status)
+		})
+	return tp
+}
+
+func (tp *testPool) submit(t *testing.T, taskID, taskType string) error {
+	t.Helper()
+	return tp.Submit(job{link: tp.link, task: model.TaskPayload{TaskID: taskID, Type: taskType}})
+}
+
+// expectStart waits for the task to start running
+func (tp *testPool) expectStart(t *testing.T, taskID string) {
+	t.Helper()
+	select {
+	case id := <-tp.started:
+		if id != taskID {
+			t.Fatalf("started %s, want %s", id, taskID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%s did not start", taskID)
+	}
+}
+
+// expectIdle checks that no further task starts
+func (tp *testPool) expectIdle(t *testing.T) {
+	t.Helper()
+	select {
+	case id := <-tp.started:
+		t.Fatalf("%s started early", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTaskPoolQueues(t *testing.T) {
+	tp := newTestPool(1, 1, nil)
+	if err := tp.submit(t, "t1", "ping"); err != nil {
+		t.Fatal(err)
+	}
+	tp.expectStart(t, "t1")
+	if err := tp.submit(t, "t2", "ping"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tp.submit(t, "t3", "ping"); !errors.Is(err, errQueueFull) {
+		t.Fatalf("err = %v, want errQueueFull", err)
+	}
+	tp.expectIdle(t)
+
+	tp.release <- struct{}{}
+	tp.expectStart(t, "t2")
+	tp.release <- struct{}{}
+	if !tp.Wait(context.Background()) {
+		t.Fatal("tasks did not finish")
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	want := []model.TaskStatusPayload{
+		{TaskID: "t1", Status: model.TaskStatusRunning},
+		{TaskID: "t2", Status: model.TaskStatusQueued, QueuePosition: 1},
+		{TaskID: "t2", Status: model.TaskStatusRunning},
+	}
+	if len(tp.statuses) != len(want) {
+		t.Fatalf("statuses = %+v, want %+v", tp.statuses, want)
+	}
+	for i := range want {
+		if tp.statuses[i] != want[i] {
+			t.Errorf("status %d = %+v, want %+v", i, tp.statuses[i], want[i])
+		}
+	}
+}
+
+func TestTaskPoolToolLimit(t *testing.T) {
+	tp := newTestPool(0, 4, map[string]int{"mtr": 1})
+	tp.submit(t, "m1", "mtr")
+	tp.expectStart(t, "m1")
+	tp.submit(t, "m2", "mtr")
+	tp.expectIdle(t)
+
+	// Other task types pass the queued one
+	tp.submit(t, "p1", "ping")
+	tp.expectStart(t, "p1")
+
+	tp.release <- struct{}{}
+	tp.release <- struct{}{}
+	tp.expectStart(t, "m2")
+	tp.release <- struct{}{}
+	if !tp.Wait(context.Background()) {
+		t.Fatal("tasks did not finish")
+	}
+}
+
+func TestTaskPoolClose(t *testing.T) {
+	tp := newTestPool(1, 4, nil)
+	tp.submit(t, "t1", "ping")
+	tp.expectStart(t, "t1")
+	tp.submit(t, "t2", "ping")
+
+	queued := tp.Close()
+	if len(queued) != 1 || queued[0].task.TaskID != "t2" {
+		t.Fatalf("Close returned %+v, want t2", queued)
+	}
+	if err := tp.submit(t, "t3", "ping"); !errors.Is(err, errShuttingDown) {
+		t.Fatalf("err = %v, want errShuttingDown", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if tp.Wait(ctx) {
+		t.Fatal("Wait returned while t1 was running")
+	}
+	tp.release <- struct{}{}
+	if !tp.Wait(context.Background()) {
+		t.Fatal("t1 did not finish")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// sandboxArg, as the first argument, turns the probe into the sandbox
+// helper: it applies resource limits to itself and then executes the tool
+const sandboxArg = "__sandbox"
+
+// exitNoMemory is the helper's exit status when the tool could not even be
+// executed within the memory limit
+const exitNoMemory = 125
+
+// toolEnv is the whole environment tools run with. LC_ALL=C also keeps
+// their output in the format summaries parse.
+var toolEnv = []string{
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"LC_ALL=C",
+}
+
+// sandboxConfig restricts the tools tasks run
+type sandboxConfig struct {
+	Enabled    bool          `yaml:"enabled"`    // run tools through the sandbox helper
+	CPUTime    time.Duration `yaml:"cpu_time"`   // CPU time per tool, 0 for no limit
+	MaxMemory  int64         `yaml:"max_memory"` // bytes of address space per tool, 0 for no limit
+	User       string        `yaml:"user"`       // unprivileged user to run tools as, requires root
+	Namespaces []string      `yaml:"namespaces"` // Linux namespaces to run tools in: ipc, uts, pid
+}
+
+// validate checks the sandbox settings against what this system supports
+func (c sandboxConfig) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(!c.Enabled || sandboxSupported, "sandbox.enabled: not supported on this system")
+	check(c.CPUTime >= 0, "sandbox.cpu_time: must not be negative")
+	check(c.CPUTime%time.Second == 0, "sandbox.cpu_time: must be whole seconds")
+	check(c.MaxMemory >= 0, "sandbox.max_memory: must not be negative")
+	if c.User != "" {
+		check(c.Enabled, "sandbox.user: requires the sandbox to be enabled")
+		err := checkUser(c.User)
+		check(err == nil, "sandbox.user: %v", err)
+		check(os.Geteuid() == 0, "sandbox.user: switching users requires running the probe as root")
+	}
+	for _, ns := range c.Namespaces {
+		_, ok := namespaceFlags[ns]
+		check(ok, "sandbox.namespaces: %q is not supported here", ns)
+	}
+	if len(c.Namespaces) > 0 {
+		check(c.Enabled, "sandbox.namespaces: requires the sandbox to be enabled")
+		check(os.Geteuid() == 0, "sandbox.namespaces: creating namespaces requires running the probe as root")
+	}
+	return errors.Join(errs...)
+}
+
+// sandbox starts the tools of command executors
+type sandbox struct {
+	cfg  sandboxConfig
+	attr syscall.SysProcAttr // process group, user and namespaces of every tool
+}
+
+// newSandbox builds the sandbox from validated configuration
+func newSandbox(cfg sandboxConfig) *sandbox {
+	return &sandbox{cfg: cfg, attr: sysProcAttr(cfg)}
+}
+
+// command prepares a tool to run with a minimal environment, in its own
+// process group so it is killed with everything it started, and, if
+// enabled, through the sandbox helper
+func (s *sandbox) command(ctx context.Context, binary string, args []string) (*exec.Cmd, error) {
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmd *exec.Cmd
+	if s.cfg.Enabled {
+		helperArgs := []string{
+			sandboxArg,
+			strconv.FormatInt(int64(s.cfg.CPUTime/time.Second), 10),
+			strconv.FormatInt(s.cfg.MaxMemory, 10),
+			path,
+			binary,
+		}
+		cmd = exec.CommandContext(ctx, selfExe, append(helperArgs, args...)...)
+	} else {
+		cmd = exec.CommandContext(ctx, path, args...)
+	}
+	cmd.Env = toolEnv
+	attr := s.attr
+	cmd.SysProcAttr = &attr
+	cmd.Cancel = func() error { return killGroup(cmd) }
+	return cmd, nil
+}
+
+// outOfMemoryRe matches what tools print when an allocation fails. It
+// only backs up the exit state, for tools that exit normally after failing
+// to allocate.
+var outOfMemoryRe = regexp.MustCompile(`(?i)cannot allocate memory|out of memory|memory exhausted|bad_alloc`)
+
+// explain turns a tool that failed on a sandbox limit into an error naming
+// the limit. An address space limit only makes allocations fail, so a tool
+// is taken to have hit it if it could not be executed at all, died of a
+// signal failed allocations end in, or said on stderr (outOfMemory) that
+// it could not allocate memory.
+func (s *sandbox) explain(err error, outOfMemory bool) error {
+	var exitErr *exec.ExitError
+	if !s.cfg.Enabled || !errors.As(err, &exitErr) {
+		return err
+	}
+	if s.cfg.CPUTime > 0 && cpuLimitExceeded(exitErr, s.cfg.CPUTime) {
+		return fmt.Errorf("Task stopped: CPU time limit of %s exceeded", s.cfg.CPUTime)
+	}
+	if s.cfg.MaxMemory > 0 && (exitErr.ExitCode() == exitNoMemory || memoryLimitSignal(exitErr) || outOfMemory) {
+		return fmt.Errorf("Task stopped: memory limit of %d bytes exceeded", s.cfg.MaxMemory)
+	}
+	return err
+}
+
+// runSandboxHelper is the probe started with sandboxArg. It applies the
+// limits passed as arguments and replaces itself with the tool; it only
+// returns if that fails.
+func runSandboxHelper(args []string) {
+	if len(args) < 4 {
+		log.Fatal("sandbox: missing arguments")
+	}
+	cpuSeconds, err1 := strconv.ParseUint(args[0], 10, 64)
+	maxMemory, err2 := strconv.ParseUint(args[1], 10, 64)
+	if err := errors.Join(err1, err2); err != nil {
+		log.Fatalf("sandbox: %v", err)
+	}
+	if err := setLimits(cpuSeconds, maxMemory); err != nil {
+		log.Fatalf("sandbox: setting resource limits: %v", err)
+	}
+	err := execTool(args[2], args[3:], os.Environ())
+	log.Printf("sandbox: running %s: %v", args[2], err)
+	if errors.Is(err, syscall.ENOMEM) {
+		os.Exit(exitNoMemory)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,128 @@
+//go:build linux
+
+package main
+
+import (
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// sandboxSupported reports whether tools can run through the sandbox helper
+const sandboxSupported = true
+
+// selfExe starts the probe's own binary, even if it was replaced on disk
+const selfExe = "/proc/self/exe"
+
+// namespaceFlags are the namespaces tools may run in. The network and
+// mount namespaces stay shared, since the tools measure the host's network.
+var namespaceFlags = map[string]uintptr{
+	"ipc": syscall.CLONE_NEWIPC,
+	"uts": syscall.CLONE_NEWUTS,
+	"pid": syscall.CLONE_NEWPID,
+}
+
+// lookupCredential resolves a user name or ID to its user and primary
+// group, without supplementary groups
+func lookupCredential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, err
+		}
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}, nil
+}
+
+// checkUser reports whether tools can be run as the given user
+func checkUser(name string) error {
+	_, err := lookupCredential(name)
+	return err
+}
+
+// sysProcAttr puts every tool in its own process group, killed if the
+// probe dies, as the configured user and in the configured namespaces
+func sysProcAttr(cfg sandboxConfig) syscall.SysProcAttr {
+	attr := syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+	if cfg.User != "" {
+		attr.Credential, _ = lookupCredential(cfg.User)
+	}
+	for _, ns := range cfg.Namespaces {
+		attr.Cloneflags |= namespaceFlags[ns]
+	}
+	return attr
+}
+
+// killGroup kills a tool together with every process it started
+func killGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// setLimits limits the CPU time and address space of the calling process
+// and whatever it executes. The hard CPU limit is one second above the
+// soft one, so a tool ignoring SIGXCPU is killed.
+func setLimits(cpuSeconds, maxMemory uint64) error {
+	if cpuSeconds > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_CPU, &syscall.Rlimit{Cur: cpuSeconds, Max: cpuSeconds + 1}); err != nil {
+			return err
+		}
+	}
+	if maxMemory > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: maxMemory, Max: maxMemory}); err != nil {
+			return err
+		}
+	}
+	return syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{})
+}
+
+// execTool replaces the calling process with the tool
+func execTool(path string, argv, env []string) error {
+	return syscall.Exec(path, argv, env)
+}
+
+// cpuLimitExceeded reports whether a tool was killed by its CPU time
+// limit: by SIGXCPU at the soft limit, or by SIGKILL at the hard one after
+// using up the limit. A SIGKILL from elsewhere, such as the OOM killer,
+// comes with less CPU time used. Callers rule out the tool having been
+// killed on cancellation.
+func cpuLimitExceeded(exitErr *exec.ExitError, limit time.Duration) bool {
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+	switch status.Signal() {
+	case syscall.SIGXCPU:
+		return true
+	case syscall.SIGKILL:
+		usage, ok := exitErr.SysUsage().(*syscall.Rusage)
+		return ok && time.Duration(usage.Utime.Nano()+usage.Stime.Nano()) >= limit
+	}
+	return false
+}
+
+// memoryLimitSignal reports whether a tool died of a signal a failed
+// allocation ends in: SIGSEGV from using a null pointer malloc returned,
+// SIGABRT from an allocator or runtime giving up, SIGBUS, or SIGKILL when
+// the kernel could not finish executing it within the limit. Callers rule
+// out cancellation and the CPU limit first.
+func memoryLimitSignal(exitErr *exec.ExitError) bool {
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+	switch status.Signal() {
+	case syscall.SIGSEGV, syscall.SIGABRT, syscall.SIGBUS, syscall.SIGKILL:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// testToolArg, as the first argument, turns the test binary into a tool
+// behaving as the second argument says
+const testToolArg = "__testtool"
+
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case sandboxArg:
+			runSandboxHelper(os.Args[2:])
+		case testToolArg:
+			runTestTool(os.Args[2])
+		}
+	}
+	os.Exit(m.Run())
+}
+
+// allocSink keeps allocations of the alloc tool reachable
+var allocSink [][]byte
+
+// runTestTool behaves like a tool that runs for long, burns CPU, allocates
+// memory without end, or is killed
+func runTestTool(mode string) {
+	fmt.Println("started")
+	switch mode {
+	case "sleep":
+		time.Sleep(time.Minute)
+	case "spin":
+		for start := time.Now(); time.Since(start) < time.Minute; {
+		}
+	case "alloc":
+		// Only the runtime's out of memory message, without goroutine dumps
+		debug.SetTraceback("none")
+		for i := 0; i < 64; i++ {
+			allocSink = append(allocSink, make([]byte, 64<<20))
+		}
+	case "kill":
+		syscall.Kill(os.Getpid(), syscall.SIGKILL)
+	}
+	os.Exit(0)
+}
+
+// runTestToolTask runs the test tool in the given mode as a task through
+// the sandbox, and returns the error of its final result
+func runTestToolTask(t *testing.T, sb sandboxConfig, timeout time.Duration, mode string) string {
+	t.Helper()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runToolTask(t, sb, timeout, self, testToolArg, mode)
+}
+
+// runToolTask runs a program as a task through the sandbox, and returns
+// the error of its final result
+func runToolTask(t *testing.T, sb sandboxConfig, timeout time.Duration, binary string, args ...string) string {
+	t.Helper()
+	tool := &commandExecutor{
+		taskType: "tool",
+		binary:   binary,
+		args:     func(model.TaskPayload) []string { return args },
+		sandbox:  newSandbox(sb),
+	}
+	cfg := &probeConfig{TaskTimeout: timeout}
+	c := &ProbeClient{cfg: cfg, executors: map[string]Executor{"tool": tool}, taskCtx: context.Background()}
+	l, s := newTestLink(cfg, 256)
+	c.executeTask(job{link: l, task: model.TaskPayload{TaskID: "t1", Type: "tool"}})
+
+	results := sentResults(t, s)
+	if len(results) == 0 || !results[len(results)-1].IsEnd {
+		t.Fatalf("no final result in %+v", results)
+	}
+	return results[len(results)-1].Error
+}
+
+func TestSandboxTimeout(t *testing.T) {
+	start := time.Now()
+	got := runTestToolTask(t, sandboxConfig{Enabled: true}, 200*time.Millisecond, "sleep")
+	if want := "Task stopped: time limit of 200ms exceeded"; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("tool was killed after %s", elapsed)
+	}
+}
+
+func TestSandboxCPULimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("burns two seconds of CPU")
+	}
+	got := runTestToolTask(t, sandboxConfig{Enabled: true, CPUTime: time.Second}, 30*time.Second, "spin")
+	if want := "Task stopped: CPU time limit of 1s exceeded"; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+}
+
+func TestSandboxKillIsNotCPULimit(t *testing.T) {
+	got := runTestToolTask(t, sandboxConfig{Enabled: true, CPUTime: 10 * time.Second}, 30*time.Second, "kill")
+	if got != "signal: killed" {
+		t.Errorf("error = %q, want signal: killed", got)
+	}
+}
+
+// Tools that die of a signal failed allocations end in are reported as
+// over the memory limit, whatever they print
+func TestSandboxMemoryLimitSignal(t *testing.T) {
+	for _, sig := range []string{"SEGV", "ABRT"} {
+		got := runToolTask(t, sandboxConfig{Enabled: true, MaxMemory: 1 << 30}, 30*time.Second, "sh", "-c", "kill -"+sig+" $$")
+		if want := "Task stopped: memory limit of 1073741824 bytes exceeded"; got != want {
+			t.Errorf("SIG%s: error = %q, want %q", sig, got, want)
+		}
+	}
+}
+
+// A limit too small to even start the tool is reported as such
+func TestSandboxMemoryLimitAtStart(t *testing.T) {
+	got := runToolTask(t, sandboxConfig{Enabled: true, MaxMemory: 1 << 16}, 30*time.Second, "sh", "-c", "true")
+	if want := "Task stopped: memory limit of 65536 bytes exceeded"; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+}
+
+func TestSandboxFailureIsNotMemoryLimit(t *testing.T) {
+	got := runToolTask(t, sandboxConfig{Enabled: true, MaxMemory: 1 << 30}, 30*time.Second, "sh", "-c", "echo failed >&2; exit 3")
+	if got != "exit status 3" {
+		t.Errorf("error = %q, want exit status 3", got)
+	}
+}
+
+func TestSandboxSignalWithoutMemoryLimit(t *testing.T) {
+	got := runToolTask(t, sandboxConfig{Enabled: true}, 30*time.Second, "sh", "-c", "kill -SEGV $$")
+	if strings.Contains(got, "memory") {
+		t.Errorf("error = %q, want no memory limit", got)
+	}
+}
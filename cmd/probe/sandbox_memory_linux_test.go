@@ -0,0 +1,18 @@
+//go:build !race
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The test tool is the test binary itself, and the race detector cannot
+// start under an address space limit. Go reports running out of memory on
+// stderr and exits with status 2, so this covers that hint.
+func TestSandboxMemoryLimit(t *testing.T) {
+	got := runTestToolTask(t, sandboxConfig{Enabled: true, MaxMemory: 1 << 30}, 30*time.Second, "alloc")
+	if want := "Task stopped: memory limit of 1073741824 bytes exceeded"; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// sandboxSupported reports whether tools can run through the sandbox helper
+const sandboxSupported = false
+
+// selfExe is unused where the sandbox is not supported
+const selfExe = ""
+
+// namespaceFlags is empty: namespaces are Linux only
+var namespaceFlags = map[string]uintptr{}
+
+var errSandboxUnsupported = errors.New("not supported on this system")
+
+func checkUser(name string) error { return errSandboxUnsupported }
+
+func sysProcAttr(cfg sandboxConfig) syscall.SysProcAttr { return syscall.SysProcAttr{} }
+
+// killGroup kills the tool; processes it started are not tracked here
+func killGroup(cmd *exec.Cmd) error { return cmd.Process.Kill() }
+
+func setLimits(cpuSeconds, maxMemory uint64) error { return errSandboxUnsupported }
+
+func execTool(path string, argv, env []string) error { return errSandboxUnsupported }
+
+func cpuLimitExceeded(exitErr *exec.ExitError, limit time.Duration) bool { return false }
+
+func memoryLimitSignal(exitErr *exec.ExitError) bool { return false }
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+// session is one connection to one server. Every server has its own
+// session, probe ID and task namespace.
+type session struct {
+	probe       *ProbeClient
+	server      serverConfig
+	link        *link
+	conn        *websocket.Conn
+	probeID     string
+	resumeToken string // issued with probeID by servers with the resume feature
+	sendCh      chan []byte
+	done        chan struct{} // closed when the reader stops
+	stopped     chan struct{} // closed when the writer stops
+
+	protocolVersion int      // version spoken with this server
+	features        []string // features both sides support
+
+	closing   chan struct{} // closed to make the writer flush and send a close frame
+	closeOnce sync.Once
+}
+
+// runServer keeps the probe connected to one server, reconnecting with
+// exponential backoff whenever the connection is lost, until ctx is done
+func (c *ProbeClient) runServer(ctx context.Context, server serverConfig, dialer *websocket.Dialer) {
+	l := newLink(c, server)
+	if c.cfg.BatchInterval > 0 {
+		batchCtx, stopBatch := context.WithCancel(context.Background())
+		defer stopBatch()
+		go l.batch.run(batchCtx, c.cfg.BatchInterval)
+	}
+
+	delay := minReconnectDelay
+	for {
+		s, err := c.connect(l, dialer)
+		if err != nil {
+			log.Printf("[%s] %v, retrying in %s", server.Name, err, delay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		delay = minReconnectDelay
+
+		c.trackSession(s, true)
+		go s.writer()
+		go s.heartbeat()
+		l.attach(s, func() { go s.reader() })
+		<-s.done
+		l.detach(s)
+		c.trackSession(s, false)
+
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[%s] Connection to server lost, reconnecting", server.Name)
+	}
+}
+
+// trackSession adds or removes a live session, so shutdown can close it
+func (c *ProbeClient) trackSession(s *session, live bool) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	if live {
+		c.sessions[s] = true
+	} else {
+		delete(c.sessions, s)
+	}
+}
+
+// liveSessions returns the sessions currently connected
+func (c *ProbeClient) liveSessions() []*session {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	sessions := make([]*session, 0, len(c.sessions))
+	for s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// connect dials the link's server and registers the probe
+func (c *ProbeClient) connect(l *link, dialer *websocket.Dialer) (*session, error) {
+	server := l.server
+	log.Printf("[%s] Connecting to %s", server.Name, server.URL)
+
+	header := http.Header{}
+	if server.Token != "" {
+		header.Set("Authorization", "Bearer "+server.Token)
+	}
+	conn, _, err := dialer.Dial(server.URL, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	s := &session{
+		probe:   c,
+		server:  server,
+		link:    l,
+		conn:    conn,
+		sendCh:  make(chan []byte, 256),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	if err := s.register(l.resumeID()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// register sends the registration message and waits for the probe ID.
+// A non-empty resumeID asks the server to continue the previous connection,
+// proven by the resume token issued with it.
+func (s *session) register(resumeID, resumeToken string) error {
+	cfg := s.probe.cfg
+	features := protocol.Features
+	if cfg.JournalSize == 0 {
+		features = withoutFeature(features, protocol.FeatureResume)
+	}
+	registerMsg := model.Message{
+		Type: model.MsgTypeRegister,
+		Payload: model.RegisterPayload{
+			Name:      cfg.Name,
+			Location:  cfg.Location,
+			Latitude:  cfg.Latitude,
+			Longitude: cfg.Longitude,
+			ASN:       cfg.ASN,
+			Country:   cfg.Country,
+			Region:    cfg.Region,
+			Tags:      cfg.Tags,
+			Addresses: cfg.Addresses,
+
+			Capabilities: s.probe.capabilities,
+
+			ProtocolVersion: protocol.Version,
+			Features:        features,
+			ResumeID:        resumeID,
+			ResumeToken:     resumeToken,
+		},
+	}
+	data, err := protocol.ProbeToServer.Encode(registerMsg)
+	if err != nil {
+		return fmt.Errorf("failed to encode registration: %w", err)
+	}
+	s.conn.SetReadLimit(protocol.MaxMessageSize)
+	s.conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout))
+	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return fmt.Errorf("failed to send registration: %w", err)
+	}
+
+	// Wait for registration response
+	s.extendReadDeadline()
+	_, message, err := s.conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("failed to read registration response: %w", err)
+	}
+
+	msg, err := protocol.ServerToProbe.Decode(message)
+	if err != nil {
+		return fmt.Errorf("failed to parse registration response: %w", err)
+	}
+
+	switch msg.Type {
+	case model.MsgTypeRegister:
+		payload, err := protocol.DecodePayload[model.RegisteredPayload](msg)
+		if err != nil {
+			return fmt.Errorf("failed to parse registration response: %w", err)
+		}
+		s.probeID = payload.ProbeID
+		s.resumeToken = payload.ResumeToken
+		// Servers before version 2 send neither field and support no features
+		s.protocolVersion = protocol.PeerVersion(payload.ProtocolVersion)
+		if s.protocolVersion < protocol.MinVersion {
+			return fmt.Errorf("server protocol version %d is not supported", s.protocolVersion)
+		}
+		s.features = protocol.Negotiate(payload.Features)
+		log.Printf("[%s] Registered with ID: %s (protocol %d, features %v)", s.server.Name, s.probeID,
+			s.protocolVersion, s.features)
+	case model.MsgTypeError:
+		payload, err := protocol.DecodePayload[model.ErrorPayload](msg)
+		if err != nil {
+			return fmt.Errorf("registration rejected: %w", err)
+		}
+		return fmt.Errorf("registration rejected: %s", payload.Message)
+	default:
+		return fmt.Errorf("unexpected registration response %q", msg.Type)
+	}
+
+	// Answer server pings and treat them as proof the server is alive
+	s.conn.SetPingHandler(func(appData string) error {
+		s.extendReadDeadline()
+		err := s.conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(cfg.WriteTimeout))
+		if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+			return err
+		}
+		return nil
+	})
+
+	return nil
+}
+
+// extendReadDeadline pushes the read deadline forward after any frame from the server
+func (s *session) extendReadDeadline() {
+	s.conn.SetReadDeadline(time.Now().Add(s.probe.cfg.ReadTimeout))
+}
+
+// alive reports whether the session's connection is still up
+func (s *session) alive() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// close asks the writer to flush queued messages and send a close frame,
+// then waits up to timeout for the server to acknowledge it
+func (s *session) close(timeout time.Duration) {
+	s.closeOnce.Do(func() { close(s.closing) })
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+		s.conn.Close()
+	}
+}
+
+// send queues a message for the writer; it is dropped once the session has ended
+func (s *session) send(data []byte) {
+	select {
+	case s.sendCh <- data:
+	case <-s.done:
+	case <-s.stopped:
+	}
+}
+
+func (s *session) reader() {
+	defer close(s.done)
+	defer s.conn.Close()
+
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("[%s] Connection error: %v", s.server.Name, err)
+			}
+			return
+		}
+		s.extendReadDeadline()
+
+		msg, err := protocol.ServerToProbe.Decode(message)
+		if err != nil {
+			log.Printf("[%s] Failed to parse message: %v", s.server.Name, err)
+			continue
+		}
+
+		switch msg.Type {
+		case model.MsgTypeTask:
+			taskPayload, err := protocol.DecodePayload[model.TaskPayload](msg)
+			if err != nil {
+				log.Printf("[%s] Failed to parse task payload: %v", s.server.Name, err)
+				continue
+			}
+			log.Printf("[%s] Received task: %s - %s %s", s.server.Name, taskPayload.TaskID, taskPayload.Type, taskPayload.Target)
+			executor, ok := s.probe.executors[taskPayload.Type]
+			if !ok {
+				s.link.finish(taskPayload.TaskID, fmt.Sprintf("Task type %s is not enabled on this probe", taskPayload.Type), nil)
+				continue
+			}
+			if err := executor.Validate(taskPayload); err != nil {
+				log.Printf("[%s] Rejected task %s: %v", s.server.Name, taskPayload.TaskID, err)
+				s.link.finish(taskPayload.TaskID, err.Error(), nil)
+				continue
+			}
+			if err := s.probe.pool.Submit(job{link: s.link, task: taskPayload}); err != nil {
+				log.Printf("[%s] Rejected task %s: %v", s.server.Name, taskPayload.TaskID, err)
+				s.link.finish(taskPayload.TaskID, err.Error(), nil)
+			}
+		case model.MsgTypeTaskAck:
+			ack, err := protocol.DecodePayload[model.TaskAckPayload](msg)
+			if err != nil {
+				log.Printf("[%s] Failed to parse task ack: %v", s.server.Name, err)
+				continue
+			}
+			s.link.journal.ack(ack.TaskID, ack.Seq)
+		case model.MsgTypeShutdown:
+			shutdown, err := protocol.DecodePayload[model.ShutdownPayload](msg)
+			if err != nil {
+				log.Printf("[%s] Failed to parse shutdown payload: %v", s.server.Name, err)
+				continue
+			}
+			log.Printf("[%s] %s, running tasks may finish until %s", s.server.Name, shutdown.Message,
+				shutdown.Deadline.Format(time.RFC3339))
+		}
+	}
+}
+
+func (s *session) writer() {
+	defer close(s.stopped)
+	for {
+		select {
+		case message := <-s.sendCh:
+			s.conn.SetWriteDeadline(time.Now().Add(s.probe.cfg.WriteTimeout))
+			if err := s.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Printf("[%s] Failed to send message: %v", s.server.Name, err)
+				s.conn.Close()
+				return
+			}
+		case <-s.closing:
+			s.flush()
+			s.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "probe shutting down"),
+				time.Now().Add(s.probe.cfg.WriteTimeout))
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// flush writes every message still queued, such as final task results
+func (s *session) flush() {
+	for {
+		select {
+		case message := <-s.sendCh:
+			s.conn.SetWriteDeadline(time.Now().Add(s.probe.cfg.WriteTimeout))
+			if err := s.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *session) heartbeat() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sendMessage(model.Message{
+				Type:    model.MsgTypeHeartbeat,
+				Payload: nil,
+			})
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// sendMessage encodes and queues a message for the server
+func (s *session) sendMessage(msg model.Message) {
+	data, err := protocol.ProbeToServer.Encode(msg)
+	if err != nil {
+		log.Printf("[%s] Failed to encode %s message: %v", s.server.Name, msg.Type, err)
+		return
+	}
+	s.send(data)
+}
+
+// sendResult queues a task result for the server
+func (s *session) sendResult(result model.TaskResultPayload) {
+	s.sendMessage(model.Message{
+		Type:    model.MsgTypeTaskResult,
+		Payload: result,
+	})
+}
+
+// withoutFeature returns features without the given one
+func withoutFeature(features []string, feature string) []string {
+	var kept []string
+	for _, f := range features {
+		if f != feature {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// sendStatus reports a task's queue status, if the server wants it
+func (s *session) sendStatus(status model.TaskStatusPayload) {
+	if !protocol.HasFeature(s.features, protocol.FeatureTaskStatus) {
+		return
+	}
+	s.sendMessage(model.Message{
+		Type:    model.MsgTypeTaskStatus,
+		Payload: status,
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gorilla/websocket"
+)
+
+// serverTLS configures how the probe verifies and authenticates to a wss:// server
+type serverTLS struct {
+	CAFile   string   `yaml:"ca_file"`    // CA bundle used instead of the system roots
+	CertFile string   `yaml:"cert_file"`  // client certificate for mutual TLS, CN must be the probe name
+	KeyFile  string   `yaml:"key_file"`   // key of the client certificate
+	Pins     []string `yaml:"pin_sha256"` // base64 SHA-256 of the server's public key, any one must match
+}
+
+func (t serverTLS) empty() bool {
+	return t.CAFile == "" && t.CertFile == "" && t.KeyFile == "" && len(t.Pins) == 0
+}
+
+// withDefaults fills fields left empty from the -tls-* flags
+func (t serverTLS) withDefaults(d serverTLS) serverTLS {
+	if t.CAFile == "" {
+		t.CAFile = d.CAFile
+	}
+	if t.CertFile == "" && t.KeyFile == "" {
+		t.CertFile, t.KeyFile = d.CertFile, d.KeyFile
+	}
+	if len(t.Pins) == 0 {
+		t.Pins = d.Pins
+	}
+	return t
+}
+
+// validate checks the settings without loading any file
+func (t serverTLS) validate() error {
+	var errs []error
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, errors.New("cert_file and key_file must be set together"))
+	}
+	for _, path := range []string{t.CAFile, t.CertFile, t.KeyFile} {
+		if path != "" {
+			if _, err := os.Stat(path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, pin := range t.Pins {
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			errs = append(errs, fmt.Errorf("pin %q is not a base64 SHA-256 digest", pin))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dialer returns a WebSocket dialer using these settings
+func (t serverTLS) dialer() (*websocket.Dialer, error) {
+	d := *websocket.DefaultDialer
+	if t.empty() {
+		return &d, nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(t.Pins) > 0 {
+		// Pins are checked on top of normal chain verification
+		pins := make(map[string]bool)
+		for _, pin := range t.Pins {
+			pins[pin] = true
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			if !pins[base64.StdEncoding.EncodeToString(sum[:])] {
+				return errors.New("server certificate does not match any pinned key")
+			}
+			return nil
+		}
+	}
+	d.TLSClientConfig = cfg
+	return &d, nil
+}
@@ -1,57 +1,212 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/bingxin666/dn42-globalping/internal/auth"
+	"github.com/bingxin666/dn42-globalping/internal/config"
 	"github.com/bingxin666/dn42-globalping/internal/handler"
 	"github.com/bingxin666/dn42-globalping/internal/hub"
+	"github.com/bingxin666/dn42-globalping/internal/registry"
+	"github.com/bingxin666/dn42-globalping/internal/static"
+	"github.com/bingxin666/dn42-globalping/internal/store"
+	"github.com/bingxin666/dn42-globalping/web"
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	flags := config.NewFlags(os.Args[0], os.Stderr)
+	genAPIKey := flags.Bool("gen-api-key", false, "Print a new API key and its hash, then exit")
+	cfg, err := flags.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *genAPIKey {
+		key, hash := auth.GenerateKey()
+		fmt.Printf("API key: %s\nHash:    %s\n", key, hash)
+		return
+	}
+
+	// Load DN42 registry for whois lookups
+	var reg *registry.Registry
+	var whoisLn net.Listener
+	if cfg.Registry.Dir != "" {
+		reg, err = registry.Load(cfg.Registry.Dir)
+		if err != nil {
+			log.Fatalf("Failed to load registry: %v", err)
+		}
+		log.Printf("Loaded %d registry objects from %s", reg.Len(), cfg.Registry.Dir)
+
+		if cfg.Registry.WhoisListen != "" {
+			whoisLn, err = net.Listen("tcp", cfg.Registry.WhoisListen)
+			if err != nil {
+				log.Fatalf("Failed to start whois listener: %v", err)
+			}
+			log.Printf("Whois service listening on %s", cfg.Registry.WhoisListen)
+			go func() {
+				if err := reg.ServeWhois(whoisLn); err != nil {
+					log.Printf("Whois service stopped: %v", err)
+				}
+			}()
+		}
+	}
+
+	// Setup authentication; roles were checked by cfg.Validate
+	anonRole, _ := auth.ParseRole(cfg.Auth.AnonymousRole)
+	loginRole, _ := auth.ParseRole(cfg.Auth.MntnerRole)
+	var keys []auth.APIKey
+	if cfg.Auth.APIKeysFile != "" {
+		if keys, err = auth.LoadKeys(cfg.Auth.APIKeysFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Loaded %d API keys", len(keys))
+	}
+	var mntner *auth.MntnerVerifier
+	if reg != nil && loginRole != auth.RoleNone {
+		mntner = auth.NewMntnerVerifier(reg, loginRole)
+	}
+	authenticator := auth.NewAuthenticator(anonRole, keys, mntner)
+
 	// Create hub for managing connections
-	h := hub.NewHub()
+	h := hub.NewHub(cfg, store.NewMemory(cfg.Storage.MaxMeasurements))
+	if cfg.Probes.AdminStateFile != "" {
+		if err := h.LoadAdminState(cfg.Probes.AdminStateFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go h.RunReaper(ctx, cfg.Probes.HeartbeatTimeout)
 
 	// Create handler
-	hdl := handler.NewHandler(h)
+	hdl := handler.NewHandler(cfg, h, reg, authenticator)
 
 	// Setup Gin router
-	r := gin.Default()
-
-	// Serve static files for frontend
-	r.Static("/assets", "./web/dist/assets")
-	r.StaticFile("/vite.svg", "./web/dist/vite.svg")
+	r := gin.New()
+	r.Use(handler.Logger(), gin.Recovery())
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
+	r.Use(hdl.CORS)
 
 	// API routes
 	api := r.Group("/api")
 	{
-		api.GET("/probes", hdl.GetProbes)
+		login := api.Group("/auth", hdl.LimitLogins)
+		login.POST("/challenge", hdl.PostAuthChallenge)
+		login.POST("/verify", hdl.PostAuthVerify)
+
+		authed := api.Group("", hdl.Authenticate)
+		authed.GET("/auth/whoami", hdl.GetWhoami)
+
+		viewer := authed.Group("", handler.RequireRole(auth.RoleViewer))
+		viewer.GET("/probes", hdl.GetProbes)
+		viewer.GET("/probes/:identity/history", hdl.GetProbeHistory)
+		viewer.GET("/quota", hdl.GetQuota)
+		viewer.GET("/whois", hdl.GetWhois)
+		viewer.GET("/measurements/:id", hdl.GetMeasurement)
+
+		measurer := authed.Group("", handler.RequireRole(auth.RoleMeasurer))
+		measurer.POST("/measurements", hdl.PostMeasurement)
+
+		admin := authed.Group("/admin", handler.RequireRole(auth.RoleAdmin))
+		admin.GET("/probes", hdl.GetAdminProbes)
+		admin.GET("/stats", hdl.GetAdminStats)
+		admin.PATCH("/probes/:id", hdl.PatchProbe)
+		admin.DELETE("/probes/:id/override", hdl.DeleteProbeOverride)
+		admin.POST("/probes/:id/drain", hdl.PostDrainProbe)
+		admin.DELETE("/probes/:id/drain", hdl.DeleteDrainProbe)
+		admin.POST("/probes/:id/kick", hdl.PostKickProbe)
+		admin.POST("/probes/:id/disable", hdl.PostDisableProbe)
+		admin.DELETE("/disabled/:identity", hdl.DeleteDisabledIdentity)
 	}
 
 	// WebSocket routes
 	r.GET("/ws/probe", hdl.HandleProbeWS)
-	r.GET("/ws/client", hdl.HandleClientWS)
-
-	// Serve index.html for all other routes (SPA)
-	r.NoRoute(func(c *gin.Context) {
-		c.File("./web/dist/index.html")
-	})
-
-	// Add CORS middleware for development
-	r.Use(func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		if c.Request.Method == http.MethodOptions {
-			c.AbortWithStatus(http.StatusNoContent)
-			return
-		}
-		c.Next()
-	})
-
-	log.Println("Server starting on :8080")
-	if err := r.Run(":8080"); err != nil {
+	r.GET("/ws/client", hdl.Authenticate, handler.RequireRole(auth.RoleViewer), hdl.HandleClientWS)
+
+	// Serve the frontend for all other routes, falling back to index.html (SPA)
+	frontend := web.Dist()
+	if cfg.StaticDir != "" {
+		frontend = os.DirFS(cfg.StaticDir)
+	}
+	if frontend == nil {
+		log.Fatal("Frontend is not embedded in this build, set -static-dir")
+	}
+	assets := static.New(frontend)
+	if !assets.HasIndex() {
+		log.Printf("Warning: frontend not built, run `npm run build` in web/ before building the server or set -static-dir")
+	}
+	r.NoRoute(assets.Handle)
+
+	srv := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           r,
+		ReadHeaderTimeout: cfg.HTTP.ReadHeaderTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+	}
+	if cfg.TLS.ClientCA != "" {
+		pem, err := os.ReadFile(cfg.TLS.ClientCA)
+		if err != nil {
+			log.Fatalf("Failed to read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in %s", cfg.TLS.ClientCA)
+		}
+		// Certificates are optional at the TLS layer so browsers can still
+		// connect; /ws/probe decides whether a probe must present one
+		srv.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if cfg.TLS.Cert != "" {
+			log.Printf("Server starting on %s (TLS)", cfg.Listen)
+			serveErr <- srv.ListenAndServeTLS(cfg.TLS.Cert, cfg.TLS.Key)
+		} else {
+			log.Printf("Server starting on %s", cfg.Listen)
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
 		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the server immediately
+
+	// Stop accepting tasks and let running ones finish before closing
+	log.Printf("Shutting down, waiting up to %s for running tasks", cfg.ShutdownTimeout)
+	deadline := time.Now().Add(cfg.ShutdownTimeout)
+	h.BeginShutdown(deadline)
+	waitCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if n := h.WaitForTasks(waitCtx); n > 0 {
+		log.Printf("%d tasks still running, closing connections anyway", n)
+	}
+	h.CloseAll(cfg.WebSocket.WriteWait)
+
+	// HTTP requests in progress get what is left of the same deadline
+	if err := srv.Shutdown(waitCtx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+	if whoisLn != nil {
+		whoisLn.Close()
 	}
+	log.Println("Server stopped")
 }
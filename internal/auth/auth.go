@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role controls what an authenticated caller may do
+type Role string
+
+const (
+	RoleNone     Role = ""         // no access at all
+	RoleViewer   Role = "viewer"   // list probes and watch results
+	RoleMeasurer Role = "measurer" // additionally create tasks
+	RoleAdmin    Role = "admin"    // additionally manage probes
+)
+
+var roleRank = map[Role]int{
+	RoleNone:     0,
+	RoleViewer:   1,
+	RoleMeasurer: 2,
+	RoleAdmin:    3,
+}
+
+// ParseRole validates a role name; "none" maps to RoleNone
+func ParseRole(s string) (Role, error) {
+	if s == "none" {
+		return RoleNone, nil
+	}
+	role := Role(s)
+	if _, ok := roleRank[role]; !ok {
+		return RoleNone, fmt.Errorf("unknown role %q", s)
+	}
+	return role, nil
+}
+
+// Allows reports whether r grants at least the required role
+func (r Role) Allows(required Role) bool {
+	return roleRank[r] >= roleRank[required]
+}
+
+// Principal identifies the caller behind a request
+type Principal struct {
+	Name string `json:"name"` // e.g. key:alice, mntner:FOO-MNT, anonymous
+	Role Role   `json:"role"`
+}
+
+// IsAnonymous reports whether no credentials were presented
+func (p Principal) IsAnonymous() bool {
+	return p.Name == anonymousName
+}
+
+const (
+	anonymousName = "anonymous"
+	sessionTTL    = 24 * time.Hour
+)
+
+var (
+	ErrInvalidToken      = errors.New("invalid or expired credentials")
+	ErrInvalidProbeToken = errors.New("invalid probe token")
+)
+
+// APIKey is a stored API key. Only the SHA-256 hash of the key is kept.
+// A key with Probe set is a probe token: it only lets the probe of that
+// name connect, and grants no role.
+type APIKey struct {
+	Name  string `json:"name"`
+	Hash  string `json:"hash"` // hex-encoded SHA-256 of the key
+	Role  Role   `json:"role"`
+	Probe string `json:"probe,omitempty"` // probe identity the key is bound to
+}
+
+type session struct {
+	principal Principal
+	expires   time.Time
+}
+
+// Authenticator resolves API keys and login sessions to principals
+type Authenticator struct {
+	anonymous Role
+	keys      []APIKey
+	mntner    *MntnerVerifier // nil when registry login is disabled
+
+	mu       sync.Mutex
+	sessions map[string]session // token hash -> session
+}
+
+// NewAuthenticator creates an Authenticator. Callers without credentials get
+// the anonymous role; mntner may be nil to disable registry login.
+func NewAuthenticator(anonymous Role, keys []APIKey, mntner *MntnerVerifier) *Authenticator {
+	return &Authenticator{
+		anonymous: anonymous,
+		keys:      keys,
+		mntner:    mntner,
+		sessions:  make(map[string]session),
+	}
+}
+
+// LoadKeys reads API keys from a JSON file containing a list of APIKey
+func LoadKeys(path string) ([]APIKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys: %w", err)
+	}
+	for i, key := range keys {
+		if _, err := ParseRole(string(key.Role)); err != nil {
+			return nil, fmt.Errorf("API key %q: %w", key.Name, err)
+		}
+		if key.Probe != "" && key.Role != RoleNone {
+			return nil, fmt.Errorf("API key %q: probe tokens cannot have a role", key.Name)
+		}
+		if b, err := hex.DecodeString(key.Hash); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("API key %q: hash must be a hex-encoded SHA-256", key.Name)
+		}
+		keys[i].Hash = strings.ToLower(key.Hash)
+	}
+	return keys, nil
+}
+
+// GenerateKey returns a new random API key and its hash for the key file
+func GenerateKey() (key, hash string) {
+	key = "gp_" + randomHex(24)
+	return key, HashKey(key)
+}
+
+// HashKey returns the hex-encoded SHA-256 of an API key or session token
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate resolves a bearer token. An empty token yields the anonymous
+// principal; an unknown token is an error rather than a silent downgrade.
+func (a *Authenticator) Authenticate(token string) (Principal, error) {
+	if token == "" {
+		return Principal{Name: anonymousName, Role: a.anonymous}, nil
+	}
+
+	hash := HashKey(token)
+	for _, key := range a.keys {
+		if key.Probe == "" && subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) == 1 {
+			return Principal{Name: "key:" + key.Name, Role: key.Role}, nil
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s, ok := a.sessions[hash]; ok {
+		if time.Now().Before(s.expires) {
+			return s.principal, nil
+		}
+		delete(a.sessions, hash)
+	}
+	return Principal{}, ErrInvalidToken
+}
+
+// AuthenticateProbe resolves a probe token to the probe identity it is
+// bound to
+func (a *Authenticator) AuthenticateProbe(token string) (string, error) {
+	hash := HashKey(token)
+	for _, key := range a.keys {
+		if key.Probe != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(key.Hash)) == 1 {
+			return key.Probe, nil
+		}
+	}
+	return "", ErrInvalidProbeToken
+}
+
+// Mntner returns the registry login verifier, or nil if disabled
+func (a *Authenticator) Mntner() *MntnerVerifier {
+	return a.mntner
+}
+
+// NewSession issues a session token for a principal
+func (a *Authenticator) NewSession(p Principal) (token string, expires time.Time) {
+	token = "gps_" + randomHex(24)
+	expires = time.Now().Add(sessionTTL)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for hash, s := range a.sessions {
+		if time.Now().After(s.expires) {
+			delete(a.sessions, hash)
+		}
+	}
+	a.sessions[HashKey(token)] = session{principal: p, expires: expires}
+	return token, expires
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestProbeTokens(t *testing.T) {
+	a := NewAuthenticator(RoleNone, []APIKey{
+		{Name: "alice", Hash: HashKey("gp_alice"), Role: RoleAdmin},
+		{Name: "probe-tokyo", Hash: HashKey("gp_tokyo"), Probe: "tokyo"},
+	}, nil)
+
+	if identity, err := a.AuthenticateProbe("gp_tokyo"); err != nil || identity != "tokyo" {
+		t.Errorf("AuthenticateProbe(probe token) = %q, %v; want tokyo", identity, err)
+	}
+	if _, err := a.AuthenticateProbe("gp_alice"); !errors.Is(err, ErrInvalidProbeToken) {
+		t.Errorf("AuthenticateProbe(user key): err = %v, want ErrInvalidProbeToken", err)
+	}
+	// Probe tokens grant no access to the API
+	if _, err := a.Authenticate("gp_tokyo"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate(probe token): err = %v, want ErrInvalidToken", err)
+	}
+	if p, err := a.Authenticate("gp_alice"); err != nil || p.Role != RoleAdmin {
+		t.Errorf("Authenticate(user key) = %+v, %v; want admin", p, err)
+	}
+}
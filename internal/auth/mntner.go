@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// SignatureNamespace must be passed to ssh-keygen -Y sign -n
+const SignatureNamespace = "dn42-globalping"
+
+const (
+	challengeTTL = 5 * time.Minute
+
+	// maxChallenges bounds the pending challenges of all mntners together
+	maxChallenges = 10000
+	// maxChallengesPerMntner and maxChallengesPerClient bound the pending
+	// challenges of one mntner and of one client address, so no single
+	// client can fill the table and lock every other mntner out
+	maxChallengesPerMntner = 32
+	maxChallengesPerClient = 8
+	// maxTriedChallenges bounds the challenges a signature is checked
+	// against when the client does not say which one it signed
+	maxTriedChallenges = 16
+)
+
+var (
+	ErrUnknownMntner     = errors.New("unknown mntner")
+	ErrNoSSHAuth         = errors.New("mntner has no ssh auth keys")
+	ErrNoChallenge       = errors.New("no pending challenge for mntner")
+	ErrTooManyChallenges = errors.New("too many pending challenges, try again later")
+	ErrInvalidSignature  = errors.New("signature does not match any auth key of the mntner")
+)
+
+type challenge struct {
+	mntner  string
+	client  string
+	expires time.Time
+}
+
+// MntnerVerifier lets users log in by proving control of a DN42 mntner:
+// they sign a server-issued challenge with an ssh key listed in one of the
+// mntner's auth: attributes (ssh-keygen -Y sign -n dn42-globalping)
+type MntnerVerifier struct {
+	registry *registry.Registry
+	role     Role
+
+	mu         sync.Mutex
+	challenges map[string]challenge // challenge text -> pending challenge
+}
+
+// NewMntnerVerifier creates a verifier granting role to maintainers that log in
+func NewMntnerVerifier(reg *registry.Registry, role Role) *MntnerVerifier {
+	return &MntnerVerifier{
+		registry:   reg,
+		role:       role,
+		challenges: make(map[string]challenge),
+	}
+}
+
+// Challenge issues a new challenge text for mntner to the client at the
+// given address. Each request gets its own challenge, so asking for one
+// never invalidates another pending one.
+func (v *MntnerVerifier) Challenge(mntner, client string) (string, time.Time, error) {
+	mntner = strings.ToUpper(strings.TrimSpace(mntner))
+	if _, err := v.authKeys(mntner); err != nil {
+		return "", time.Time{}, err
+	}
+
+	text := fmt.Sprintf("dn42-globalping login %s %s", mntner, randomHex(16))
+	now := time.Now()
+	expires := now.Add(challengeTTL)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	perMntner, perClient := 0, 0
+	for t, c := range v.challenges {
+		switch {
+		case now.After(c.expires):
+			delete(v.challenges, t)
+			continue
+		case c.mntner == mntner:
+			perMntner++
+		}
+		if c.client == client {
+			perClient++
+		}
+	}
+	if len(v.challenges) >= maxChallenges || perMntner >= maxChallengesPerMntner || perClient >= maxChallengesPerClient {
+		return "", time.Time{}, ErrTooManyChallenges
+	}
+	v.challenges[text] = challenge{mntner: mntner, client: client, expires: expires}
+	return text, expires, nil
+}
+
+// Verify checks an armored SSH signature over a pending challenge of the
+// mntner. text names the challenge that was signed; if empty, the mntner's
+// most recent pending challenges are tried. A named challenge is consumed
+// whether or not verification succeeds, others only by a valid signature.
+func (v *MntnerVerifier) Verify(mntner, text, armored string) (Principal, error) {
+	mntner = strings.ToUpper(strings.TrimSpace(mntner))
+	candidates := v.pending(mntner, text)
+	if len(candidates) == 0 {
+		return Principal{}, ErrNoChallenge
+	}
+
+	keys, err := v.authKeys(mntner)
+	if err != nil {
+		return Principal{}, err
+	}
+	for _, candidate := range candidates {
+		signer, err := verifySSHSig([]byte(candidate), armored, SignatureNamespace)
+		if errors.Is(err, ErrInvalidSignature) {
+			continue // signed a different challenge
+		}
+		if err != nil {
+			return Principal{}, err
+		}
+		for _, key := range keys {
+			if bytes.Equal(key.Marshal(), signer.Marshal()) {
+				v.mu.Lock()
+				delete(v.challenges, candidate)
+				v.mu.Unlock()
+				return Principal{Name: "mntner:" + mntner, Role: v.role}, nil
+			}
+		}
+		break
+	}
+	return Principal{}, ErrInvalidSignature
+}
+
+// pending returns the texts of the mntner's unexpired challenges to verify
+// a signature against: the named one, consumed, or the most recent ones
+func (v *MntnerVerifier) pending(mntner, text string) []string {
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if text != "" {
+		c, ok := v.challenges[text]
+		delete(v.challenges, text)
+		if !ok || c.mntner != mntner || now.After(c.expires) {
+			return nil
+		}
+		return []string{text}
+	}
+
+	var texts []string
+	for t, c := range v.challenges {
+		if c.mntner == mntner && !now.After(c.expires) {
+			texts = append(texts, t)
+		}
+	}
+	sort.Slice(texts, func(i, j int) bool {
+		return v.challenges[texts[i]].expires.After(v.challenges[texts[j]].expires)
+	})
+	if len(texts) > maxTriedChallenges {
+		texts = texts[:maxTriedChallenges]
+	}
+	return texts
+}
+
+// authKeys returns the ssh public keys listed in the mntner's auth: attributes
+func (v *MntnerVerifier) authKeys(mntner string) ([]ssh.PublicKey, error) {
+	obj := v.registry.Object("mntner", mntner)
+	if obj == nil {
+		return nil, ErrUnknownMntner
+	}
+
+	var keys []ssh.PublicKey
+	for _, value := range obj.GetAll("auth") {
+		if !strings.HasPrefix(value, "ssh-") && !strings.HasPrefix(value, "ecdsa-") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(value))
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoSSHAuth
+	}
+	return keys, nil
+}
+
+// sshsigBlob is the body of an SSHSIG signature after the magic preamble,
+// see PROTOCOL.sshsig in OpenSSH
+type sshsigBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshsigSignedData is what the signature actually covers
+type sshsigSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+const sshsigMagic = "SSHSIG"
+
+// verifySSHSig verifies an armored "ssh-keygen -Y sign" signature over
+// message and returns the public key that made it
+func verifySSHSig(message []byte, armored, namespace string) (ssh.PublicKey, error) {
+	body := strings.TrimSpace(armored)
+	body = strings.TrimPrefix(body, "-----BEGIN SSH SIGNATURE-----")
+	body = strings.TrimSuffix(body, "-----END SSH SIGNATURE-----")
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	if !bytes.HasPrefix(raw, []byte(sshsigMagic)) {
+		return nil, errors.New("malformed signature: missing SSHSIG preamble")
+	}
+
+	var blob sshsigBlob
+	if err := ssh.Unmarshal(raw[len(sshsigMagic):], &blob); err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+	if blob.Version != 1 {
+		return nil, fmt.Errorf("unsupported signature version %d", blob.Version)
+	}
+	if blob.Namespace != namespace {
+		return nil, fmt.Errorf("signature namespace must be %q", namespace)
+	}
+
+	var hash []byte
+	switch blob.HashAlgorithm {
+	case "sha256":
+		sum := sha256.Sum256(message)
+		hash = sum[:]
+	case "sha512":
+		sum := sha512.Sum512(message)
+		hash = sum[:]
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", blob.HashAlgorithm)
+	}
+
+	pub, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature key: %w", err)
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &sig); err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+
+	signed := append([]byte(sshsigMagic), ssh.Marshal(sshsigSignedData{
+		Namespace:     blob.Namespace,
+		Reserved:      blob.Reserved,
+		HashAlgorithm: blob.HashAlgorithm,
+		Hash:          hash,
+	})...)
+	if err := pub.Verify(signed, &sig); err != nil {
+		return nil, ErrInvalidSignature
+	}
+	return pub, nil
+}
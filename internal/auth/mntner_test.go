@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bingxin666/dn42-globalping/internal/registry"
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestVerifier returns a verifier for a registry holding FOO-MNT and
+// BAR-MNT, whose only auth key is the returned signer
+func newTestVerifier(t *testing.T) (*MntnerVerifier, ssh.Signer) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "data", "mntner")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"FOO-MNT", "BAR-MNT"} {
+		obj := "mntner: " + name + "\nauth: " + string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(obj), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reg, err := registry.Load(filepath.Dir(filepath.Dir(dir)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMntnerVerifier(reg, RoleMeasurer), signer
+}
+
+// sign makes an armored signature like ssh-keygen -Y sign -n dn42-globalping
+func sign(t *testing.T, signer ssh.Signer, message string) string {
+	t.Helper()
+	hash := sha512.Sum512([]byte(message))
+	signed := append([]byte(sshsigMagic), ssh.Marshal(sshsigSignedData{
+		Namespace:     SignatureNamespace,
+		HashAlgorithm: "sha512",
+		Hash:          hash[:],
+	})...)
+	sig, err := signer.Sign(rand.Reader, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := append([]byte(sshsigMagic), ssh.Marshal(sshsigBlob{
+		Version:       1,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     SignatureNamespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	})...)
+	return "-----BEGIN SSH SIGNATURE-----\n" + base64.StdEncoding.EncodeToString(blob) + "\n-----END SSH SIGNATURE-----\n"
+}
+
+func TestChallengesDoNotReplaceEachOther(t *testing.T) {
+	v, signer := newTestVerifier(t)
+
+	first, _, err := v.Challenge("FOO-MNT", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := v.Challenge("foo-mnt", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("two requests got the same challenge")
+	}
+
+	principal, err := v.Verify("FOO-MNT", first, sign(t, signer, first))
+	if err != nil {
+		t.Fatalf("first challenge: %v", err)
+	}
+	if principal.Name != "mntner:FOO-MNT" {
+		t.Errorf("principal = %q, want mntner:FOO-MNT", principal.Name)
+	}
+	// Without naming it, the remaining challenge is found
+	if _, err := v.Verify("FOO-MNT", "", sign(t, signer, second)); err != nil {
+		t.Fatalf("second challenge: %v", err)
+	}
+}
+
+func TestChallengeIsUsedOnce(t *testing.T) {
+	v, signer := newTestVerifier(t)
+	text, _, err := v.Challenge("FOO-MNT", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := sign(t, signer, text)
+	if _, err := v.Verify("FOO-MNT", text, sig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify("FOO-MNT", text, sig); !errors.Is(err, ErrNoChallenge) {
+		t.Errorf("replayed signature: err = %v, want ErrNoChallenge", err)
+	}
+}
+
+func TestVerifyRejectsOtherKeys(t *testing.T) {
+	v, _ := newTestVerifier(t)
+	_, other := newTestVerifier(t)
+	text, _, err := v.Challenge("FOO-MNT", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify("FOO-MNT", "", sign(t, other, text)); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("err = %v, want ErrInvalidSignature", err)
+	}
+	// A failed attempt without naming the challenge leaves it pending
+	if got := v.pending("FOO-MNT", ""); len(got) != 1 || got[0] != text {
+		t.Errorf("pending = %v, want [%s]", got, text)
+	}
+}
+
+func TestNoisyClientCannotLockOutOthers(t *testing.T) {
+	v, _ := newTestVerifier(t)
+
+	// One address asking over and over runs into its own limit
+	var err error
+	for i := 0; i <= maxChallengesPerClient && err == nil; i++ {
+		_, _, err = v.Challenge("FOO-MNT", "198.51.100.1")
+	}
+	if !errors.Is(err, ErrTooManyChallenges) {
+		t.Fatalf("noisy client was never limited, last error %v", err)
+	}
+
+	// Many addresses hammering one mntner run into its limit
+	err = nil
+	for i := 0; i <= maxChallengesPerMntner && err == nil; i++ {
+		_, _, err = v.Challenge("FOO-MNT", fmt.Sprintf("198.51.100.%d", i+2))
+	}
+	if !errors.Is(err, ErrTooManyChallenges) {
+		t.Fatalf("flooded mntner was never limited, last error %v", err)
+	}
+
+	if _, _, err := v.Challenge("BAR-MNT", "192.0.2.1"); err != nil {
+		t.Fatalf("other mntner locked out: %v", err)
+	}
+	if _, _, err := v.Challenge("BAR-MNT", "198.51.100.2"); err != nil {
+		t.Fatalf("client of the flooded mntner locked out of another: %v", err)
+	}
+}
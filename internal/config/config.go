@@ -0,0 +1,248 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/auth"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds all server settings. Values are resolved in order of
+// increasing precedence: defaults, config file, environment, flags.
+type Config struct {
+	Listen         string   `yaml:"listen"`
+	TLS            TLS      `yaml:"tls"`
+	StaticDir      string   `yaml:"static_dir"`      // serve the frontend from disk instead of the embedded copy
+	AllowedOrigins []string `yaml:"allowed_origins"` // extra origins for CORS and WebSockets, "*" for any
+	TrustedProxies []string `yaml:"trusted_proxies"` // IPs/CIDRs whose X-Forwarded-For is trusted
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // how long running tasks may take to finish on shutdown
+
+	HTTP      HTTP      `yaml:"http"`
+	WebSocket WebSocket `yaml:"websocket"`
+	Probes    Probes    `yaml:"probes"`
+	Tasks     Tasks     `yaml:"tasks"`
+	Storage   Storage   `yaml:"storage"`
+	Auth      Auth      `yaml:"auth"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+	Registry  Registry  `yaml:"registry"`
+}
+
+// TLS enables HTTPS/WSS when both files are set. With ClientCA, probes may
+// authenticate with a client certificate whose common name is their identity.
+type TLS struct {
+	Cert             string `yaml:"cert"`
+	Key              string `yaml:"key"`
+	ClientCA         string `yaml:"client_ca"`          // CA bundle that signs probe certificates
+	RequireProbeCert bool   `yaml:"require_probe_cert"` // reject probes without a certificate
+}
+
+// HTTP holds HTTP server timeouts
+type HTTP struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+}
+
+// WebSocket holds WebSocket buffer sizes and keepalive timing
+type WebSocket struct {
+	ReadBufferSize  int           `yaml:"read_buffer_size"`
+	WriteBufferSize int           `yaml:"write_buffer_size"`
+	SendQueueSize   int           `yaml:"send_queue_size"` // outgoing messages buffered per connection
+	PingInterval    time.Duration `yaml:"ping_interval"`
+	PongWait        time.Duration `yaml:"pong_wait"`
+	WriteWait       time.Duration `yaml:"write_wait"`
+	Compression     bool          `yaml:"compression"` // offer permessage-deflate
+
+	SlowConsumerTimeout time.Duration `yaml:"slow_consumer_timeout"` // disconnect peers whose queue stays full this long
+}
+
+// Probes holds probe management settings
+type Probes struct {
+	HeartbeatTimeout   time.Duration `yaml:"heartbeat_timeout"`
+	AdminStateFile     string        `yaml:"admin_state_file"`
+	MinProbeVersion    string        `yaml:"min_probe_version"` // e.g. v1.2.0, empty to accept any
+	MinProtocolVersion int           `yaml:"min_protocol_version"`
+	RequireToken       bool          `yaml:"require_token"` // reject probes without a probe token
+}
+
+// Tasks holds the server's ceiling on each task's runtime and output per
+// probe. Clients may ask for less; probes may enforce less on their own.
+type Tasks struct {
+	Timeout  time.Duration `yaml:"timeout"`   // whole seconds, 0 for no ceiling
+	MaxLines int           `yaml:"max_lines"` // 0 for no ceiling
+	MaxBytes int           `yaml:"max_bytes"` // 0 for no ceiling
+}
+
+// Storage selects where measurements are kept. Only the in-memory backend
+// exists so far; the key is validated so configs stay forward compatible.
+type Storage struct {
+	Backend         string `yaml:"backend"`
+	MaxMeasurements int    `yaml:"max_measurements"` // oldest are dropped beyond this
+}
+
+// Auth holds authentication settings
+type Auth struct {
+	APIKeysFile   string `yaml:"api_keys_file"`
+	AnonymousRole string `yaml:"anonymous_role"`
+	MntnerRole    string `yaml:"mntner_role"`
+}
+
+// RateLimit holds per-client task creation limits
+type RateLimit struct {
+	PerMinute  float64 `yaml:"per_minute"`
+	Burst      int     `yaml:"burst"`
+	DailyQuota int     `yaml:"daily_quota"`
+}
+
+// Registry points at a DN42 registry checkout for whois
+type Registry struct {
+	Dir         string `yaml:"dir"`
+	WhoisListen string `yaml:"whois_listen"`
+}
+
+// Default returns the built-in defaults
+func Default() *Config {
+	return &Config{
+		Listen:          ":8080",
+		ShutdownTimeout: 30 * time.Second,
+		HTTP: HTTP{
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       120 * time.Second,
+		},
+		WebSocket: WebSocket{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			SendQueueSize:   256,
+			PingInterval:    30 * time.Second,
+			PongWait:        60 * time.Second,
+			WriteWait:       10 * time.Second,
+			Compression:     true,
+
+			SlowConsumerTimeout: 30 * time.Second,
+		},
+		Probes: Probes{
+			HeartbeatTimeout:   90 * time.Second,
+			MinProtocolVersion: protocol.MinVersion,
+		},
+		Tasks: Tasks{
+			Timeout:  5 * time.Minute,
+			MaxLines: 10000,
+			MaxBytes: 1 << 20,
+		},
+		Storage: Storage{
+			Backend:         "memory",
+			MaxMeasurements: 1000,
+		},
+		Auth: Auth{
+			AnonymousRole: "measurer",
+			MntnerRole:    "measurer",
+		},
+		RateLimit: RateLimit{
+			PerMinute:  10,
+			Burst:      5,
+			DailyQuota: 1000,
+		},
+	}
+}
+
+// loadFile merges a YAML file into c, rejecting unknown keys
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the configuration and reports every problem at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Listen != "", "listen: must not be empty")
+	check((c.TLS.Cert == "") == (c.TLS.Key == ""), "tls: cert and key must be set together")
+	check(c.TLS.ClientCA == "" || c.TLS.Cert != "", "tls.client_ca: requires tls.cert and tls.key")
+	check(!c.TLS.RequireProbeCert || c.TLS.ClientCA != "", "tls.require_probe_cert: requires tls.client_ca")
+	for _, path := range []string{c.TLS.Cert, c.TLS.Key, c.TLS.ClientCA} {
+		if path != "" {
+			_, err := os.Stat(path)
+			check(err == nil, "tls: %v", err)
+		}
+	}
+	for _, origin := range c.AllowedOrigins {
+		u, err := url.Parse(origin)
+		check(origin == "*" || (err == nil && u.Scheme != "" && u.Host != ""),
+			"allowed_origins: %q must be \"*\" or scheme://host[:port]", origin)
+	}
+	for _, proxy := range c.TrustedProxies {
+		_, _, cidrErr := net.ParseCIDR(proxy)
+		check(cidrErr == nil || net.ParseIP(proxy) != nil, "trusted_proxies: %q is not an IP or CIDR", proxy)
+	}
+
+	if c.StaticDir != "" {
+		info, err := os.Stat(c.StaticDir)
+		check(err == nil && info.IsDir(), "static_dir: %q is not a directory", c.StaticDir)
+	}
+
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout: must not be negative")
+	check(c.HTTP.ReadHeaderTimeout > 0, "http.read_header_timeout: must be positive")
+	check(c.HTTP.IdleTimeout > 0, "http.idle_timeout: must be positive")
+	check(c.WebSocket.ReadBufferSize > 0, "websocket.read_buffer_size: must be positive")
+	check(c.WebSocket.WriteBufferSize > 0, "websocket.write_buffer_size: must be positive")
+	check(c.WebSocket.SendQueueSize > 0, "websocket.send_queue_size: must be positive")
+	check(c.WebSocket.PingInterval > 0, "websocket.ping_interval: must be positive")
+	check(c.WebSocket.PongWait > c.WebSocket.PingInterval, "websocket.pong_wait: must be longer than ping_interval")
+	check(c.WebSocket.WriteWait > 0, "websocket.write_wait: must be positive")
+	check(c.WebSocket.SlowConsumerTimeout > 0, "websocket.slow_consumer_timeout: must be positive")
+	check(c.Probes.HeartbeatTimeout > 0, "probes.heartbeat_timeout: must be positive")
+	check(!c.Probes.RequireToken || c.Auth.APIKeysFile != "", "probes.require_token: requires auth.api_keys_file")
+	if c.Probes.MinProbeVersion != "" {
+		err := protocol.ParseVersion(c.Probes.MinProbeVersion)
+		check(err == nil, "probes.min_probe_version: %v", err)
+	}
+	check(c.Probes.MinProtocolVersion >= protocol.MinVersion && c.Probes.MinProtocolVersion <= protocol.Version,
+		"probes.min_protocol_version: must be between %d and %d", protocol.MinVersion, protocol.Version)
+
+	check(c.Tasks.Timeout >= 0, "tasks.timeout: must not be negative")
+	check(c.Tasks.Timeout%time.Second == 0, "tasks.timeout: must be whole seconds")
+	check(c.Tasks.MaxLines >= 0, "tasks.max_lines: must not be negative")
+	check(c.Tasks.MaxBytes >= 0, "tasks.max_bytes: must not be negative")
+
+	check(c.Storage.Backend == "memory", "storage.backend: unknown backend %q (supported: memory)", c.Storage.Backend)
+	check(c.Storage.MaxMeasurements > 0, "storage.max_measurements: must be positive")
+
+	_, err := auth.ParseRole(c.Auth.AnonymousRole)
+	check(err == nil, "auth.anonymous_role: %v", err)
+	_, err = auth.ParseRole(c.Auth.MntnerRole)
+	check(err == nil, "auth.mntner_role: %v", err)
+
+	check(c.RateLimit.PerMinute >= 0, "rate_limit.per_minute: must not be negative")
+	check(c.RateLimit.Burst > 0, "rate_limit.burst: must be positive")
+	check(c.RateLimit.DailyQuota >= 0, "rate_limit.daily_quota: must not be negative")
+
+	if c.Registry.Dir != "" {
+		info, err := os.Stat(c.Registry.Dir)
+		check(err == nil && info.IsDir(), "registry.dir: %q is not a directory", c.Registry.Dir)
+	}
+	check(c.Registry.WhoisListen == "" || c.Registry.Dir != "", "registry.whois_listen: requires registry.dir")
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string // empty when valid
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"viewer anonymous role", func(c *Config) { c.Auth.AnonymousRole = "viewer" }, ""},
+		{"unknown anonymous role", func(c *Config) { c.Auth.AnonymousRole = "root" }, "auth.anonymous_role"},
+		{"unknown mntner role", func(c *Config) { c.Auth.MntnerRole = "owner" }, "auth.mntner_role"},
+		{"negative shutdown timeout", func(c *Config) { c.ShutdownTimeout = -time.Second }, "shutdown_timeout"},
+		{"zero ping interval", func(c *Config) { c.WebSocket.PingInterval = 0 }, "websocket.ping_interval"},
+		{"pong wait shorter than ping", func(c *Config) { c.WebSocket.PongWait = c.WebSocket.PingInterval }, "websocket.pong_wait"},
+		{"fractional task timeout", func(c *Config) { c.Tasks.Timeout = 1500 * time.Millisecond }, "tasks.timeout: must be whole seconds"},
+		{"zero heartbeat timeout", func(c *Config) { c.Probes.HeartbeatTimeout = 0 }, "probes.heartbeat_timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if tt.err == "" && err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Validate = %v, want an error about %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.AnonymousRole = "root"
+	cfg.Auth.MntnerRole = "owner"
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "auth.anonymous_role") || !strings.Contains(err.Error(), "auth.mntner_role") {
+		t.Fatalf("Validate = %v, want both roles reported", err)
+	}
+}
+
+// load runs Flags.Load with args and the config file content, if any
+func load(t *testing.T, file string, args ...string) (*Config, error) {
+	t.Helper()
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "server.yaml")
+		if err := os.WriteFile(path, []byte(file), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", path}, args...)
+	}
+	return NewFlags("server", io.Discard).Load(args)
+}
+
+func TestLoadInvalidValues(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		err  string
+	}{
+		{name: "flag duration", args: []string{"-ping-interval", "soon"}, err: "invalid -ping-interval"},
+		{name: "env duration", env: map[string]string{"GLOBALPING_PONG_WAIT": "10"}, err: "invalid GLOBALPING_PONG_WAIT"},
+		{name: "file duration", file: "websocket:\n  ping_interval: soon\n", err: "failed to parse config file"},
+		{name: "flag role", args: []string{"-anonymous-role", "root"}, err: "auth.anonymous_role"},
+		{name: "env role", env: map[string]string{"GLOBALPING_MNTNER_ROLE": "owner"}, err: "auth.mntner_role"},
+		{name: "file role", file: "auth:\n  anonymous_role: root\n", err: "auth.anonymous_role"},
+		{name: "unknown file key", file: "listen_addr: :8080\n", err: "listen_addr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if _, err := load(t, tt.file, tt.args...); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Load = %v, want an error about %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := "listen: \":1\"\nwebsocket:\n  ping_interval: 11s\n  pong_wait: 60s\nauth:\n  anonymous_role: viewer\n"
+	tests := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		listen string
+		ping   time.Duration
+		role   string
+	}{
+		{"file over defaults", nil, nil, ":1", 11 * time.Second, "viewer"},
+		{"env over file", map[string]string{"GLOBALPING_LISTEN": ":2", "GLOBALPING_PING_INTERVAL": "12s", "GLOBALPING_ANONYMOUS_ROLE": "none"}, nil, ":2", 12 * time.Second, "none"},
+		{
+			"flags over env",
+			map[string]string{"GLOBALPING_LISTEN": ":2", "GLOBALPING_PING_INTERVAL": "12s", "GLOBALPING_ANONYMOUS_ROLE": "none"},
+			[]string{"-listen", ":3", "-ping-interval", "13s", "-anonymous-role", "measurer"},
+			":3", 13 * time.Second, "measurer",
+		},
+		{"flags over file", nil, []string{"-listen", ":3"}, ":3", 11 * time.Second, "viewer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := load(t, file, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Listen != tt.listen || cfg.WebSocket.PingInterval != tt.ping || cfg.Auth.AnonymousRole != tt.role {
+				t.Errorf("listen %q, ping_interval %s, anonymous_role %q; want %q, %s, %q",
+					cfg.Listen, cfg.WebSocket.PingInterval, cfg.Auth.AnonymousRole, tt.listen, tt.ping, tt.role)
+			}
+			if cfg.WebSocket.PongWait != 60*time.Second {
+				t.Errorf("pong_wait = %s, want 60s from the file", cfg.WebSocket.PongWait)
+			}
+		})
+	}
+}
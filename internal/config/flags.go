@@ -0,0 +1,200 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is prepended to the upper-cased flag name to form the
+// environment variable overriding a setting, e.g. GLOBALPING_LISTEN
+const EnvPrefix = "GLOBALPING_"
+
+// setting binds a flag/environment name to a config field
+type setting struct {
+	name   string
+	usage  string
+	set    func(c *Config, value string) error
+	isBool bool
+}
+
+func stringSetting(name, usage string, field func(c *Config) *string) setting {
+	return setting{name: name, usage: usage, set: func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}}
+}
+
+func listSetting(name, usage string, field func(c *Config) *[]string) setting {
+	return setting{name: name, usage: usage, set: func(c *Config, v string) error {
+		var list []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*field(c) = list
+		return nil
+	}}
+}
+
+func boolSetting(name, usage string, field func(c *Config) *bool) setting {
+	return setting{name: name, usage: usage, set: func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		*field(c) = b
+		return err
+	}, isBool: true}
+}
+
+func intSetting(name, usage string, field func(c *Config) *int) setting {
+	return setting{name: name, usage: usage, set: func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		*field(c) = n
+		return err
+	}}
+}
+
+func floatSetting(name, usage string, field func(c *Config) *float64) setting {
+	return setting{name: name, usage: usage, set: func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		*field(c) = f
+		return err
+	}}
+}
+
+func durationSetting(name, usage string, field func(c *Config) *time.Duration) setting {
+	return setting{name: name, usage: usage, set: func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		*field(c) = d
+		return err
+	}}
+}
+
+// settings lists every value that can be overridden by flag or environment
+var settings = []setting{
+	stringSetting("listen", "HTTP listen address", func(c *Config) *string { return &c.Listen }),
+	stringSetting("tls-cert", "TLS certificate file (enables HTTPS)", func(c *Config) *string { return &c.TLS.Cert }),
+	stringSetting("tls-key", "TLS private key file", func(c *Config) *string { return &c.TLS.Key }),
+	stringSetting("tls-client-ca", "CA bundle for verifying probe client certificates", func(c *Config) *string { return &c.TLS.ClientCA }),
+	boolSetting("require-probe-cert", "Reject probes without a verified client certificate", func(c *Config) *bool { return &c.TLS.RequireProbeCert }),
+	stringSetting("static-dir", "Serve the frontend from this directory instead of the embedded copy", func(c *Config) *string { return &c.StaticDir }),
+	listSetting("allowed-origins", "Comma-separated extra origins allowed for CORS and WebSockets (* for any)", func(c *Config) *[]string { return &c.AllowedOrigins }),
+	listSetting("trusted-proxies", "Comma-separated proxy IPs/CIDRs whose X-Forwarded-For is trusted", func(c *Config) *[]string { return &c.TrustedProxies }),
+	durationSetting("shutdown-timeout", "How long running tasks may take to finish on shutdown", func(c *Config) *time.Duration { return &c.ShutdownTimeout }),
+
+	durationSetting("read-header-timeout", "HTTP read header timeout", func(c *Config) *time.Duration { return &c.HTTP.ReadHeaderTimeout }),
+	durationSetting("idle-timeout", "HTTP keep-alive idle timeout", func(c *Config) *time.Duration { return &c.HTTP.IdleTimeout }),
+
+	intSetting("read-buffer-size", "WebSocket read buffer size", func(c *Config) *int { return &c.WebSocket.ReadBufferSize }),
+	intSetting("write-buffer-size", "WebSocket write buffer size", func(c *Config) *int { return &c.WebSocket.WriteBufferSize }),
+	intSetting("send-queue-size", "Outgoing messages buffered per WebSocket", func(c *Config) *int { return &c.WebSocket.SendQueueSize }),
+	durationSetting("ping-interval", "WebSocket ping interval", func(c *Config) *time.Duration { return &c.WebSocket.PingInterval }),
+	durationSetting("pong-wait", "Close WebSockets silent for this long", func(c *Config) *time.Duration { return &c.WebSocket.PongWait }),
+	durationSetting("write-wait", "WebSocket write timeout", func(c *Config) *time.Duration { return &c.WebSocket.WriteWait }),
+	durationSetting("slow-consumer-timeout", "Disconnect WebSockets whose send queue stays full this long", func(c *Config) *time.Duration { return &c.WebSocket.SlowConsumerTimeout }),
+	boolSetting("ws-compression", "Offer permessage-deflate compression on WebSockets", func(c *Config) *bool { return &c.WebSocket.Compression }),
+
+	durationSetting("heartbeat-timeout", "Disconnect probes that send no heartbeat for this long", func(c *Config) *time.Duration { return &c.Probes.HeartbeatTimeout }),
+	stringSetting("admin-state", "Path to persist disabled and draining probes and label overrides", func(c *Config) *string { return &c.Probes.AdminStateFile }),
+	boolSetting("require-probe-token", "Reject probes without a probe token from the API keys file", func(c *Config) *bool { return &c.Probes.RequireToken }),
+	intSetting("min-protocol-version", "Reject probes speaking an older protocol version", func(c *Config) *int { return &c.Probes.MinProtocolVersion }),
+	stringSetting("min-probe-version", "Reject probes older than this version, e.g. v1.2.0", func(c *Config) *string { return &c.Probes.MinProbeVersion }),
+
+	durationSetting("task-timeout", "Longest a task may run on a probe (0 for no ceiling)", func(c *Config) *time.Duration { return &c.Tasks.Timeout }),
+	intSetting("task-max-lines", "Most output lines a task may produce on a probe (0 for no ceiling)", func(c *Config) *int { return &c.Tasks.MaxLines }),
+	intSetting("task-max-bytes", "Most output bytes a task may produce on a probe (0 for no ceiling)", func(c *Config) *int { return &c.Tasks.MaxBytes }),
+
+	stringSetting("storage", "Measurement storage backend (memory)", func(c *Config) *string { return &c.Storage.Backend }),
+	intSetting("max-measurements", "Measurements kept for retrieval by ID", func(c *Config) *int { return &c.Storage.MaxMeasurements }),
+
+	stringSetting("api-keys", "Path to a JSON file of hashed API keys", func(c *Config) *string { return &c.Auth.APIKeysFile }),
+	stringSetting("anonymous-role", "Role for callers without credentials (none, viewer, measurer, admin)", func(c *Config) *string { return &c.Auth.AnonymousRole }),
+	stringSetting("mntner-role", "Role granted to users logging in with a DN42 mntner (none to disable)", func(c *Config) *string { return &c.Auth.MntnerRole }),
+
+	floatSetting("rate-limit", "Tasks each client may create per minute (0 to disable)", func(c *Config) *float64 { return &c.RateLimit.PerMinute }),
+	intSetting("rate-burst", "Tasks each client may create in a burst", func(c *Config) *int { return &c.RateLimit.Burst }),
+	intSetting("daily-quota", "Probe-tests each client may run per day (0 to disable)", func(c *Config) *int { return &c.RateLimit.DailyQuota }),
+
+	stringSetting("registry", "Path to a DN42 registry checkout for whois lookups", func(c *Config) *string { return &c.Registry.Dir }),
+	stringSetting("whois", "Listen address for the port 43 whois service (e.g. :43)", func(c *Config) *string { return &c.Registry.WhoisListen }),
+}
+
+// EnvName returns the environment variable for a flag name
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// recorder captures flag values so they can be applied after the config
+// file has been loaded
+type recorder struct {
+	values map[string]string
+	name   string
+	isBool bool
+}
+
+func (r recorder) String() string     { return r.values[r.name] }
+func (r recorder) Set(v string) error { r.values[r.name] = v; return nil }
+
+// IsBoolFlag lets boolean settings be given as -flag without a value
+func (r recorder) IsBoolFlag() bool { return r.isBool }
+
+// Flags holds the flag set used by Load, so callers can add their own flags
+type Flags struct {
+	*flag.FlagSet
+	configPath string
+	values     map[string]string
+}
+
+// NewFlags registers -config and one flag per setting on a new flag set
+func NewFlags(name string, output io.Writer) *Flags {
+	f := &Flags{
+		FlagSet: flag.NewFlagSet(name, flag.ExitOnError),
+		values:  make(map[string]string),
+	}
+	f.SetOutput(output)
+	f.StringVar(&f.configPath, "config", os.Getenv(EnvName("config")), "Path to a YAML config file")
+
+	for _, s := range settings {
+		f.Var(recorder{values: f.values, name: s.name, isBool: s.isBool}, s.name, s.usage)
+	}
+	return f
+}
+
+// Load builds the configuration from defaults, the -config file, environment
+// variables and explicitly set flags, then validates it
+func (f *Flags) Load(args []string) (*Config, error) {
+	if err := f.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if f.configPath != "" {
+		if err := cfg.loadFile(f.configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(EnvName(s.name)); ok {
+			if err := s.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", EnvName(s.name), err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := f.values[s.name]; ok {
+			if err := s.set(cfg, v); err != nil {
+				return nil, fmt.Errorf("invalid -%s: %w", s.name, err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/bingxin666/dn42-globalping/internal/hub"
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/gin-gonic/gin"
+)
+
+// GetAdminProbes lists connected probes with full details and the disabled
+// identities (admin API)
+func (h *Handler) GetAdminProbes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"probes":   h.hub.GetProbeDetails(),
+		"disabled": h.hub.DisabledIdentities(),
+	})
+}
+
+// GetAdminStats reports how many messages were dropped and why (admin API)
+func (h *Handler) GetAdminStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"drops": h.hub.DropStats(),
+	})
+}
+
+// PostDrainProbe stops dispatching new tasks to a probe (admin API)
+func (h *Handler) PostDrainProbe(c *gin.Context) {
+	h.adminAction(c, "drain", h.hub.SetProbeDraining(c.Param("id"), true))
+}
+
+// DeleteDrainProbe resumes dispatching tasks to a drained probe (admin API)
+func (h *Handler) DeleteDrainProbe(c *gin.Context) {
+	h.adminAction(c, "undrain", h.hub.SetProbeDraining(c.Param("id"), false))
+}
+
+// PostKickProbe disconnects a probe (admin API)
+func (h *Handler) PostKickProbe(c *gin.Context) {
+	h.adminAction(c, "kick", h.hub.KickProbe(c.Param("id")))
+}
+
+// PostDisableProbe disconnects a probe and rejects its identity from now on (admin API)
+func (h *Handler) PostDisableProbe(c *gin.Context) {
+	h.adminAction(c, "disable", h.hub.DisableProbe(c.Param("id")))
+}
+
+// DeleteDisabledIdentity allows a disabled identity to register again (admin API)
+func (h *Handler) DeleteDisabledIdentity(c *gin.Context) {
+	h.adminAction(c, "enable", h.hub.EnableIdentity(c.Param("identity")))
+}
+
+// PatchProbe overrides a probe's displayed name, location or tags (admin API)
+func (h *Handler) PatchProbe(c *gin.Context) {
+	var override model.ProbeOverride
+	if err := c.ShouldBindJSON(&override); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid override"})
+		return
+	}
+	h.adminAction(c, "relabel", h.hub.SetProbeOverride(c.Param("id"), override))
+}
+
+// DeleteProbeOverride restores a probe's self-reported labels (admin API)
+func (h *Handler) DeleteProbeOverride(c *gin.Context) {
+	h.adminAction(c, "reset labels", h.hub.SetProbeOverride(c.Param("id"), model.ProbeOverride{}))
+}
+
+// adminAction logs an admin action and writes its result
+func (h *Handler) adminAction(c *gin.Context, action string, err error) {
+	target := c.Param("id") + c.Param("identity")
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, hub.ErrProbeNotFound) {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Admin %s: %s %s", principalFrom(c).Name, action, target)
+	c.Status(http.StatusNoContent)
+}
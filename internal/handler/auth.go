@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bingxin666/dn42-globalping/internal/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const principalKey = "principal"
+
+// Mntner login requests need no credentials, so they are rate limited per
+// client address on their own, apart from the measurement limit
+const (
+	loginsPerMinute = 10
+	loginBurst      = 5
+)
+
+// WebSocket subprotocols: browsers, which cannot set headers on a
+// WebSocket, offer tokenProtocolPrefix+token along with wsProtocol, and the
+// server picks wsProtocol. Tokens are never read from the URL, which ends
+// up in logs.
+const (
+	wsProtocol          = "globalping"
+	tokenProtocolPrefix = "bearer."
+)
+
+// Authenticate resolves the request's API key or session token to a
+// principal. Tokens are read from "Authorization: Bearer <token>" or, for
+// browser WebSockets, from a "bearer.<token>" WebSocket subprotocol.
+func (h *Handler) Authenticate(c *gin.Context) {
+	token := bearerToken(c.Request)
+	if token == "" {
+		token = protocolToken(c.Request)
+	}
+
+	principal, err := h.auth.Authenticate(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(principalKey, principal)
+	c.Next()
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	return strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// protocolToken returns the token offered as a WebSocket subprotocol
+func protocolToken(r *http.Request) string {
+	for _, p := range websocket.Subprotocols(r) {
+		if token, ok := strings.CutPrefix(p, tokenProtocolPrefix); ok {
+			return token
+		}
+	}
+	return ""
+}
+
+// RequireRole rejects requests whose principal lacks the given role
+func RequireRole(role auth.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := principalFrom(c)
+		if !principal.Role.Allows(role) {
+			status := http.StatusForbidden
+			if principal.IsAnonymous() {
+				status = http.StatusUnauthorized
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": "requires role " + string(role)})
+			return
+		}
+		c.Next()
+	}
+}
+
+// principalFrom returns the principal set by Authenticate
+func principalFrom(c *gin.Context) auth.Principal {
+	if v, ok := c.Get(principalKey); ok {
+		return v.(auth.Principal)
+	}
+	return auth.Principal{}
+}
+
+// GetWhoami returns the caller's principal (REST API)
+func (h *Handler) GetWhoami(c *gin.Context) {
+	c.JSON(http.StatusOK, principalFrom(c))
+}
+
+// LimitLogins rate limits the mntner login endpoints per client address
+func (h *Handler) LimitLogins(c *gin.Context) {
+	res := h.logins.Allow("ip:"+c.ClientIP(), 0)
+	if !res.Allowed {
+		setRateLimitHeaders(c, res)
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too many login attempts"})
+		return
+	}
+	c.Next()
+}
+
+// PostAuthChallenge issues a challenge for a DN42 mntner login (REST API)
+func (h *Handler) PostAuthChallenge(c *gin.Context) {
+	verifier := h.auth.Mntner()
+	if verifier == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "mntner login not configured"})
+		return
+	}
+
+	var req struct {
+		Mntner string `json:"mntner" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing mntner"})
+		return
+	}
+
+	text, expires, err := verifier.Challenge(req.Mntner, c.ClientIP())
+	if errors.Is(err, auth.ErrTooManyChallenges) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"challenge":  text,
+		"namespace":  auth.SignatureNamespace,
+		"expires_at": expires,
+	})
+}
+
+// PostAuthVerify exchanges a signed challenge for a session token (REST API)
+func (h *Handler) PostAuthVerify(c *gin.Context) {
+	verifier := h.auth.Mntner()
+	if verifier == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "mntner login not configured"})
+		return
+	}
+
+	var req struct {
+		Mntner    string `json:"mntner" binding:"required"`
+		Challenge string `json:"challenge"` // the challenge signed, optional
+		Signature string `json:"signature" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing mntner or signature"})
+		return
+	}
+
+	principal, err := verifier.Verify(req.Mntner, req.Challenge, req.Signature)
+	if err != nil {
+		status := http.StatusUnauthorized
+		if errors.Is(err, auth.ErrUnknownMntner) || errors.Is(err, auth.ErrNoSSHAuth) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, expires := h.auth.NewSession(principal)
+	log.Printf("Login: %s as %s", principal.Name, principal.Role)
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"principal":  principal,
+		"expires_at": expires,
+	})
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bingxin666/dn42-globalping/internal/auth"
+	"github.com/bingxin666/dn42-globalping/internal/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestAuthenticateTokenSources(t *testing.T) {
+	h := &Handler{auth: auth.NewAuthenticator(auth.RoleNone, []auth.APIKey{
+		{Name: "alice", Hash: auth.HashKey("gp_alice"), Role: auth.RoleAdmin},
+	}, nil)}
+	r := gin.New()
+	r.GET("/whoami", h.Authenticate, h.GetWhoami)
+
+	tests := []struct {
+		name      string
+		url       string
+		header    http.Header
+		want      int
+		principal string // principal name in the response
+	}{
+		{"bearer header", "/whoami", http.Header{"Authorization": {"Bearer gp_alice"}}, http.StatusOK, "key:alice"},
+		{"websocket subprotocol", "/whoami", http.Header{"Sec-Websocket-Protocol": {"globalping, bearer.gp_alice"}}, http.StatusOK, "key:alice"},
+		{"query parameter ignored", "/whoami?token=gp_alice", nil, http.StatusOK, "anonymous"},
+		{"wrong token", "/whoami", http.Header{"Authorization": {"Bearer gp_bob"}}, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			for k, v := range tt.header {
+				req.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.principal != "" && !strings.Contains(w.Body.String(), `"name":"`+tt.principal+`"`) {
+				t.Errorf("principal = %s, want %s", w.Body, tt.principal)
+			}
+		})
+	}
+}
+
+func TestLoggerLeavesOutQuery(t *testing.T) {
+	var buf bytes.Buffer
+	saved := gin.DefaultWriter
+	gin.DefaultWriter = &buf
+	defer func() { gin.DefaultWriter = saved }()
+
+	r := gin.New()
+	r.Use(Logger())
+	r.GET("/x", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/x?token=gp_secret", nil))
+
+	if strings.Contains(buf.String(), "gp_secret") || !strings.Contains(buf.String(), `"/x"`) {
+		t.Errorf("log line = %q", buf.String())
+	}
+}
+
+func TestLoginsAreRateLimitedPerAddress(t *testing.T) {
+	h := &Handler{logins: ratelimit.New(loginsPerMinute, loginBurst, 0)}
+	r := gin.New()
+	r.POST("/auth/challenge", h.LimitLogins, func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	post := func(addr string) int {
+		req := httptest.NewRequest(http.MethodPost, "/auth/challenge", nil)
+		req.RemoteAddr = addr + ":1234"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i := 0; i < loginBurst; i++ {
+		if code := post("192.0.2.1"); code != http.StatusNoContent {
+			t.Fatalf("request %d: status %d", i, code)
+		}
+	}
+	if code := post("192.0.2.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst: status %d, want 429", code)
+	}
+	if code := post("192.0.2.2"); code != http.StatusNoContent {
+		t.Fatalf("other address: status %d", code)
+	}
+}
+
+func TestAuthorizeProbeIdentity(t *testing.T) {
+	h := &Handler{auth: auth.NewAuthenticator(auth.RoleNone, []auth.APIKey{
+		{Name: "p1-token", Hash: auth.HashKey("gp_p1"), Probe: "p1"},
+	}, nil)}
+
+	tests := []struct {
+		name     string
+		token    string
+		probe    string
+		identity string
+		err      bool
+	}{
+		{"token", "gp_p1", "p1", "p1", false},
+		{"token for another probe", "gp_p1", "p2", "", true},
+		{"no credentials", "", "p1", "unverified:p1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/ws/probe", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			identity, err := h.authorizeProbe(req, tt.probe)
+			if (err != nil) != tt.err || identity != tt.identity {
+				t.Errorf("authorizeProbe = %q, %v; want %q, error %v", identity, err, tt.identity, tt.err)
+			}
+		})
+	}
+}
@@ -1,42 +1,75 @@
 package handler
 
 import (
-	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/bingxin666/dn42-globalping/internal/auth"
+	"github.com/bingxin666/dn42-globalping/internal/config"
 	"github.com/bingxin666/dn42-globalping/internal/hub"
 	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+	"github.com/bingxin666/dn42-globalping/internal/ratelimit"
+	"github.com/bingxin666/dn42-globalping/internal/registry"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for development
-	},
-}
-
 // Handler holds all HTTP and WebSocket handlers
 type Handler struct {
-	hub *hub.Hub
+	hub       *hub.Hub
+	registry  *registry.Registry // nil when no registry is configured
+	limiter   *ratelimit.Limiter
+	logins    *ratelimit.Limiter // mntner login attempts per client address
+	auth      *auth.Authenticator
+	keepalive Keepalive
+	origins   originPolicy
+	upgrader  websocket.Upgrader
+
+	requireProbeCert  bool // reject probes without a verified client certificate
+	requireProbeToken bool // reject probes without a probe token
 }
 
 // NewHandler creates a new Handler
-func NewHandler(h *hub.Hub) *Handler {
-	return &Handler{hub: h}
+func NewHandler(cfg *config.Config, h *hub.Hub, reg *registry.Registry, authenticator *auth.Authenticator) *Handler {
+	hdl := &Handler{
+		hub:      h,
+		registry: reg,
+		limiter:  ratelimit.New(cfg.RateLimit.PerMinute, cfg.RateLimit.Burst, cfg.RateLimit.DailyQuota),
+		logins:   ratelimit.New(loginsPerMinute, loginBurst, 0),
+		auth:     authenticator,
+		keepalive: Keepalive{
+			PingInterval: cfg.WebSocket.PingInterval,
+			PongWait:     cfg.WebSocket.PongWait,
+			WriteWait:    cfg.WebSocket.WriteWait,
+		},
+		origins:           newOriginPolicy(cfg.AllowedOrigins),
+		requireProbeCert:  cfg.TLS.RequireProbeCert,
+		requireProbeToken: cfg.Probes.RequireToken,
+	}
+	hdl.upgrader = websocket.Upgrader{
+		ReadBufferSize:    cfg.WebSocket.ReadBufferSize,
+		WriteBufferSize:   cfg.WebSocket.WriteBufferSize,
+		EnableCompression: cfg.WebSocket.Compression,
+		CheckOrigin:       hdl.origins.checkWebSocket,
+		Subprotocols:      []string{wsProtocol},
+	}
+	return hdl
 }
 
 // HandleProbeWS handles WebSocket connections from probe nodes
 func (h *Handler) HandleProbeWS(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade probe connection: %v", err)
 		return
 	}
+	conn.SetReadLimit(protocol.MaxMessageSize)
+	h.keepalive.extend(conn)
 
 	// Wait for registration message
 	_, message, err := conn.ReadMessage()
@@ -46,38 +79,61 @@ func (h *Handler) HandleProbeWS(c *gin.Context) {
 		return
 	}
 
-	var msg model.Message
-	if err := json.Unmarshal(message, &msg); err != nil {
+	// Probes newer than the server may send fields it does not know yet
+	msg, err := protocol.ProbeToServer.DecodeFrom(message, protocol.AnnouncedVersion(message))
+	if err != nil {
 		log.Printf("Failed to parse registration message: %v", err)
-		conn.Close()
+		h.rejectProbe(conn, fmt.Errorf("invalid registration: %w", err))
 		return
 	}
 
 	if msg.Type != model.MsgTypeRegister {
 		log.Printf("Expected register message, got: %s", msg.Type)
-		conn.Close()
+		h.rejectProbe(conn, fmt.Errorf("expected register, got %s", msg.Type))
 		return
 	}
 
-	// Parse registration payload
-	payloadBytes, _ := json.Marshal(msg.Payload)
-	var registerPayload model.RegisterPayload
-	if err := json.Unmarshal(payloadBytes, &registerPayload); err != nil {
+	registerPayload, err := protocol.DecodePayload[model.RegisterPayload](msg)
+	if err != nil {
 		log.Printf("Failed to parse register payload: %v", err)
-		conn.Close()
+		h.rejectProbe(conn, fmt.Errorf("invalid registration: %w", err))
 		return
 	}
 
-	probe := h.hub.RegisterProbe(conn, registerPayload)
-	defer h.hub.UnregisterProbe(probe.ID)
+	var probe *hub.ProbeConnection
+	identity, err := h.authorizeProbe(c.Request, registerPayload.Name)
+	if err == nil {
+		probe, err = h.hub.RegisterProbe(conn, registerPayload, identity)
+	}
+	if err != nil {
+		h.rejectProbe(conn, err)
+		return
+	}
+	defer h.hub.UnregisterProbe(probe)
+	h.keepalive.setup(conn, func(rtt time.Duration) {
+		h.hub.UpdateProbeRTT(probe.ID, rtt)
+	})
 
 	// Send probe ID back
-	idMsg := model.Message{
+	registered := model.RegisteredPayload{ProbeID: probe.ID}
+	if probe.Info.ProtocolVersion >= 2 {
+		// Strict version 1 decoders would reject the extra fields
+		registered.ProtocolVersion = min(probe.Info.ProtocolVersion, protocol.Version)
+		registered.Features = probe.Info.Features
+		registered.ResumeToken = probe.ResumeToken
+	}
+	idData, err := protocol.ServerToProbe.Encode(model.Message{
 		Type:    model.MsgTypeRegister,
-		Payload: map[string]string{"probe_id": probe.ID},
+		Payload: registered,
+	})
+	if err != nil {
+		log.Printf("Failed to encode probe ID: %v", err)
+		return
+	}
+	if err := h.keepalive.write(conn, websocket.TextMessage, idData); err != nil {
+		log.Printf("Failed to send probe ID: %v", err)
+		return
 	}
-	idData, _ := json.Marshal(idMsg)
-	conn.WriteMessage(websocket.TextMessage, idData)
 
 	// Start write goroutine
 	go h.probeWriter(probe)
@@ -91,9 +147,10 @@ func (h *Handler) HandleProbeWS(c *gin.Context) {
 			}
 			break
 		}
+		h.keepalive.extend(conn)
 
-		var msg model.Message
-		if err := json.Unmarshal(message, &msg); err != nil {
+		msg, err := protocol.ProbeToServer.DecodeFrom(message, probe.Info.ProtocolVersion)
+		if err != nil {
 			log.Printf("Failed to parse message from probe %s: %v", probe.ID, err)
 			continue
 		}
@@ -102,35 +159,48 @@ func (h *Handler) HandleProbeWS(c *gin.Context) {
 		case model.MsgTypeHeartbeat:
 			h.hub.UpdateProbeHeartbeat(probe.ID)
 		case model.MsgTypeTaskResult:
-			payloadBytes, _ := json.Marshal(msg.Payload)
-			var resultPayload model.TaskResultPayload
-			if err := json.Unmarshal(payloadBytes, &resultPayload); err != nil {
-				log.Printf("Failed to parse task result: %v", err)
+			resultPayload, err := protocol.DecodePayload[model.TaskResultPayload](msg)
+			if err != nil {
+				log.Printf("Failed to parse task result from probe %s: %v", probe.ID, err)
 				continue
 			}
 			resultPayload.ProbeID = probe.ID
 			h.hub.ForwardTaskResult(resultPayload)
+		case model.MsgTypeTaskStatus:
+			statusPayload, err := protocol.DecodePayload[model.TaskStatusPayload](msg)
+			if err != nil {
+				log.Printf("Failed to parse task status from probe %s: %v", probe.ID, err)
+				continue
+			}
+			statusPayload.ProbeID = probe.ID
+			h.hub.ForwardTaskStatus(statusPayload)
 		}
 	}
 }
 
+// rejectProbe tells a probe why it cannot register and closes its connection
+func (h *Handler) rejectProbe(conn *websocket.Conn, err error) {
+	errData, _ := protocol.ServerToProbe.Encode(model.Message{
+		Type:    model.MsgTypeError,
+		Payload: model.ErrorPayload{Message: err.Error()},
+	})
+	h.keepalive.write(conn, websocket.TextMessage, errData)
+	conn.Close()
+}
+
 // probeWriter handles writing messages to probe
 func (h *Handler) probeWriter(probe *hub.ProbeConnection) {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(h.keepalive.PingInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case message, ok := <-probe.SendCh:
-			if !ok {
-				probe.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-			if err := probe.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		case <-probe.Queue.Ready():
+			if !h.writeQueued(probe.Conn, probe.Queue) {
 				return
 			}
 		case <-ticker.C:
-			if err := probe.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := h.keepalive.ping(probe.Conn); err != nil {
 				return
 			}
 		}
@@ -139,17 +209,23 @@ func (h *Handler) probeWriter(probe *hub.ProbeConnection) {
 
 // HandleClientWS handles WebSocket connections from web clients
 func (h *Handler) HandleClientWS(c *gin.Context) {
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade client connection: %v", err)
 		return
 	}
 
-	client := h.hub.RegisterClient(conn)
+	conn.SetReadLimit(protocol.MaxMessageSize)
+	// Clients opt into protocol features, such as batch, with ?features=
+	client := h.hub.RegisterClient(conn, strings.Split(c.Query("features"), ","))
 	defer h.hub.UnregisterClient(client.ID)
+	h.keepalive.setup(conn, nil)
+	principal := principalFrom(c)
+	identity := clientIdentity(c)
 
-	// Send current probe list
+	// Send current probe list and remaining quota
 	h.hub.SendProbeListToClient(client.ID)
+	h.sendQuota(client.ID, h.limiter.Peek(identity))
 
 	// Start write goroutine
 	go h.clientWriter(client)
@@ -163,28 +239,82 @@ func (h *Handler) HandleClientWS(c *gin.Context) {
 			}
 			break
 		}
+		h.keepalive.extend(conn)
 
-		var msg model.Message
-		if err := json.Unmarshal(message, &msg); err != nil {
+		msg, err := protocol.ClientToServer.Decode(message)
+		if err != nil {
 			log.Printf("Failed to parse message from client %s: %v", client.ID, err)
+			h.hub.SendToClient(client.ID, model.Message{
+				Type:    model.MsgTypeError,
+				Payload: model.ErrorPayload{Message: "Invalid message: " + err.Error()},
+			})
 			continue
 		}
 
 		switch msg.Type {
 		case model.MsgTypeTaskCreate:
-			payloadBytes, _ := json.Marshal(msg.Payload)
-			var createPayload model.TaskCreatePayload
-			if err := json.Unmarshal(payloadBytes, &createPayload); err != nil {
+			if !principal.Role.Allows(auth.RoleMeasurer) {
+				h.hub.SendToClient(client.ID, model.Message{
+					Type:    model.MsgTypeError,
+					Payload: model.ErrorPayload{Message: "Permission denied: creating tasks requires role measurer"},
+				})
+				continue
+			}
+
+			if h.hub.ShuttingDown() {
+				h.hub.SendToClient(client.ID, model.Message{
+					Type:    model.MsgTypeError,
+					Payload: model.ErrorPayload{Message: "Server is shutting down, try again later"},
+				})
+				continue
+			}
+
+			createPayload, err := protocol.DecodePayload[model.TaskCreatePayload](msg)
+			if err != nil {
 				log.Printf("Failed to parse task create payload: %v", err)
 				h.hub.SendToClient(client.ID, model.Message{
 					Type:    model.MsgTypeError,
-					Payload: model.ErrorPayload{Message: "Invalid task payload"},
+					Payload: model.ErrorPayload{Message: "Invalid message: " + err.Error()},
+				})
+				continue
+			}
+			if err := h.hub.CheckLimits(createPayload.Limits); err != nil {
+				h.hub.SendToClient(client.ID, model.Message{
+					Type:    model.MsgTypeError,
+					Payload: model.ErrorPayload{Message: "Invalid task: " + err.Error()},
+				})
+				continue
+			}
+
+			// Resolve selectors up front so the quota is charged per probe-test
+			createPayload.ProbeIDs = h.hub.ResolveProbes(createPayload)
+			createPayload.Selectors = nil
+			if len(createPayload.ProbeIDs) == 0 {
+				h.hub.SendToClient(client.ID, model.Message{
+					Type:    model.MsgTypeError,
+					Payload: model.ErrorPayload{Message: "No probes matched the selection"},
 				})
 				continue
 			}
 
-			taskID := h.hub.CreateTask(client.ID, createPayload)
-			log.Printf("Task created: %s for client %s", taskID, client.ID)
+			res := h.limiter.Allow(identity, len(createPayload.ProbeIDs))
+			if !res.Allowed {
+				log.Printf("Rate limited client %s (%s)", client.ID, identity)
+				h.hub.SendToClient(client.ID, model.Message{
+					Type: model.MsgTypeError,
+					Payload: model.ErrorPayload{
+						Message:    "Rate limit exceeded",
+						RetryAfter: retryAfterSeconds(res),
+					},
+				})
+				h.sendQuota(client.ID, res)
+				continue
+			}
+
+			if taskID := h.hub.CreateTask(client.ID, createPayload); taskID != "" {
+				log.Printf("Task created: %s for client %s", taskID, client.ID)
+			}
+			h.sendQuota(client.ID, res)
 		case model.MsgTypeProbeList:
 			h.hub.SendProbeListToClient(client.ID)
 		}
@@ -193,27 +323,46 @@ func (h *Handler) HandleClientWS(c *gin.Context) {
 
 // clientWriter handles writing messages to client
 func (h *Handler) clientWriter(client *hub.ClientConnection) {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(h.keepalive.PingInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case message, ok := <-client.SendCh:
-			if !ok {
-				client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-			if err := client.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		case <-client.Queue.Ready():
+			if !h.writeQueued(client.Conn, client.Queue) {
 				return
 			}
 		case <-ticker.C:
-			if err := client.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := h.keepalive.ping(client.Conn); err != nil {
 				return
 			}
 		}
 	}
 }
 
+// writeQueued writes every queued message. It returns false when the
+// writer should stop, after sending a close frame if the queue was closed.
+func (h *Handler) writeQueued(conn *websocket.Conn, queue *hub.SendQueue) bool {
+	// Messages queued before the connection went away are still written
+	closed := queue.Closed()
+	for {
+		message, ok := queue.Pop()
+		if !ok {
+			break
+		}
+		if err := h.keepalive.write(conn, websocket.TextMessage, message); err != nil {
+			return false
+		}
+	}
+	if closed {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(h.keepalive.WriteWait))
+		return false
+	}
+	return true
+}
+
 // GetProbes returns list of all probes (REST API)
 func (h *Handler) GetProbes(c *gin.Context) {
 	probes := h.hub.GetProbeList()
@@ -221,3 +370,91 @@ func (h *Handler) GetProbes(c *gin.Context) {
 		"probes": probes,
 	})
 }
+
+// GetProbeHistory returns the online/offline history and uptime of a probe identity (REST API)
+func (h *Handler) GetProbeHistory(c *gin.Context) {
+	identity := c.Param("identity")
+	events, uptime, ok := h.hub.ProbeHistory(identity)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown probe identity"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"identity": identity,
+		"uptime":   uptime,
+		"events":   events,
+	})
+}
+
+// GetQuota returns the caller's remaining daily quota (REST API)
+func (h *Handler) GetQuota(c *gin.Context) {
+	res := h.limiter.Peek(clientIdentity(c))
+	setRateLimitHeaders(c, res)
+	c.JSON(http.StatusOK, quotaPayload(res))
+}
+
+// clientIdentity returns the key rate limits and quotas are tracked under:
+// the principal for authenticated callers, the client IP otherwise
+func clientIdentity(c *gin.Context) string {
+	if principal := principalFrom(c); !principal.IsAnonymous() {
+		return principal.Name
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// sendQuota tells a web client how much of its daily quota is left
+func (h *Handler) sendQuota(clientID string, res ratelimit.Result) {
+	h.hub.SendToClient(clientID, model.Message{
+		Type:    model.MsgTypeQuota,
+		Payload: quotaPayload(res),
+	})
+}
+
+func quotaPayload(res ratelimit.Result) model.QuotaPayload {
+	return model.QuotaPayload{
+		Limit:     res.QuotaLimit,
+		Remaining: res.QuotaRemaining,
+		ResetAt:   res.QuotaReset,
+	}
+}
+
+// setRateLimitHeaders adds the quota headers, and Retry-After when denied
+func setRateLimitHeaders(c *gin.Context, res ratelimit.Result) {
+	if res.QuotaLimit >= 0 {
+		c.Header("X-RateLimit-Limit", strconv.Itoa(res.QuotaLimit))
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(res.QuotaRemaining))
+		c.Header("X-RateLimit-Reset", strconv.FormatInt(res.QuotaReset.Unix(), 10))
+	}
+	if !res.Allowed {
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(res)))
+	}
+}
+
+// retryAfterSeconds rounds the retry delay up to whole seconds
+func retryAfterSeconds(res ratelimit.Result) int {
+	return int((res.RetryAfter + time.Second - 1) / time.Second)
+}
+
+// GetWhois resolves an IP, prefix, ASN or object name against the DN42 registry (REST API)
+func (h *Handler) GetWhois(c *gin.Context) {
+	if h.registry == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "whois registry not configured"})
+		return
+	}
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing query parameter q"})
+		return
+	}
+
+	objects := h.registry.Lookup(query)
+	if objects == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no entries found", "query": query})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"query":   query,
+		"objects": objects,
+	})
+}
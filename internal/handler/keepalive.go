@@ -0,0 +1,45 @@
+package handler
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Keepalive configures WebSocket ping/pong liveness checks
+type Keepalive struct {
+	PingInterval time.Duration // how often the server pings the peer
+	PongWait     time.Duration // how long without any frame before the peer is considered dead
+	WriteWait    time.Duration // deadline for every write
+}
+
+// setup arms the read deadline and extends it on every pong. Pings carry
+// their send time, so onRTT (if not nil) receives each round-trip time.
+func (k Keepalive) setup(conn *websocket.Conn, onRTT func(time.Duration)) {
+	k.extend(conn)
+	conn.SetPongHandler(func(appData string) error {
+		k.extend(conn)
+		if sent, err := strconv.ParseInt(appData, 10, 64); err == nil && onRTT != nil {
+			onRTT(time.Since(time.Unix(0, sent)))
+		}
+		return nil
+	})
+}
+
+// extend pushes the read deadline forward after any frame from the peer
+func (k Keepalive) extend(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(k.PongWait))
+}
+
+// ping sends a ping whose payload is the current time
+func (k Keepalive) ping(conn *websocket.Conn) error {
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	return conn.WriteControl(websocket.PingMessage, []byte(now), time.Now().Add(k.WriteWait))
+}
+
+// write sends a data message with a write deadline
+func (k Keepalive) write(conn *websocket.Conn, messageType int, data []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(k.WriteWait))
+	return conn.WriteMessage(messageType, data)
+}
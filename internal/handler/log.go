@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Logger logs requests like gin's default logger, but without the query
+// string, so that nothing passed in a URL ends up in the logs
+func Logger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(p gin.LogFormatterParams) string {
+		path, _, _ := strings.Cut(p.Path, "?")
+		return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+			p.TimeStamp.Format(time.DateTime), p.StatusCode, p.Latency, p.ClientIP, p.Method, path, p.ErrorMessage)
+	})
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/gin-gonic/gin"
+)
+
+// PostMeasurement creates a task without a WebSocket; results are fetched
+// later with GetMeasurement (REST API)
+func (h *Handler) PostMeasurement(c *gin.Context) {
+	if h.hub.ShuttingDown() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "server is shutting down, try again later"})
+		return
+	}
+
+	var payload model.TaskCreatePayload
+	if err := c.ShouldBindJSON(&payload); err != nil || payload.Type == "" ||
+		(payload.Target == "" && h.hub.NeedsTarget(payload.Type)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid measurement, type and target are required"})
+		return
+	}
+	if err := h.hub.CheckLimits(payload.Limits); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid measurement, " + err.Error()})
+		return
+	}
+
+	// Resolve selectors up front so the quota is charged per probe-test
+	payload.ProbeIDs = h.hub.ResolveProbes(payload)
+	payload.Selectors = nil
+	if len(payload.ProbeIDs) == 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "no probes matched the selection"})
+		return
+	}
+
+	identity := clientIdentity(c)
+	res := h.limiter.Allow(identity, len(payload.ProbeIDs))
+	setRateLimitHeaders(c, res)
+	if !res.Allowed {
+		log.Printf("Rate limited %s", identity)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded"})
+		return
+	}
+
+	taskID := h.hub.CreateTask("", payload)
+	log.Printf("Task created: %s for %s", taskID, identity)
+	c.JSON(http.StatusAccepted, gin.H{"id": taskID, "probe_ids": payload.ProbeIDs})
+}
+
+// GetMeasurement returns a measurement and the output of every probe so far (REST API)
+func (h *Handler) GetMeasurement(c *gin.Context) {
+	m, ok := h.hub.Measurement(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "measurement not found"})
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
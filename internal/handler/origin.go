@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// originPolicy decides which browser origins may call the API and open
+// WebSockets. The server's own origin is always allowed.
+type originPolicy struct {
+	any     bool
+	allowed map[string]bool
+}
+
+func newOriginPolicy(origins []string) originPolicy {
+	p := originPolicy{allowed: make(map[string]bool)}
+	for _, origin := range origins {
+		if origin == "*" {
+			p.any = true
+			continue
+		}
+		p.allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return p
+}
+
+// allows reports whether a cross-origin request from origin is permitted
+func (p originPolicy) allows(origin string) bool {
+	return p.any || p.allowed[strings.ToLower(origin)]
+}
+
+// sameOrigin reports whether origin matches the host the request was sent to
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// checkWebSocket is the upgrader's CheckOrigin. Requests without an Origin
+// header come from non-browser clients such as probes and are allowed.
+func (p originPolicy) checkWebSocket(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || sameOrigin(r, origin) || p.allows(origin)
+}
+
+// CORS adds CORS headers for allowed cross-origin callers and answers preflight requests
+func (h *Handler) CORS(c *gin.Context) {
+	origin := c.GetHeader("Origin")
+	if origin != "" && !sameOrigin(c.Request, origin) && h.origins.allows(origin) {
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Header("Vary", "Origin")
+	}
+	if c.Request.Method == http.MethodOptions {
+		c.AbortWithStatus(http.StatusNoContent)
+		return
+	}
+	c.Next()
+}
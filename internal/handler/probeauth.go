@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// unverifiedPrefix marks the identity of a probe that presented neither a
+// token nor a client certificate, so a name it merely claims never matches
+// the identity of a probe that proved it
+const unverifiedPrefix = "unverified:"
+
+var (
+	errProbeCertRequired  = errors.New("a client certificate is required to register probes")
+	errProbeTokenRequired = errors.New("a probe token is required to register probes")
+)
+
+// probeCertIdentity returns the common name of the verified client
+// certificate presented by a probe, or "" if it presented none
+func probeCertIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// authorizeProbe checks that a probe registering as name holds a token and
+// a client certificate for that identity, for each that it presented or
+// that is required. It returns the identity operator actions are keyed on:
+// the one proven by token or certificate, or name with unverifiedPrefix
+// if the probe proved none.
+func (h *Handler) authorizeProbe(r *http.Request, name string) (string, error) {
+	verified := ""
+	if token := bearerToken(r); token != "" {
+		identity, err := h.auth.AuthenticateProbe(token)
+		if err != nil {
+			log.Printf("Rejected probe %s from %s: %v", name, r.RemoteAddr, err)
+			return "", err
+		}
+		if identity != name {
+			log.Printf("Rejected probe %s from %s: token is for %s", name, r.RemoteAddr, identity)
+			return "", fmt.Errorf("probe token is for %q, not %q", identity, name)
+		}
+		verified = identity
+	} else if h.requireProbeToken {
+		log.Printf("Rejected probe %s from %s: no probe token", name, r.RemoteAddr)
+		return "", errProbeTokenRequired
+	}
+
+	if identity := probeCertIdentity(r); identity != "" {
+		if identity != name {
+			log.Printf("Rejected probe %s from %s: certificate is for %s", name, r.RemoteAddr, identity)
+			return "", fmt.Errorf("client certificate is for %q, not %q", identity, name)
+		}
+		verified = identity
+	} else if h.requireProbeCert {
+		log.Printf("Rejected probe %s from %s: no client certificate", name, r.RemoteAddr)
+		return "", errProbeCertRequired
+	}
+
+	if verified == "" {
+		return unverifiedPrefix + name, nil
+	}
+	return verified, nil
+}
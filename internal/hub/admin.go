@@ -0,0 +1,244 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+var (
+	ErrProbeNotFound = errors.New("probe not found")
+	ErrProbeDisabled = errors.New("probe has been disabled by an operator")
+)
+
+// ProbeDetail is the full view of a connected probe for operators
+type ProbeDetail struct {
+	model.ProbeInfo
+	RemoteAddr  string                `json:"remote_addr"`
+	ConnectedAt time.Time             `json:"connected_at"`
+	Reported    model.RegisterPayload `json:"reported"`
+	Override    *model.ProbeOverride  `json:"override,omitempty"`
+}
+
+// adminState is the persisted form of operator decisions
+type adminState struct {
+	Disabled  []string                       `json:"disabled"`
+	Draining  []string                       `json:"draining,omitempty"`
+	Overrides map[string]model.ProbeOverride `json:"overrides"`
+}
+
+// LoadAdminState reads disabled and draining identities and overrides from path and
+// persists later changes there. A missing file starts with an empty state.
+func (h *Hub) LoadAdminState(path string) error {
+	h.probesMux.Lock()
+	defer h.probesMux.Unlock()
+
+	h.statePath = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read admin state: %w", err)
+	}
+
+	var state adminState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse admin state: %w", err)
+	}
+	for _, identity := range state.Disabled {
+		h.disabled[identity] = true
+	}
+	for _, identity := range state.Draining {
+		h.draining[identity] = true
+	}
+	for identity, override := range state.Overrides {
+		h.overrides[identity] = override
+	}
+	return nil
+}
+
+// saveAdminState persists operator decisions; callers hold probesMux
+func (h *Hub) saveAdminState() {
+	if h.statePath == "" {
+		return
+	}
+
+	state := adminState{
+		Disabled:  sortedIdentities(h.disabled),
+		Draining:  sortedIdentities(h.draining),
+		Overrides: h.overrides,
+	}
+	data, _ := json.MarshalIndent(state, "", "  ")
+	tmp := h.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		log.Printf("Failed to save admin state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, h.statePath); err != nil {
+		log.Printf("Failed to save admin state: %v", err)
+	}
+}
+
+// sortedIdentities returns the identities set in m, sorted; callers hold probesMux
+func sortedIdentities(m map[string]bool) []string {
+	identities := make([]string, 0, len(m))
+	for identity := range m {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+	return identities
+}
+
+// DisabledIdentities returns the identities that may not register
+func (h *Hub) DisabledIdentities() []string {
+	h.probesMux.RLock()
+	defer h.probesMux.RUnlock()
+	return sortedIdentities(h.disabled)
+}
+
+// GetProbeDetails returns the full details of every connected probe
+func (h *Hub) GetProbeDetails() []ProbeDetail {
+	h.probesMux.RLock()
+	defer h.probesMux.RUnlock()
+
+	details := make([]ProbeDetail, 0, len(h.probes))
+	for _, p := range h.probes {
+		detail := ProbeDetail{
+			ProbeInfo:   p.Info,
+			RemoteAddr:  p.Conn.RemoteAddr().String(),
+			ConnectedAt: p.ConnectedAt,
+			Reported:    p.Reported,
+		}
+		if override, ok := h.overrides[p.Info.Identity]; ok {
+			detail.Override = &override
+		}
+		details = append(details, detail)
+	}
+	return details
+}
+
+// SetProbeDraining stops or resumes dispatching new tasks to a probe's
+// identity, which stays drained across reconnects. Tasks already running
+// are left to finish.
+func (h *Hub) SetProbeDraining(probeID string, draining bool) error {
+	h.probesMux.Lock()
+	defer h.probesMux.Unlock()
+
+	probe, ok := h.probes[probeID]
+	if !ok {
+		return ErrProbeNotFound
+	}
+	identity := probe.Info.Identity
+	status := model.ProbeStatusOnline
+	if draining {
+		h.draining[identity] = true
+		status = model.ProbeStatusDraining
+	} else {
+		delete(h.draining, identity)
+	}
+	h.saveAdminState()
+
+	for _, p := range h.probes {
+		if p.Info.Identity == identity {
+			p.Info.Status = status
+		}
+	}
+	log.Printf("Probe identity %s draining: %t", identity, draining)
+	h.broadcastProbeList()
+	return nil
+}
+
+// KickProbe forcibly disconnects a probe; it may reconnect afterwards
+func (h *Hub) KickProbe(probeID string) error {
+	h.probesMux.RLock()
+	probe, ok := h.probes[probeID]
+	h.probesMux.RUnlock()
+	if !ok {
+		return ErrProbeNotFound
+	}
+
+	log.Printf("Kicking probe %s", probeID)
+	return probe.disconnect()
+}
+
+// DisableProbe permanently rejects the probe's identity and disconnects it
+func (h *Hub) DisableProbe(probeID string) error {
+	h.probesMux.Lock()
+	probe, ok := h.probes[probeID]
+	if !ok {
+		h.probesMux.Unlock()
+		return ErrProbeNotFound
+	}
+	h.disabled[probe.Info.Identity] = true
+	h.saveAdminState()
+	h.probesMux.Unlock()
+
+	log.Printf("Disabled probe identity %s", probe.Info.Identity)
+	return probe.disconnect()
+}
+
+// EnableIdentity allows a previously disabled identity to register again
+func (h *Hub) EnableIdentity(identity string) error {
+	h.probesMux.Lock()
+	defer h.probesMux.Unlock()
+
+	if !h.disabled[identity] {
+		return ErrProbeNotFound
+	}
+	delete(h.disabled, identity)
+	h.saveAdminState()
+	log.Printf("Enabled probe identity %s", identity)
+	return nil
+}
+
+// SetProbeOverride replaces the displayed name, location or tags of a probe.
+// The override is kept for the identity and applied on every reconnect;
+// an empty override restores the values reported by the probe.
+func (h *Hub) SetProbeOverride(probeID string, override model.ProbeOverride) error {
+	h.probesMux.Lock()
+	defer h.probesMux.Unlock()
+
+	probe, ok := h.probes[probeID]
+	if !ok {
+		return ErrProbeNotFound
+	}
+	identity := probe.Info.Identity
+	if override == (model.ProbeOverride{}) {
+		delete(h.overrides, identity)
+	} else {
+		h.overrides[identity] = override
+	}
+	h.saveAdminState()
+
+	for _, p := range h.probes {
+		if p.Info.Identity == identity {
+			applyOverride(p, override)
+		}
+	}
+	h.broadcastProbeList()
+	return nil
+}
+
+// applyOverride sets the displayed fields from the reported values and override
+func applyOverride(probe *ProbeConnection, override model.ProbeOverride) {
+	probe.Info.Name = probe.Reported.Name
+	probe.Info.Location = probe.Reported.Location
+	probe.Info.Tags = probe.Reported.Tags
+
+	if override.Name != nil {
+		probe.Info.Name = *override.Name
+	}
+	if override.Location != nil {
+		probe.Info.Location = *override.Location
+	}
+	if override.Tags != nil {
+		probe.Info.Tags = *override.Tags
+	}
+}
@@ -0,0 +1,114 @@
+package hub
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// newTestConn returns the client end of a WebSocket to a server that
+// holds the connection open, so operator actions can close it
+func newTestConn(t *testing.T) *websocket.Conn {
+	t.Helper()
+	var upgrader websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// registerAs registers a probe reporting name under identity
+func registerAs(t *testing.T, h *Hub, name, identity string) (*ProbeConnection, error) {
+	t.Helper()
+	return h.RegisterProbe(newTestConn(t), model.RegisterPayload{Name: name, ProtocolVersion: protocol.Version}, identity)
+}
+
+func TestDisableFollowsIdentity(t *testing.T) {
+	h := newTestHub()
+	probe, err := registerAs(t, h, "p1", "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.DisableProbe(probe.ID); err != nil {
+		t.Fatal(err)
+	}
+	h.UnregisterProbe(probe)
+
+	if _, err := registerAs(t, h, "p1", "p1"); !errors.Is(err, ErrProbeDisabled) {
+		t.Errorf("disabled identity registered again: %v", err)
+	}
+	// A probe merely claiming the name is someone else
+	if _, err := registerAs(t, h, "p1", "unverified:p1"); err != nil {
+		t.Errorf("unverified probe with the same name rejected: %v", err)
+	}
+
+	// Disabling the unverified probe leaves the verified one alone
+	impostor, err := registerAs(t, h, "p2", "unverified:p2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.DisableProbe(impostor.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := registerAs(t, h, "p2", "p2"); err != nil {
+		t.Errorf("verified probe rejected after an unverified one with its name was disabled: %v", err)
+	}
+}
+
+func TestDrainFollowsIdentity(t *testing.T) {
+	h := newTestHub()
+	probe, err := registerAs(t, h, "p1", "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetProbeDraining(probe.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if probe.Info.Status != model.ProbeStatusDraining {
+		t.Fatalf("status = %s, want draining", probe.Info.Status)
+	}
+	h.UnregisterProbe(probe)
+
+	impostor, err := registerAs(t, h, "p1", "unverified:p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if impostor.Info.Status != model.ProbeStatusOnline {
+		t.Errorf("unverified probe with the same name: status %s, want online", impostor.Info.Status)
+	}
+
+	reconnected, err := registerAs(t, h, "p1", "p1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reconnected.Info.Status != model.ProbeStatusDraining {
+		t.Errorf("reconnected probe: status %s, want draining", reconnected.Info.Status)
+	}
+	if err := h.SetProbeDraining(reconnected.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if reconnected.Info.Status != model.ProbeStatusOnline {
+		t.Errorf("undrained probe: status %s, want online", reconnected.Info.Status)
+	}
+}
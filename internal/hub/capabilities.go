@@ -0,0 +1,109 @@
+package hub
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// checkCompatible reports why a probe cannot run the requested task, or nil
+// if it can. Probes that did not advertise capabilities (a nil task type
+// list, as opposed to an empty one) are assumed to support everything,
+// matching the behaviour before capabilities existed.
+func checkCompatible(caps model.ProbeCapabilities, payload model.TaskCreatePayload) error {
+	if caps.TaskTypes == nil {
+		return nil
+	}
+
+	supported := false
+	for _, taskType := range caps.TaskTypes {
+		if taskType == payload.Type {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		return fmt.Errorf("probe does not support %s", payload.Type)
+	}
+	if err := checkArguments(caps, payload); err != nil {
+		return err
+	}
+
+	// Hostnames are resolved on the probe, so only literal addresses can be checked
+	if addr, err := netip.ParseAddr(payload.Target); err == nil {
+		if addr.Unmap().Is4() && !caps.IPv4 {
+			return fmt.Errorf("probe has no IPv4 connectivity")
+		}
+		if !addr.Unmap().Is4() && !caps.IPv6 {
+			return fmt.Errorf("probe has no IPv6 connectivity")
+		}
+	}
+	return nil
+}
+
+// findCommand returns the custom command a probe defines for a task type
+func findCommand(caps model.ProbeCapabilities, taskType string) (model.CommandInfo, bool) {
+	for _, cmd := range caps.Commands {
+		if cmd.Name == taskType {
+			return cmd, true
+		}
+	}
+	return model.CommandInfo{}, false
+}
+
+// checkArguments reports a missing target or parameter, or one the task
+// type does not take. Parameter values are checked by the probe.
+func checkArguments(caps model.ProbeCapabilities, payload model.TaskCreatePayload) error {
+	cmd, ok := findCommand(caps, payload.Type)
+	if !ok {
+		if payload.Target == "" {
+			return fmt.Errorf("%s requires a target", payload.Type)
+		}
+		if len(payload.Params) > 0 {
+			return fmt.Errorf("%s takes no parameters", payload.Type)
+		}
+		return nil
+	}
+
+	switch {
+	case cmd.Target && payload.Target == "":
+		return fmt.Errorf("%s requires a target", payload.Type)
+	case !cmd.Target && payload.Target != "":
+		return fmt.Errorf("%s takes no target", payload.Type)
+	case payload.Options != "":
+		return fmt.Errorf("%s takes no options, only parameters", payload.Type)
+	}
+	for _, param := range cmd.Params {
+		if !param.Optional && payload.Params[param.Name] == "" {
+			return fmt.Errorf("%s requires parameter %s", payload.Type, param.Name)
+		}
+	}
+	for name := range payload.Params {
+		if !slices.ContainsFunc(cmd.Params, func(p model.CommandParam) bool { return p.Name == name }) {
+			return fmt.Errorf("%s has no parameter %s", payload.Type, name)
+		}
+	}
+	return nil
+}
+
+// NeedsTarget reports whether tasks of a type need a target. Only custom
+// commands that a connected probe defines without one do not.
+func (h *Hub) NeedsTarget(taskType string) bool {
+	h.probesMux.RLock()
+	defer h.probesMux.RUnlock()
+	for _, probe := range h.probes {
+		if cmd, ok := findCommand(probe.Info.Capabilities, taskType); ok && !cmd.Target {
+			return false
+		}
+	}
+	return true
+}
+
+// overloaded reports whether a probe already has every task slot and queue
+// entry it advertised in use, so another task would only be rejected
+func overloaded(info model.ProbeInfo) bool {
+	caps := info.Capabilities
+	return caps.MaxConcurrency > 0 && info.ActiveTasks >= caps.MaxConcurrency+caps.QueueSize
+}
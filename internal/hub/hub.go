@@ -1,102 +1,231 @@
 package hub
 
 import (
-	"encoding/json"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/bingxin666/dn42-globalping/internal/config"
 	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+	"github.com/bingxin666/dn42-globalping/internal/store"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 // ProbeConnection represents a connected probe
 type ProbeConnection struct {
-	ID     string
-	Info   model.ProbeInfo
-	Conn   *websocket.Conn
-	SendCh chan []byte
+	ID          string
+	Info        model.ProbeInfo
+	Reported    model.RegisterPayload // as sent by the probe, before overrides
+	ConnectedAt time.Time
+	Conn        *websocket.Conn
+	Queue       *SendQueue
+	ResumeToken string // proves a reconnecting probe owns this connection, empty without resume
+
+	slow atomic.Bool // disconnected for not keeping up
+}
+
+// disconnect closes the probe's WebSocket. That ends HandleProbeWS, which
+// unregisters the probe, so callers need not do so themselves.
+func (p *ProbeConnection) disconnect() error {
+	return p.Conn.Close()
 }
 
 // ClientConnection represents a connected web client
 type ClientConnection struct {
-	ID     string
-	Conn   *websocket.Conn
-	SendCh chan []byte
+	ID       string
+	Conn     *websocket.Conn
+	Queue    *SendQueue
+	Features []string // protocol features the client asked for
+
+	slow atomic.Bool // disconnected for not keeping up
 }
 
 // Hub manages all probe and client connections
 type Hub struct {
-	probes        map[string]*ProbeConnection
-	clients       map[string]*ClientConnection
-	taskToClient  map[string]string // taskID -> clientID
-	taskToProbes  map[string][]string // taskID -> []probeID
-	probesMux     sync.RWMutex
-	clientsMux    sync.RWMutex
-	taskMux       sync.RWMutex
+	probes       map[string]*ProbeConnection
+	clients      map[string]*ClientConnection
+	taskToClient map[string]string          // taskID -> clientID
+	taskToProbes map[string][]string        // taskID -> []probeID
+	streams      map[streamKey]*streamState // numbering of each task's output per probe
+	probesMux    sync.RWMutex
+	clientsMux   sync.RWMutex
+	taskMux      sync.RWMutex
+
+	// Presence history keyed by probe identity, guarded by probesMux
+	known map[string]*knownProbe
+
+	// Probes that disconnected and may still resume, by probe ID; guarded
+	// by probesMux
+	detached map[string]detachedProbe
+
+	// Operator decisions keyed by probe identity, guarded by probesMux
+	disabled  map[string]bool
+	draining  map[string]bool
+	overrides map[string]model.ProbeOverride
+	statePath string // where disabled/draining/overrides are persisted, empty for memory only
+
+	sendQueueSize      int              // buffered outgoing messages per connection
+	slowTimeout        time.Duration    // how long a send queue may stay full
+	minProbeVersion    string           // oldest probe software accepted, empty for any
+	minProtocolVersion int              // oldest probe protocol accepted
+	taskLimits         model.TaskLimits // ceiling on every task, sent to probes
+
+	store store.Store // measurements, kept after their streams end
+	drops dropCounters
+
+	shuttingDown atomic.Bool
 }
 
-// NewHub creates a new Hub
-func NewHub() *Hub {
+// NewHub creates a new Hub recording measurements in st
+func NewHub(cfg *config.Config, st store.Store) *Hub {
 	return &Hub{
 		probes:       make(map[string]*ProbeConnection),
 		clients:      make(map[string]*ClientConnection),
 		taskToClient: make(map[string]string),
 		taskToProbes: make(map[string][]string),
+		streams:      make(map[streamKey]*streamState),
+		known:        make(map[string]*knownProbe),
+		detached:     make(map[string]detachedProbe),
+		disabled:     make(map[string]bool),
+		draining:     make(map[string]bool),
+		overrides:    make(map[string]model.ProbeOverride),
+
+		sendQueueSize:      cfg.WebSocket.SendQueueSize,
+		slowTimeout:        cfg.WebSocket.SlowConsumerTimeout,
+		minProbeVersion:    cfg.Probes.MinProbeVersion,
+		minProtocolVersion: cfg.Probes.MinProtocolVersion,
+		taskLimits: model.TaskLimits{
+			Timeout:  int(cfg.Tasks.Timeout / time.Second),
+			MaxLines: cfg.Tasks.MaxLines,
+			MaxBytes: cfg.Tasks.MaxBytes,
+		},
+		store: st,
 	}
 }
 
-// RegisterProbe registers a new probe connection
-func (h *Hub) RegisterProbe(conn *websocket.Conn, payload model.RegisterPayload) *ProbeConnection {
+// RegisterProbe registers a new probe connection under the identity it
+// authenticated as and negotiates the protocol features used with it. A
+// probe resuming its previous connection keeps its probe ID. It fails with
+// ErrProbeDisabled if an operator has disabled the identity, and with
+// ErrProbeOutdated if the probe is too old.
+func (h *Hub) RegisterProbe(conn *websocket.Conn, payload model.RegisterPayload, identity string) (*ProbeConnection, error) {
 	h.probesMux.Lock()
 	defer h.probesMux.Unlock()
 
+	if h.disabled[identity] {
+		log.Printf("Rejected disabled probe: %s", identity)
+		return nil, ErrProbeDisabled
+	}
+	if err := h.checkProbeVersion(payload); err != nil {
+		log.Printf("Rejected probe %s: %v", payload.Name, err)
+		return nil, err
+	}
+	version := protocol.PeerVersion(payload.ProtocolVersion)
+	features := protocol.Negotiate(payload.Features)
+
 	probeID := uuid.New().String()
+	activeTasks := 0
+	resumeToken := ""
+	if protocol.HasFeature(features, protocol.FeatureResume) {
+		if payload.ResumeID != "" {
+			if id, active, ok := h.resumeProbe(payload, identity); ok {
+				probeID, activeTasks = id, active
+			}
+		}
+		resumeToken = newResumeToken()
+	}
 	probe := &ProbeConnection{
 		ID: probeID,
 		Info: model.ProbeInfo{
 			ID:        probeID,
+			Identity:  identity,
 			Name:      payload.Name,
 			Location:  payload.Location,
 			Latitude:  payload.Latitude,
 			Longitude: payload.Longitude,
-			Status:    "online",
+			Status:    model.ProbeStatusOnline,
 			LastSeen:  time.Now(),
+
+			ASN:     payload.ASN,
+			Country: strings.ToUpper(payload.Country),
+			Region:  strings.ToLower(payload.Region),
+			Tags:    payload.Tags,
+
+			Addresses:    payload.Addresses,
+			Capabilities: payload.Capabilities,
+			ActiveTasks:  activeTasks,
+
+			ProtocolVersion: version,
+			Features:        features,
+			Outdated:        version < protocol.Version,
 		},
-		Conn:   conn,
-		SendCh: make(chan []byte, 256),
+		Reported:    payload,
+		ConnectedAt: time.Now(),
+		Conn:        conn,
+		Queue:       newSendQueue(h.sendQueueSize, h.slowTimeout),
+		ResumeToken: resumeToken,
+	}
+	if h.draining[identity] {
+		probe.Info.Status = model.ProbeStatusDraining
 	}
+	applyOverride(probe, h.overrides[identity])
 	h.probes[probeID] = probe
+	h.markOnline(probe.Info)
 
-	log.Printf("Probe registered: %s (%s)", payload.Name, probeID)
+	log.Printf("Probe registered: %s (%s), protocol %d, version %s", payload.Name, probeID,
+		version, payload.Capabilities.Version)
 	h.broadcastProbeList()
-	return probe
+	return probe, nil
 }
 
-// UnregisterProbe removes a probe connection
-func (h *Hub) UnregisterProbe(probeID string) {
+// UnregisterProbe removes a probe connection, unless a resumed connection
+// has already taken its place. A probe with the resume feature may still
+// resume until the reaper gives up on it; the tasks of any other probe
+// end with an error right away.
+func (h *Hub) UnregisterProbe(probe *ProbeConnection) {
 	h.probesMux.Lock()
-	defer h.probesMux.Unlock()
+	if h.probes[probe.ID] != probe {
+		h.probesMux.Unlock()
+		return
+	}
+	probe.Queue.close()
+	delete(h.probes, probe.ID)
+	h.markOffline(probe.Info)
+	resumable := probe.ResumeToken != ""
+	if resumable {
+		h.detached[probe.ID] = detachedProbe{
+			identity:    probe.Info.Identity,
+			resumeToken: probe.ResumeToken,
+			activeTasks: probe.Info.ActiveTasks,
+			since:       time.Now(),
+		}
+	} else {
+		h.clearActiveTasks(probe.Info.Identity, probe.ID)
+	}
+	log.Printf("Probe unregistered: %s", probe.ID)
+	h.broadcastProbeList()
+	h.probesMux.Unlock()
 
-	if probe, ok := h.probes[probeID]; ok {
-		close(probe.SendCh)
-		delete(h.probes, probeID)
-		log.Printf("Probe unregistered: %s", probeID)
-		h.broadcastProbeList()
+	if !resumable {
+		h.abandonTasks(probe.ID)
 	}
 }
 
 // RegisterClient registers a new web client connection
-func (h *Hub) RegisterClient(conn *websocket.Conn) *ClientConnection {
+func (h *Hub) RegisterClient(conn *websocket.Conn, features []string) *ClientConnection {
 	h.clientsMux.Lock()
 	defer h.clientsMux.Unlock()
 
 	clientID := uuid.New().String()
 	client := &ClientConnection{
-		ID:     clientID,
-		Conn:   conn,
-		SendCh: make(chan []byte, 256),
+		ID:       clientID,
+		Conn:     conn,
+		Queue:    newSendQueue(h.sendQueueSize, h.slowTimeout),
+		Features: protocol.Negotiate(features),
 	}
 	h.clients[clientID] = client
 
@@ -110,88 +239,255 @@ func (h *Hub) UnregisterClient(clientID string) {
 	defer h.clientsMux.Unlock()
 
 	if client, ok := h.clients[clientID]; ok {
-		close(client.SendCh)
+		client.Queue.close()
 		delete(h.clients, clientID)
 		log.Printf("Client disconnected: %s", clientID)
 	}
 }
 
-// GetProbeList returns list of all online probes
+// GetProbeList returns list of all known probes, including offline ones
 func (h *Hub) GetProbeList() []model.ProbeInfo {
 	h.probesMux.RLock()
 	defer h.probesMux.RUnlock()
+	return h.probeListLocked()
+}
 
-	probes := make([]model.ProbeInfo, 0, len(h.probes))
+// probeListLocked returns connected probes followed by identities that are
+// currently offline, with uptime filled in; callers hold probesMux
+func (h *Hub) probeListLocked() []model.ProbeInfo {
+	now := time.Now()
+	probes := make([]model.ProbeInfo, 0, len(h.known))
 	for _, p := range h.probes {
-		probes = append(probes, p.Info)
+		info := p.Info
+		if k, ok := h.known[info.Identity]; ok {
+			info.Uptime = k.uptime(now)
+		}
+		probes = append(probes, info)
+	}
+	for _, k := range h.known {
+		if k.connections == 0 {
+			info := k.last
+			info.Uptime = k.uptime(now)
+			probes = append(probes, info)
+		}
 	}
 	return probes
 }
 
-// broadcastProbeList sends updated probe list to all clients
+// broadcastProbeList sends updated probe list to all clients; callers hold probesMux
 func (h *Hub) broadcastProbeList() {
-	probes := make([]model.ProbeInfo, 0, len(h.probes))
-	for _, p := range h.probes {
-		probes = append(probes, p.Info)
-	}
+	probes := h.probeListLocked()
 
 	msg := model.Message{
 		Type:    model.MsgTypeProbeList,
 		Payload: model.ProbeListPayload{Probes: probes},
 	}
-	data, _ := json.Marshal(msg)
+	data, err := protocol.ServerToClient.Encode(msg)
+	if err != nil {
+		log.Printf("Failed to encode probe list: %v", err)
+		return
+	}
 
 	h.clientsMux.RLock()
 	defer h.clientsMux.RUnlock()
 
 	for _, client := range h.clients {
-		select {
-		case client.SendCh <- data:
-		default:
-			log.Printf("Client %s send channel full", client.ID)
-		}
+		h.queueToClient(client, data, latestOnly, string(model.MsgTypeProbeList))
 	}
 }
 
-// CreateTask creates a new task and dispatches to probes
+// CreateTask creates a new task and dispatches to probes. The client first
+// gets a task_created message listing every selected probe; probes that are
+// not connected or cannot run the task get an immediate per-probe error.
+// An empty clientID creates a task whose results are only stored. No task
+// is created if no probe matches; the client gets an error and the
+// returned ID is empty.
 func (h *Hub) CreateTask(clientID string, payload model.TaskCreatePayload) string {
 	taskID := uuid.New().String()
+	payload.Limits = h.effectiveLimits(payload.Limits)
+
+	// Probes without the task_limits feature would reject the limits
+	task := model.TaskPayload{
+		TaskID:  taskID,
+		Type:    payload.Type,
+		Target:  payload.Target,
+		Options: payload.Options,
+		Params:  payload.Params,
+	}
+	legacyData, err := protocol.ServerToProbe.Encode(model.Message{Type: model.MsgTypeTask, Payload: task})
+	if err != nil {
+		log.Printf("Failed to encode task: %v", err)
+		return ""
+	}
+	task.Limits = payload.Limits
+	data, err := protocol.ServerToProbe.Encode(model.Message{Type: model.MsgTypeTask, Payload: task})
+	if err != nil {
+		log.Printf("Failed to encode task: %v", err)
+		return ""
+	}
+
+	probeIDs := h.ResolveProbes(payload)
+	if len(probeIDs) == 0 {
+		h.SendToClient(clientID, model.Message{
+			Type:    model.MsgTypeError,
+			Payload: model.ErrorPayload{Message: "No probes matched the selection"},
+		})
+		return ""
+	}
+
+	h.recordMeasurement(taskID, payload, probeIDs)
 
+	// Register the task before dispatching so early results find their client
 	h.taskMux.Lock()
 	h.taskToClient[taskID] = clientID
-	h.taskToProbes[taskID] = payload.ProbeIDs
 	h.taskMux.Unlock()
 
+	h.SendToClient(clientID, model.Message{
+		Type:    model.MsgTypeTaskCreated,
+		Payload: model.TaskCreatedPayload{TaskID: taskID, ProbeIDs: probeIDs},
+	})
+
 	// Send task to selected probes
-	h.probesMux.RLock()
-	defer h.probesMux.RUnlock()
+	var dispatched []string
+	var rejected []model.TaskStreamPayload
 
-	for _, probeID := range payload.ProbeIDs {
-		if probe, ok := h.probes[probeID]; ok {
-			taskMsg := model.Message{
-				Type: model.MsgTypeTask,
-				Payload: model.TaskPayload{
-					TaskID:  taskID,
-					Type:    payload.Type,
-					Target:  payload.Target,
-					Options: payload.Options,
-				},
-			}
-			data, _ := json.Marshal(taskMsg)
-			select {
-			case probe.SendCh <- data:
-				log.Printf("Task %s sent to probe %s", taskID, probeID)
-			default:
-				log.Printf("Probe %s send channel full", probeID)
-			}
+	h.probesMux.Lock()
+	for _, probeID := range probeIDs {
+		probe, ok := h.probes[probeID]
+		if !ok {
+			rejected = append(rejected, model.TaskStreamPayload{
+				TaskID:  taskID,
+				ProbeID: probeID,
+				IsEnd:   true,
+				Error:   "probe is not connected",
+			})
+			continue
+		}
+		if err := checkCompatible(probe.Info.Capabilities, payload); err != nil {
+			log.Printf("Task %s skipped on probe %s: %v", taskID, probeID, err)
+			rejected = append(rejected, model.TaskStreamPayload{
+				TaskID:    taskID,
+				ProbeID:   probeID,
+				ProbeName: probe.Info.Name,
+				IsEnd:     true,
+				Error:     err.Error(),
+			})
+			continue
+		}
+		if probe.Info.Status == model.ProbeStatusDraining {
+			rejected = append(rejected, model.TaskStreamPayload{
+				TaskID:    taskID,
+				ProbeID:   probeID,
+				ProbeName: probe.Info.Name,
+				IsEnd:     true,
+				Error:     "probe is draining and accepts no new tasks",
+			})
+			continue
 		}
+		if overloaded(probe.Info) {
+			log.Printf("Task %s skipped on overloaded probe %s", taskID, probeID)
+			rejected = append(rejected, model.TaskStreamPayload{
+				TaskID:    taskID,
+				ProbeID:   probeID,
+				ProbeName: probe.Info.Name,
+				IsEnd:     true,
+				Error:     "probe is busy, try again later",
+			})
+			continue
+		}
+
+		taskData := legacyData
+		if protocol.HasFeature(probe.Info.Features, protocol.FeatureTaskLimits) {
+			taskData = data
+		}
+		if !h.queueToProbe(probe, taskData, guaranteed, "") {
+			rejected = append(rejected, model.TaskStreamPayload{
+				TaskID:    taskID,
+				ProbeID:   probeID,
+				ProbeName: probe.Info.Name,
+				IsEnd:     true,
+				Error:     "probe is not responding, try again later",
+			})
+			continue
+		}
+		dispatched = append(dispatched, probeID)
+		probe.Info.ActiveTasks++
+		log.Printf("Task %s sent to probe %s", taskID, probeID)
+	}
+	h.probesMux.Unlock()
+
+	h.taskMux.Lock()
+	h.taskToProbes[taskID] = dispatched
+	h.taskMux.Unlock()
+
+	for _, stream := range rejected {
+		h.store.Finish(taskID, stream.ProbeID, stream.Error, nil)
+		h.SendToClient(clientID, model.Message{
+			Type:    model.MsgTypeTaskStream,
+			Payload: stream,
+		})
 	}
 
 	return taskID
 }
 
-// ForwardTaskResult forwards task result from probe to client
+// recordMeasurement stores a new measurement with a pending result per probe
+func (h *Hub) recordMeasurement(taskID string, payload model.TaskCreatePayload, probeIDs []string) {
+	results := make([]model.MeasurementResult, 0, len(probeIDs))
+	h.probesMux.RLock()
+	for _, probeID := range probeIDs {
+		result := model.MeasurementResult{ProbeID: probeID, Status: model.MeasurementInProgress}
+		if probe, ok := h.probes[probeID]; ok {
+			result.ProbeName = probe.Info.Name
+		}
+		results = append(results, result)
+	}
+	h.probesMux.RUnlock()
+
+	h.store.Create(model.Measurement{
+		ID:        taskID,
+		Type:      payload.Type,
+		Target:    payload.Target,
+		Options:   payload.Options,
+		Params:    payload.Params,
+		Limits:    payload.Limits,
+		CreatedAt: time.Now(),
+		Results:   results,
+	})
+}
+
+// Measurement returns a stored measurement by task ID
+func (h *Hub) Measurement(id string) (model.Measurement, bool) {
+	return h.store.Get(id)
+}
+
+// ForwardTaskResult forwards task result from probe to client. Numbered
+// results are acknowledged, and those that arrived before are ignored.
 func (h *Hub) ForwardTaskResult(result model.TaskResultPayload) {
+	if result.Seq > 0 {
+		defer h.ackResult(result)
+	}
+	if !h.acceptResult(result) {
+		return
+	}
+
+	// Get probe name and release the probe's task slot once it finishes
+	h.probesMux.Lock()
+	probeName := ""
+	if probe, ok := h.probes[result.ProbeID]; ok {
+		probeName = probe.Info.Name
+		if result.IsEnd && probe.Info.ActiveTasks > 0 {
+			probe.Info.ActiveTasks--
+		}
+	}
+	h.probesMux.Unlock()
+
+	lines := h.outputLines(result)
+	h.store.Append(result.TaskID, result.ProbeID, lines...)
+	if result.IsEnd {
+		h.store.Finish(result.TaskID, result.ProbeID, result.Error, result.Data)
+	}
+
 	h.taskMux.RLock()
 	clientID, ok := h.taskToClient[result.TaskID]
 	h.taskMux.RUnlock()
@@ -201,47 +497,92 @@ func (h *Hub) ForwardTaskResult(result model.TaskResultPayload) {
 		return
 	}
 
-	// Get client's send channel while holding the lock
 	h.clientsMux.RLock()
 	client, clientOk := h.clients[clientID]
-	var sendCh chan []byte
-	if clientOk {
-		sendCh = client.SendCh
-	}
 	h.clientsMux.RUnlock()
 
-	if !clientOk || sendCh == nil {
+	if !clientOk {
 		return
 	}
 
-	// Get probe name
-	h.probesMux.RLock()
-	probeName := ""
-	if probe, ok := h.probes[result.ProbeID]; ok {
-		probeName = probe.Info.Name
+	// Batching clients get everything in one message; others get a message
+	// per line, then one marking the end. Lines dropped while the client's
+	// queue was full are reported as soon as it has room again.
+	key := streamKey{taskID: result.TaskID, probeID: result.ProbeID}
+	var streams []model.TaskStreamPayload
+	if !result.IsEnd {
+		if n := client.Queue.takeDropped(key, false); n > 0 {
+			streams = append(streams, model.TaskStreamPayload{Dropped: n})
+		}
 	}
-	h.probesMux.RUnlock()
+	switch {
+	case protocol.HasFeature(client.Features, protocol.FeatureLineInfo):
+		streams = append(streams, model.TaskStreamPayload{Output: lines, IsEnd: result.IsEnd, Error: result.Error})
+	case protocol.HasFeature(client.Features, protocol.FeatureBatch):
+		streams = append(streams, model.TaskStreamPayload{Lines: lineTexts(lines), IsEnd: result.IsEnd, Error: result.Error})
+	default:
+		for _, line := range lines {
+			streams = append(streams, model.TaskStreamPayload{Line: line.Text})
+		}
+		if result.IsEnd {
+			streams = append(streams, model.TaskStreamPayload{IsEnd: true, Error: result.Error})
+		}
+	}
+
+	for _, stream := range streams {
+		stream.TaskID = result.TaskID
+		stream.ProbeID = result.ProbeID
+		stream.ProbeName = probeName
+		d := bestEffort
+		if stream.IsEnd {
+			stream.Dropped = client.Queue.takeDropped(key, true)
+			if protocol.HasFeature(client.Features, protocol.FeatureResultData) {
+				stream.Data = result.Data
+			}
+			d = guaranteed
+		} else if stream.Dropped > 0 {
+			d = guaranteed
+		}
+		data, err := protocol.ServerToClient.Encode(model.Message{
+			Type:    model.MsgTypeTaskStream,
+			Payload: stream,
+		})
+		if err != nil {
+			log.Printf("Failed to encode task stream: %v", err)
+			return
+		}
 
-	streamPayload := model.TaskStreamPayload{
-		TaskID:    result.TaskID,
-		ProbeID:   result.ProbeID,
-		ProbeName: probeName,
-		Line:      result.Line,
-		IsEnd:     result.IsEnd,
-		Error:     result.Error,
+		switch h.queueToClient(client, data, d, "") {
+		case pushDropped:
+			n := max(len(stream.Output)+len(stream.Lines), 1)
+			client.Queue.noteDropped(key, n)
+			h.drops.lines.Add(int64(n))
+		case pushOverflow, pushClosed:
+			return
+		}
 	}
+}
 
-	msg := model.Message{
-		Type:    model.MsgTypeTaskStream,
-		Payload: streamPayload,
+// ForwardTaskStatus forwards a probe's queue/running status to the task's client
+func (h *Hub) ForwardTaskStatus(status model.TaskStatusPayload) {
+	h.taskMux.RLock()
+	clientID, ok := h.taskToClient[status.TaskID]
+	h.taskMux.RUnlock()
+
+	if !ok {
+		return
 	}
-	data, _ := json.Marshal(msg)
 
-	select {
-	case sendCh <- data:
-	default:
-		log.Printf("Client %s send channel full", clientID)
+	h.probesMux.RLock()
+	if probe, ok := h.probes[status.ProbeID]; ok {
+		status.ProbeName = probe.Info.Name
 	}
+	h.probesMux.RUnlock()
+
+	h.SendToClient(clientID, model.Message{
+		Type:    model.MsgTypeTaskStatus,
+		Payload: status,
+	})
 }
 
 // UpdateProbeHeartbeat updates probe's last seen time
@@ -254,6 +595,18 @@ func (h *Hub) UpdateProbeHeartbeat(probeID string) {
 	}
 }
 
+// UpdateProbeRTT records the control channel round-trip time measured by a
+// ping/pong exchange; a pong also proves the probe is alive
+func (h *Hub) UpdateProbeRTT(probeID string, rtt time.Duration) {
+	h.probesMux.Lock()
+	defer h.probesMux.Unlock()
+
+	if probe, ok := h.probes[probeID]; ok {
+		probe.Info.ControlRTT = float64(rtt.Microseconds()) / 1000
+		probe.Info.LastSeen = time.Now()
+	}
+}
+
 // SendToClient sends a message to a specific client
 func (h *Hub) SendToClient(clientID string, msg model.Message) {
 	h.clientsMux.RLock()
@@ -264,22 +617,27 @@ func (h *Hub) SendToClient(clientID string, msg model.Message) {
 		return
 	}
 
-	data, _ := json.Marshal(msg)
-	select {
-	case client.SendCh <- data:
-	default:
-		log.Printf("Client %s send channel full", clientID)
+	data, err := protocol.ServerToClient.Encode(msg)
+	if err != nil {
+		log.Printf("Failed to encode message for client %s: %v", clientID, err)
+		return
+	}
+	// Status and quota updates are superseded by the next one anyway
+	d := guaranteed
+	switch msg.Type {
+	case model.MsgTypeTaskStatus, model.MsgTypeQuota:
+		d = bestEffort
+	case model.MsgTypeProbeList:
+		d = latestOnly
+	}
+	if h.queueToClient(client, data, d, string(msg.Type)) == pushDropped {
+		h.drops.status.Add(1)
 	}
 }
 
 // SendProbeListToClient sends current probe list to a specific client
 func (h *Hub) SendProbeListToClient(clientID string) {
-	h.probesMux.RLock()
-	probes := make([]model.ProbeInfo, 0, len(h.probes))
-	for _, p := range h.probes {
-		probes = append(probes, p.Info)
-	}
-	h.probesMux.RUnlock()
+	probes := h.GetProbeList()
 
 	msg := model.Message{
 		Type:    model.MsgTypeProbeList,
@@ -0,0 +1,55 @@
+package hub
+
+import (
+	"fmt"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// CheckLimits reports why limits a client asked for are invalid: negative,
+// or above the server's ceiling. nil asks for none.
+func (h *Hub) CheckLimits(requested *model.TaskLimits) error {
+	if requested == nil {
+		return nil
+	}
+	for _, limit := range []struct {
+		name, unit     string
+		value, ceiling int
+	}{
+		{"timeout", "seconds", requested.Timeout, h.taskLimits.Timeout},
+		{"max_lines", "lines", requested.MaxLines, h.taskLimits.MaxLines},
+		{"max_bytes", "bytes", requested.MaxBytes, h.taskLimits.MaxBytes},
+	} {
+		if limit.value < 0 {
+			return fmt.Errorf("limits.%s must not be negative", limit.name)
+		}
+		if limit.ceiling > 0 && limit.value > limit.ceiling {
+			return fmt.Errorf("limits.%s must be at most %d %s", limit.name, limit.ceiling, limit.unit)
+		}
+	}
+	return nil
+}
+
+// effectiveLimits returns the limits sent to probes: for each, the lower of
+// what the client asked for and the server's ceiling, or nil if neither
+// sets any
+func (h *Hub) effectiveLimits(requested *model.TaskLimits) *model.TaskLimits {
+	limits := h.taskLimits
+	if requested != nil {
+		limits.Timeout = lowerLimit(limits.Timeout, requested.Timeout)
+		limits.MaxLines = lowerLimit(limits.MaxLines, requested.MaxLines)
+		limits.MaxBytes = lowerLimit(limits.MaxBytes, requested.MaxBytes)
+	}
+	if limits == (model.TaskLimits{}) {
+		return nil
+	}
+	return &limits
+}
+
+// lowerLimit returns the lower of two limits, where 0 means no limit
+func lowerLimit(a, b int) int {
+	if a == 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,61 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// streamState tracks the numbering of one task's output on one probe;
+// guarded by taskMux
+type streamState struct {
+	resultSeq uint64 // last result sequence number the probe sent
+	lineSeq   uint64 // last line sequence number the server assigned
+}
+
+// streamLocked returns the state of a stream, creating it if needed;
+// callers hold taskMux
+func (h *Hub) streamLocked(key streamKey) *streamState {
+	st, ok := h.streams[key]
+	if !ok {
+		st = &streamState{}
+		h.streams[key] = st
+	}
+	return st
+}
+
+// outputLines returns the output carried by a result. Probes with the
+// line_info feature number and time their lines themselves; lines from
+// other probes are numbered in arrival order and timed on receipt.
+func (h *Hub) outputLines(result model.TaskResultPayload) []model.OutputLine {
+	if len(result.Output) > 0 {
+		return result.Output
+	}
+	texts := result.Lines
+	if len(texts) == 0 && (!result.IsEnd || result.Line != "") {
+		texts = []string{result.Line}
+	}
+	if len(texts) == 0 {
+		return nil
+	}
+
+	h.taskMux.Lock()
+	st := h.streamLocked(streamKey{taskID: result.TaskID, probeID: result.ProbeID})
+	now := time.Now()
+	lines := make([]model.OutputLine, len(texts))
+	for i, text := range texts {
+		st.lineSeq++
+		lines[i] = model.OutputLine{Seq: st.lineSeq, Time: now, Stream: model.StreamStdout, Text: text}
+	}
+	h.taskMux.Unlock()
+	return lines
+}
+
+// lineTexts returns the text of every line, for clients without line_info
+func lineTexts(lines []model.OutputLine) []string {
+	texts := make([]string, len(lines))
+	for i, line := range lines {
+		texts[i] = line.Text
+	}
+	return texts
+}
@@ -0,0 +1,171 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+const (
+	historyRetention = 7 * 24 * time.Hour // how long offline probes and their history are kept
+	uptimeWindow     = 24 * time.Hour     // window the uptime percentage is computed over
+)
+
+// StatusEvent records a probe identity going online or offline
+type StatusEvent struct {
+	At     time.Time `json:"at"`
+	Online bool      `json:"online"`
+}
+
+// knownProbe tracks an identity across connections; guarded by probesMux
+type knownProbe struct {
+	last        model.ProbeInfo // snapshot taken when the identity went offline
+	connections int
+	history     []StatusEvent
+}
+
+// markOnline records a new connection for the probe's identity; callers hold probesMux
+func (h *Hub) markOnline(info model.ProbeInfo) {
+	k, ok := h.known[info.Identity]
+	if !ok {
+		k = &knownProbe{}
+		h.known[info.Identity] = k
+	}
+	k.connections++
+	if k.connections == 1 {
+		k.history = append(k.history, StatusEvent{At: time.Now(), Online: true})
+	}
+}
+
+// markOffline records a closed connection for the probe's identity; callers hold probesMux
+func (h *Hub) markOffline(info model.ProbeInfo) {
+	k, ok := h.known[info.Identity]
+	if !ok {
+		return
+	}
+	if k.connections > 0 {
+		k.connections--
+	}
+	if k.connections == 0 {
+		// ActiveTasks is kept: a resuming probe still runs those tasks
+		info.Status = model.ProbeStatusOffline
+		k.last = info
+		k.history = append(k.history, StatusEvent{At: time.Now(), Online: false})
+	}
+}
+
+// pruneKnown drops history older than the retention period, and identities
+// that have been offline for longer than that; callers hold probesMux
+func (h *Hub) pruneKnown(now time.Time) {
+	cutoff := now.Add(-historyRetention)
+	for identity, k := range h.known {
+		if k.connections == 0 && k.last.LastSeen.Before(cutoff) {
+			delete(h.known, identity)
+			continue
+		}
+		// Keep the newest event before the cutoff, it tells the state at the cutoff
+		i := 0
+		for i+1 < len(k.history) && k.history[i+1].At.Before(cutoff) {
+			i++
+		}
+		k.history = k.history[i:]
+	}
+}
+
+// uptime returns the percentage of the uptime window the identity was
+// online, counting only from when it was first seen
+func (k *knownProbe) uptime(now time.Time) float64 {
+	if len(k.history) == 0 {
+		return 0
+	}
+
+	start := now.Add(-uptimeWindow)
+	if first := k.history[0].At; first.After(start) {
+		start = first
+	}
+	total := now.Sub(start)
+	if total <= 0 {
+		return 100
+	}
+
+	var online time.Duration
+	for i, event := range k.history {
+		if !event.Online {
+			continue
+		}
+		from, to := event.At, now
+		if i+1 < len(k.history) {
+			to = k.history[i+1].At
+		}
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(from) {
+			online += to.Sub(from)
+		}
+	}
+	return float64(online) / float64(total) * 100
+}
+
+// ProbeHistory returns the status events and uptime percentage of an identity
+func (h *Hub) ProbeHistory(identity string) ([]StatusEvent, float64, bool) {
+	h.probesMux.RLock()
+	defer h.probesMux.RUnlock()
+
+	k, ok := h.known[identity]
+	if !ok {
+		return nil, 0, false
+	}
+	events := make([]StatusEvent, len(k.history))
+	copy(events, k.history)
+	return events, k.uptime(time.Now()), true
+}
+
+// RunReaper disconnects probes that have not sent a heartbeat within timeout,
+// which clears half-open connections that would otherwise linger forever,
+// and ends the tasks of probes that have not resumed within timeout.
+// It returns when ctx is cancelled.
+func (h *Hub) RunReaper(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.reap(now, timeout)
+		}
+	}
+}
+
+func (h *Hub) reap(now time.Time, timeout time.Duration) {
+	h.probesMux.Lock()
+	var stale []*ProbeConnection
+	for _, p := range h.probes {
+		if now.Sub(p.Info.LastSeen) > timeout && p.Info.Status != model.ProbeStatusOffline {
+			p.Info.Status = model.ProbeStatusOffline
+			stale = append(stale, p)
+		}
+	}
+	h.pruneKnown(now)
+	abandoned := h.expireDetached(now, timeout)
+	if len(stale) > 0 || len(abandoned) > 0 {
+		h.broadcastProbeList()
+	}
+	h.probesMux.Unlock()
+
+	for _, probeID := range abandoned {
+		log.Printf("Probe %s did not resume within %s, ending its tasks", probeID, timeout)
+		h.abandonTasks(probeID)
+	}
+	h.pruneTasks()
+
+	for _, p := range stale {
+		log.Printf("Probe %s (%s) missed heartbeats since %s, disconnecting",
+			p.Info.Name, p.ID, p.Info.LastSeen.Format(time.RFC3339))
+		p.disconnect()
+	}
+}
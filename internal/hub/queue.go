@@ -0,0 +1,182 @@
+package hub
+
+import (
+	"sync"
+	"time"
+)
+
+// delivery says what may happen to a message when its queue is full
+type delivery int
+
+const (
+	// bestEffort messages, such as output lines, are dropped while the queue is full
+	bestEffort delivery = iota
+	// latestOnly messages replace a queued message with the same key, e.g.
+	// probe lists or the acknowledgements of one task
+	latestOnly
+	// guaranteed messages, such as task dispatch and end-of-task markers, are never dropped
+	guaranteed
+)
+
+// pushResult tells the sender what happened to a message
+type pushResult int
+
+const (
+	pushQueued   pushResult = iota
+	pushReplaced            // took the place of a queued message with the same key
+	pushDropped             // best-effort message dropped because the queue is full
+	pushOverflow            // the peer cannot keep up and has to be disconnected
+	pushClosed              // the connection has gone away
+)
+
+type queuedMessage struct {
+	data []byte
+	key  string // set for latestOnly messages
+}
+
+// streamKey identifies the output of one task on one probe
+type streamKey struct {
+	taskID  string
+	probeID string
+}
+
+// SendQueue holds the messages waiting to be written to one WebSocket.
+// Best-effort messages are dropped once size messages are queued, while
+// guaranteed ones are accepted up to twice that. A peer is considered
+// hopelessly slow when even that is exceeded, or when its queue stays full
+// for longer than slowTimeout.
+type SendQueue struct {
+	mu          sync.Mutex
+	messages    []queuedMessage
+	size        int
+	slowTimeout time.Duration
+	fullSince   time.Time // zero while the queue has room
+	closed      bool
+	ready       chan struct{}
+
+	dropped map[streamKey]int // output lines dropped but not yet reported to the client
+}
+
+func newSendQueue(size int, slowTimeout time.Duration) *SendQueue {
+	return &SendQueue{
+		size:        size,
+		slowTimeout: slowTimeout,
+		ready:       make(chan struct{}, 1),
+		dropped:     make(map[streamKey]int),
+	}
+}
+
+// push queues a message according to its delivery class
+func (q *SendQueue) push(data []byte, d delivery, key string) pushResult {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return pushClosed
+	}
+	if len(q.messages) >= q.size {
+		if q.fullSince.IsZero() {
+			q.fullSince = time.Now()
+		} else if time.Since(q.fullSince) > q.slowTimeout {
+			return pushOverflow
+		}
+	}
+
+	switch d {
+	case bestEffort:
+		if len(q.messages) >= q.size {
+			return pushDropped
+		}
+	case latestOnly:
+		for i := range q.messages {
+			if q.messages[i].key == key {
+				q.messages[i].data = data
+				return pushReplaced
+			}
+		}
+	}
+	if len(q.messages) >= 2*q.size {
+		return pushOverflow
+	}
+
+	if d != latestOnly {
+		key = ""
+	}
+	q.messages = append(q.messages, queuedMessage{data: data, key: key})
+	q.signal()
+	return pushQueued
+}
+
+// Pop removes and returns the oldest queued message, if any
+func (q *SendQueue) Pop() ([]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) == 0 {
+		return nil, false
+	}
+	data := q.messages[0].data
+	q.messages[0] = queuedMessage{}
+	q.messages = q.messages[1:]
+	if len(q.messages) < q.size {
+		q.fullSince = time.Time{}
+	}
+	return data, true
+}
+
+// Ready is signalled whenever messages were queued or the queue was closed
+func (q *SendQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Closed reports whether the connection has gone away. Messages queued
+// before that may still be popped.
+func (q *SendQueue) Closed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// Len returns the number of queued messages
+func (q *SendQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// close rejects further messages and wakes the writer
+func (q *SendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.signal()
+}
+
+func (q *SendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// noteDropped remembers that n output lines of a stream were dropped
+func (q *SendQueue) noteDropped(key streamKey, n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dropped[key] += n
+}
+
+// takeDropped returns and forgets the number of lines dropped from a
+// stream. Unless final is set, it returns 0 while the queue is still full,
+// so the client is told only once it is able to receive the notice.
+func (q *SendQueue) takeDropped(key streamKey, final bool) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := q.dropped[key]
+	if n == 0 || (!final && len(q.messages) >= q.size) {
+		return 0
+	}
+	delete(q.dropped, key)
+	return n
+}
@@ -0,0 +1,180 @@
+package hub
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+)
+
+// detachedProbe is a probe with the resume feature that disconnected and
+// has not resumed yet
+type detachedProbe struct {
+	identity    string
+	resumeToken string
+	activeTasks int // tasks it was running, which it keeps running
+	since       time.Time
+}
+
+// newResumeToken returns a secret for a probe to resume its connection with
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// resumeProbe returns the probe ID a reconnecting probe asked to continue
+// with, and how many tasks it still had in flight, if the probe presents
+// the resume token issued with that ID under the same identity. Probe IDs
+// are public, the token is only known to the probe. A connection still
+// registered under the ID, such as one the server has not noticed dropping
+// yet, is taken over. Callers hold probesMux.
+func (h *Hub) resumeProbe(payload model.RegisterPayload, identity string) (string, int, bool) {
+	if old, ok := h.probes[payload.ResumeID]; ok {
+		if old.Info.Identity != identity || !tokensEqual(old.ResumeToken, payload.ResumeToken) {
+			return "", 0, false
+		}
+		log.Printf("Probe %s (%s) reconnected, closing its previous connection", payload.Name, old.ID)
+		old.Queue.close()
+		delete(h.probes, old.ID)
+		h.markOffline(old.Info)
+		old.disconnect()
+		return old.ID, old.Info.ActiveTasks, true
+	}
+	if d, ok := h.detached[payload.ResumeID]; ok {
+		if d.identity != identity || !tokensEqual(d.resumeToken, payload.ResumeToken) {
+			return "", 0, false
+		}
+		delete(h.detached, payload.ResumeID)
+		return payload.ResumeID, d.activeTasks, true
+	}
+	return "", 0, false
+}
+
+// tokensEqual compares resume tokens in constant time; an empty token
+// never matches
+func tokensEqual(want, got string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(want), []byte(got)) == 1
+}
+
+// expireDetached gives up on detached probes that have not resumed within
+// timeout and returns their IDs. Callers hold probesMux.
+func (h *Hub) expireDetached(now time.Time, timeout time.Duration) []string {
+	var expired []string
+	for id, d := range h.detached {
+		if now.Sub(d.since) <= timeout {
+			continue
+		}
+		delete(h.detached, id)
+		h.clearActiveTasks(d.identity, id)
+		expired = append(expired, id)
+	}
+	return expired
+}
+
+// clearActiveTasks zeroes the tasks in flight of an identity's offline
+// snapshot if it is still that of the given probe; callers hold probesMux
+func (h *Hub) clearActiveTasks(identity, probeID string) {
+	if k, ok := h.known[identity]; ok && k.connections == 0 && k.last.ID == probeID {
+		k.last.ActiveTasks = 0
+	}
+}
+
+// abandonTasks ends the tasks still in flight on a probe that is gone for
+// good, so stored measurements finish and clients get is_end for them
+func (h *Hub) abandonTasks(probeID string) {
+	var taskIDs []string
+	h.taskMux.RLock()
+	for taskID, probeIDs := range h.taskToProbes {
+		for _, id := range probeIDs {
+			if id == probeID {
+				taskIDs = append(taskIDs, taskID)
+				break
+			}
+		}
+	}
+	h.taskMux.RUnlock()
+
+	for _, taskID := range taskIDs {
+		m, ok := h.store.Get(taskID)
+		if !ok {
+			continue
+		}
+		for _, r := range m.Results {
+			if r.ProbeID == probeID && r.Status == model.MeasurementInProgress {
+				h.ForwardTaskResult(model.TaskResultPayload{
+					TaskID:  taskID,
+					ProbeID: probeID,
+					IsEnd:   true,
+					Error:   "probe disconnected",
+				})
+			}
+		}
+	}
+}
+
+// acceptResult records the sequence number of a result from a probe with
+// the resume feature, and reports whether the result is new. Results
+// replayed after a reconnect that arrived before are duplicates.
+func (h *Hub) acceptResult(result model.TaskResultPayload) bool {
+	if result.Seq == 0 {
+		return true
+	}
+	key := streamKey{taskID: result.TaskID, probeID: result.ProbeID}
+
+	h.taskMux.Lock()
+	defer h.taskMux.Unlock()
+	st := h.streamLocked(key)
+	if result.Seq <= st.resultSeq {
+		return false
+	}
+	st.resultSeq = result.Seq
+	return true
+}
+
+// ackResult tells the probe that every result of the task up to seq has
+// arrived. A queued acknowledgement of the same task is replaced, since a
+// newer one covers it.
+func (h *Hub) ackResult(result model.TaskResultPayload) {
+	data, err := protocol.ServerToProbe.Encode(model.Message{
+		Type:    model.MsgTypeTaskAck,
+		Payload: model.TaskAckPayload{TaskID: result.TaskID, Seq: result.Seq},
+	})
+	if err != nil {
+		log.Printf("Failed to encode task ack: %v", err)
+		return
+	}
+
+	h.probesMux.RLock()
+	defer h.probesMux.RUnlock()
+	if probe, ok := h.probes[result.ProbeID]; ok {
+		h.queueToProbe(probe, data, latestOnly, string(model.MsgTypeTaskAck)+":"+result.TaskID)
+	}
+}
+
+// pruneTasks forgets the clients, probes and output numbering of tasks
+// whose measurement is no longer stored
+func (h *Hub) pruneTasks() {
+	h.taskMux.Lock()
+	defer h.taskMux.Unlock()
+
+	for taskID := range h.taskToClient {
+		if _, ok := h.store.Get(taskID); ok {
+			continue
+		}
+		delete(h.taskToClient, taskID)
+		delete(h.taskToProbes, taskID)
+	}
+	for key := range h.streams {
+		if _, ok := h.taskToClient[key.taskID]; !ok {
+			delete(h.streams, key)
+		}
+	}
+}
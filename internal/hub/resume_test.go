@@ -0,0 +1,125 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/config"
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+	"github.com/bingxin666/dn42-globalping/internal/store"
+)
+
+func newTestHub() *Hub {
+	return NewHub(config.Default(), store.NewMemory(100))
+}
+
+func registerTestProbe(t *testing.T, h *Hub, name string, features []string, resumeID, resumeToken string) *ProbeConnection {
+	t.Helper()
+	probe, err := h.RegisterProbe(nil, model.RegisterPayload{
+		Name:            name,
+		ProtocolVersion: protocol.Version,
+		Features:        features,
+		ResumeID:        resumeID,
+		ResumeToken:     resumeToken,
+	}, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return probe
+}
+
+// startTask creates a task on the probe and returns its ID
+func startTask(t *testing.T, h *Hub, probe *ProbeConnection) string {
+	t.Helper()
+	taskID := h.CreateTask("", model.TaskCreatePayload{ProbeIDs: []string{probe.ID}, Type: "ping", Target: "172.20.0.53"})
+	if taskID == "" {
+		t.Fatal("task was not created")
+	}
+	return taskID
+}
+
+func resultStatus(t *testing.T, h *Hub, taskID string) string {
+	t.Helper()
+	m, ok := h.Measurement(taskID)
+	if !ok || len(m.Results) != 1 {
+		t.Fatalf("measurement = %+v", m)
+	}
+	return m.Results[0].Status
+}
+
+func TestResumeNeedsToken(t *testing.T) {
+	h := newTestHub()
+	features := []string{protocol.FeatureResume}
+	probe := registerTestProbe(t, h, "p1", features, "", "")
+	if probe.ResumeToken == "" {
+		t.Fatal("no resume token issued")
+	}
+	startTask(t, h, probe)
+	h.UnregisterProbe(probe)
+
+	if p := registerTestProbe(t, h, "p1", features, probe.ID, "guessed"); p.ID == probe.ID {
+		t.Fatal("resumed with a wrong token")
+	} else {
+		h.UnregisterProbe(p)
+	}
+	if p := registerTestProbe(t, h, "p2", features, probe.ID, probe.ResumeToken); p.ID == probe.ID {
+		t.Fatal("resumed under another name")
+	} else {
+		h.UnregisterProbe(p)
+	}
+
+	resumed := registerTestProbe(t, h, "p1", features, probe.ID, probe.ResumeToken)
+	if resumed.ID != probe.ID {
+		t.Fatalf("probe ID = %s, want %s", resumed.ID, probe.ID)
+	}
+	if resumed.Info.ActiveTasks != 1 {
+		t.Errorf("ActiveTasks = %d, want 1", resumed.Info.ActiveTasks)
+	}
+	if resumed.ResumeToken == probe.ResumeToken {
+		t.Error("resume token was not renewed")
+	}
+}
+
+func TestOfflineSnapshotKeepsActiveTasks(t *testing.T) {
+	h := newTestHub()
+	probe := registerTestProbe(t, h, "p1", []string{protocol.FeatureResume}, "", "")
+	startTask(t, h, probe)
+	h.UnregisterProbe(probe)
+
+	for _, info := range h.GetProbeList() {
+		if info.ID == probe.ID && info.ActiveTasks != 1 {
+			t.Errorf("offline ActiveTasks = %d, want 1", info.ActiveTasks)
+		}
+	}
+}
+
+func TestTasksEndWhenProbeDoesNotResume(t *testing.T) {
+	h := newTestHub()
+	probe := registerTestProbe(t, h, "p1", []string{protocol.FeatureResume}, "", "")
+	taskID := startTask(t, h, probe)
+	h.UnregisterProbe(probe)
+
+	h.reap(time.Now(), time.Minute)
+	if status := resultStatus(t, h, taskID); status != model.MeasurementInProgress {
+		t.Fatalf("status before the timeout = %s", status)
+	}
+	h.reap(time.Now().Add(2*time.Minute), time.Minute)
+	if status := resultStatus(t, h, taskID); status != model.MeasurementFailed {
+		t.Fatalf("status after the timeout = %s, want %s", status, model.MeasurementFailed)
+	}
+	if p := registerTestProbe(t, h, "p1", []string{protocol.FeatureResume}, probe.ID, probe.ResumeToken); p.ID == probe.ID {
+		t.Error("resumed after its tasks ended")
+	}
+}
+
+func TestTasksEndWithoutResume(t *testing.T) {
+	h := newTestHub()
+	probe := registerTestProbe(t, h, "p1", nil, "", "")
+	taskID := startTask(t, h, probe)
+	h.UnregisterProbe(probe)
+
+	if status := resultStatus(t, h, taskID); status != model.MeasurementFailed {
+		t.Fatalf("status = %s, want %s", status, model.MeasurementFailed)
+	}
+}
@@ -0,0 +1,154 @@
+package hub
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// Selection strategies for choosing among more matching probes than requested
+const (
+	StrategyRandom = "random"
+	StrategyLoad   = "load"
+)
+
+// ResolveProbes returns the concrete probe IDs a task should be dispatched to.
+// Explicit probe IDs are always kept so that missing probes can be reported;
+// selectors only match online probes that are able to run the task and are
+// not overloaded.
+func (h *Hub) ResolveProbes(payload model.TaskCreatePayload) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(payload.ProbeIDs))
+	for _, id := range payload.ProbeIDs {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	if len(payload.Selectors) == 0 {
+		return result
+	}
+
+	h.probesMux.RLock()
+	candidates := make([]model.ProbeInfo, 0, len(h.probes))
+	for _, p := range h.probes {
+		if p.Info.Status == model.ProbeStatusOnline &&
+			checkCompatible(p.Info.Capabilities, payload) == nil && !overloaded(p.Info) {
+			candidates = append(candidates, p.Info)
+		}
+	}
+	h.probesMux.RUnlock()
+
+	var matched []model.ProbeInfo
+	for _, selector := range payload.Selectors {
+		kind, value, _ := strings.Cut(strings.TrimSpace(selector), ":")
+		kind = strings.ToLower(kind)
+
+		if kind == "any" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				n = 1
+			}
+			var unused []model.ProbeInfo
+			for _, p := range candidates {
+				if !seen[p.ID] {
+					unused = append(unused, p)
+				}
+			}
+			for _, p := range choose(unused, n, payload.Strategy) {
+				seen[p.ID] = true
+				matched = append(matched, p)
+			}
+			continue
+		}
+
+		for _, p := range candidates {
+			if !seen[p.ID] && matchSelector(p, selector) {
+				seen[p.ID] = true
+				matched = append(matched, p)
+			}
+		}
+	}
+
+	for _, p := range choose(matched, payload.Limit, payload.Strategy) {
+		result = append(result, p.ID)
+	}
+	return result
+}
+
+// matchSelector reports whether a probe matches a single selector
+func matchSelector(p model.ProbeInfo, selector string) bool {
+	kind, value, ok := strings.Cut(strings.TrimSpace(selector), ":")
+	if !ok {
+		return matchMagic(p, selector)
+	}
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	switch strings.ToLower(kind) {
+	case "id":
+		return p.ID == value
+	case "name":
+		return strings.EqualFold(p.Name, value)
+	case "asn", "as":
+		asn, err := strconv.ParseUint(strings.TrimPrefix(value, "as"), 10, 32)
+		return err == nil && p.ASN == uint32(asn)
+	case "country":
+		return strings.EqualFold(p.Country, value)
+	case "region":
+		return strings.EqualFold(p.Region, value)
+	case "tag":
+		for _, tag := range p.Tags {
+			if strings.EqualFold(tag, value) {
+				return true
+			}
+		}
+		return false
+	default:
+		return matchMagic(p, selector)
+	}
+}
+
+// matchMagic matches a free-form string: every word must appear in the
+// probe's name, location, country, region, tags or ASN
+func matchMagic(p model.ProbeInfo, query string) bool {
+	fields := []string{p.Name, p.Location, p.Country, p.Region}
+	fields = append(fields, p.Tags...)
+	if p.ASN != 0 {
+		fields = append(fields, "as"+strconv.FormatUint(uint64(p.ASN), 10))
+	}
+	haystack := strings.ToLower(strings.Join(fields, " "))
+
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return false
+	}
+	for _, word := range words {
+		if !strings.Contains(haystack, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// choose picks up to limit probes, randomly or preferring the least loaded
+func choose(probes []model.ProbeInfo, limit int, strategy string) []model.ProbeInfo {
+	if limit <= 0 || len(probes) <= limit {
+		return probes
+	}
+
+	chosen := make([]model.ProbeInfo, len(probes))
+	copy(chosen, probes)
+	rand.Shuffle(len(chosen), func(i, j int) {
+		chosen[i], chosen[j] = chosen[j], chosen[i]
+	})
+	if strategy == StrategyLoad {
+		// Stable sort keeps the shuffled order among equally loaded probes
+		sort.SliceStable(chosen, func(i, j int) bool {
+			return chosen[i].ActiveTasks < chosen[j].ActiveTasks
+		})
+	}
+	return chosen[:limit]
+}
@@ -0,0 +1,130 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// BeginShutdown stops task creation and tells every client, and every probe
+// that negotiated the shutdown feature, that the server is going away and
+// by when running tasks must be done
+func (h *Hub) BeginShutdown(deadline time.Time) {
+	h.shuttingDown.Store(true)
+
+	// The shutdown message is the same for probes and clients
+	data, err := protocol.ServerToProbe.Encode(model.Message{
+		Type: model.MsgTypeShutdown,
+		Payload: model.ShutdownPayload{
+			Message:  "Server is shutting down",
+			Deadline: deadline,
+		},
+	})
+	if err != nil {
+		log.Printf("Failed to encode shutdown message: %v", err)
+		return
+	}
+
+	h.probesMux.RLock()
+	for _, probe := range h.probes {
+		if !protocol.HasFeature(probe.Info.Features, protocol.FeatureShutdown) {
+			continue
+		}
+		h.queueToProbe(probe, data, guaranteed, "")
+	}
+	h.probesMux.RUnlock()
+
+	h.clientsMux.RLock()
+	for _, client := range h.clients {
+		h.queueToClient(client, data, guaranteed, "")
+	}
+	h.clientsMux.RUnlock()
+}
+
+// ShuttingDown reports whether BeginShutdown has been called
+func (h *Hub) ShuttingDown() bool {
+	return h.shuttingDown.Load()
+}
+
+// InFlightTasks returns the number of probe-tests that have not finished yet
+func (h *Hub) InFlightTasks() int {
+	h.probesMux.RLock()
+	defer h.probesMux.RUnlock()
+
+	n := 0
+	for _, probe := range h.probes {
+		n += probe.Info.ActiveTasks
+	}
+	return n
+}
+
+// WaitForTasks blocks until no task is in flight or ctx is done, and
+// returns the number of tasks still running
+func (h *Hub) WaitForTasks(ctx context.Context) int {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		n := h.InFlightTasks()
+		if n == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return n
+		case <-ticker.C:
+		}
+	}
+}
+
+// CloseAll sends a close frame to every probe and client and closes their
+// connections. The http.Server does not track hijacked WebSocket
+// connections, so they have to be closed here.
+func (h *Hub) CloseAll(writeWait time.Duration) {
+	// Give the writers a moment to flush queued messages such as final results
+	flushDeadline := time.Now().Add(writeWait)
+	for h.queuedMessages() > 0 && time.Now().Before(flushDeadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	var conns []*websocket.Conn
+
+	h.probesMux.RLock()
+	for _, probe := range h.probes {
+		conns = append(conns, probe.Conn)
+	}
+	h.probesMux.RUnlock()
+
+	h.clientsMux.RLock()
+	for _, client := range h.clients {
+		conns = append(conns, client.Conn)
+	}
+	h.clientsMux.RUnlock()
+
+	for _, conn := range conns {
+		conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeWait))
+		conn.Close()
+	}
+}
+
+// queuedMessages counts messages waiting in all send channels
+func (h *Hub) queuedMessages() int {
+	n := 0
+	h.probesMux.RLock()
+	for _, probe := range h.probes {
+		n += probe.Queue.Len()
+	}
+	h.probesMux.RUnlock()
+
+	h.clientsMux.RLock()
+	for _, client := range h.clients {
+		n += client.Queue.Len()
+	}
+	h.clientsMux.RUnlock()
+	return n
+}
@@ -0,0 +1,64 @@
+package hub
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+// DropStats counts messages the hub could not deliver, by reason
+type DropStats struct {
+	LinesDropped       int64 `json:"lines_dropped"`        // output lines dropped for clients that fell behind
+	StatusDropped      int64 `json:"status_dropped"`       // task_status and quota messages dropped
+	ProbeListsReplaced int64 `json:"probe_lists_replaced"` // queued probe lists superseded by a newer one
+	SlowClients        int64 `json:"slow_clients"`         // clients disconnected for not keeping up
+	SlowProbes         int64 `json:"slow_probes"`          // probes disconnected for not keeping up
+}
+
+type dropCounters struct {
+	lines, status, probeLists, slowClients, slowProbes atomic.Int64
+}
+
+// DropStats returns the drop counters since the server started
+func (h *Hub) DropStats() DropStats {
+	return DropStats{
+		LinesDropped:       h.drops.lines.Load(),
+		StatusDropped:      h.drops.status.Load(),
+		ProbeListsReplaced: h.drops.probeLists.Load(),
+		SlowClients:        h.drops.slowClients.Load(),
+		SlowProbes:         h.drops.slowProbes.Load(),
+	}
+}
+
+// queueToClient queues a message for a client. A client that cannot keep
+// up is disconnected; dropped output lines are left for the caller to count.
+func (h *Hub) queueToClient(client *ClientConnection, data []byte, d delivery, key string) pushResult {
+	res := client.Queue.push(data, d, key)
+	switch res {
+	case pushReplaced:
+		// Probe lists are the only messages clients get replaced
+		h.drops.probeLists.Add(1)
+	case pushOverflow:
+		if client.slow.CompareAndSwap(false, true) {
+			log.Printf("Client %s is not keeping up, disconnecting", client.ID)
+			h.drops.slowClients.Add(1)
+			client.Conn.Close()
+		}
+	}
+	return res
+}
+
+// queueToProbe queues a message for a probe, disconnecting the probe if it
+// cannot keep up, and reports whether the message was queued
+func (h *Hub) queueToProbe(probe *ProbeConnection, data []byte, d delivery, key string) bool {
+	switch probe.Queue.push(data, d, key) {
+	case pushQueued, pushReplaced:
+		return true
+	case pushOverflow:
+		if probe.slow.CompareAndSwap(false, true) {
+			log.Printf("Probe %s is not keeping up, disconnecting", probe.ID)
+			h.drops.slowProbes.Add(1)
+			probe.disconnect()
+		}
+	}
+	return false
+}
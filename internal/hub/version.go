@@ -0,0 +1,37 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+)
+
+// ErrProbeOutdated is returned for probes too old to be served
+var ErrProbeOutdated = errors.New("probe is outdated, please upgrade")
+
+// checkProbeVersion rejects probes speaking a protocol older than
+// min_protocol_version, or whose software is older than min_probe_version.
+// With a minimum software version, development builds, whose version
+// ("dev" unless set at build time) is not a release number, are rejected
+// too, since nothing says what they contain.
+func (h *Hub) checkProbeVersion(payload model.RegisterPayload) error {
+	if v := protocol.PeerVersion(payload.ProtocolVersion); v < h.minProtocolVersion {
+		return fmt.Errorf("%w: protocol version %d is not supported (server speaks %d to %d)",
+			ErrProbeOutdated, v, h.minProtocolVersion, protocol.Version)
+	}
+	if h.minProbeVersion == "" {
+		return nil
+	}
+	cmp, err := protocol.CompareVersions(payload.Capabilities.Version, h.minProbeVersion)
+	if err != nil {
+		return fmt.Errorf("%w: version %q is not a release version, and this server requires %s or newer",
+			ErrProbeOutdated, payload.Capabilities.Version, h.minProbeVersion)
+	}
+	if cmp < 0 {
+		return fmt.Errorf("%w: version %s is older than minimum %s", ErrProbeOutdated,
+			payload.Capabilities.Version, h.minProbeVersion)
+	}
+	return nil
+}
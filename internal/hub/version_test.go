@@ -0,0 +1,46 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+	"github.com/bingxin666/dn42-globalping/internal/protocol"
+)
+
+func TestCheckProbeVersion(t *testing.T) {
+	register := func(proto int, version string) model.RegisterPayload {
+		return model.RegisterPayload{
+			Name:            "p",
+			ProtocolVersion: proto,
+			Capabilities:    model.ProbeCapabilities{Version: version},
+		}
+	}
+	tests := []struct {
+		name       string
+		minProto   int
+		minVersion string
+		payload    model.RegisterPayload
+		ok         bool
+	}{
+		{"defaults accept unversioned probe", protocol.MinVersion, "", register(0, "dev"), true},
+		{"old protocol rejected", protocol.Version, "", register(0, "v1.0.0"), false},
+		{"current protocol accepted", protocol.Version, "", register(protocol.Version, "v1.0.0"), true},
+		{"dev build accepted without minimum", protocol.MinVersion, "", register(protocol.Version, "dev"), true},
+		{"dev build rejected with minimum", protocol.MinVersion, "v1.2.0", register(protocol.Version, "dev"), false},
+		{"older release rejected", protocol.MinVersion, "v1.2.0", register(protocol.Version, "v1.1.9"), false},
+		{"newer release accepted", protocol.MinVersion, "v1.2.0", register(protocol.Version, "v1.10.0"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Hub{minProtocolVersion: tt.minProto, minProbeVersion: tt.minVersion}
+			err := h.checkProbeVersion(tt.payload)
+			if tt.ok && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrProbeOutdated) {
+				t.Fatalf("err = %v, want ErrProbeOutdated", err)
+			}
+		})
+	}
+}
@@ -1,16 +1,95 @@
 package model
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // ProbeInfo represents a probe node's registration information
 type ProbeInfo struct {
 	ID        string    `json:"id"`
+	Identity  string    `json:"identity"` // name proven by token or certificate, else "unverified:" and the name; stable across reconnects
 	Name      string    `json:"name"`
 	Location  string    `json:"location"`
 	Latitude  float64   `json:"latitude"`
 	Longitude float64   `json:"longitude"`
-	Status    string    `json:"status"` // online, offline
+	Status    string    `json:"status"` // online, draining, offline
 	LastSeen  time.Time `json:"last_seen"`
+
+	ASN     uint32   `json:"asn,omitempty"`
+	Country string   `json:"country,omitempty"` // ISO 3166-1 alpha-2
+	Region  string   `json:"region,omitempty"`  // e.g. eu, na, as
+	Tags    []string `json:"tags,omitempty"`
+
+	Addresses    []string          `json:"addresses,omitempty"` // addresses the probe measures from
+	Capabilities ProbeCapabilities `json:"capabilities"`
+	ActiveTasks  int               `json:"active_tasks"`
+	Uptime       float64           `json:"uptime"`         // percent online over the last 24h
+	ControlRTT   float64           `json:"control_rtt_ms"` // WebSocket ping round-trip to the server
+
+	ProtocolVersion int      `json:"protocol_version"`
+	Features        []string `json:"features,omitempty"` // negotiated with the server
+	Outdated        bool     `json:"outdated,omitempty"` // speaks an older protocol than the server
+}
+
+// Probe status values
+const (
+	ProbeStatusOnline   = "online"
+	ProbeStatusDraining = "draining" // finishing running tasks, accepting no new ones
+	ProbeStatusOffline  = "offline"
+)
+
+// ProbeOverride replaces a probe's self-reported display fields.
+// Nil fields keep the value the probe reported.
+type ProbeOverride struct {
+	Name     *string   `json:"name,omitempty"`
+	Location *string   `json:"location,omitempty"`
+	Tags     *[]string `json:"tags,omitempty"`
+}
+
+// ProbeCapabilities describes what a probe is able to execute.
+// Probes that predate capability advertisement send an empty value.
+type ProbeCapabilities struct {
+	TaskTypes      []string `json:"task_types"` // ping, traceroute, mtr
+	IPv4           bool     `json:"ipv4"`
+	IPv6           bool     `json:"ipv6"`
+	Bird           bool     `json:"bird"`
+	Version        string   `json:"version"`
+	MaxConcurrency int      `json:"max_concurrency"` // 0 means unlimited
+	QueueSize      int      `json:"queue_size"`      // tasks that may wait for a free slot
+
+	// Sent since protocol version 3; older probes omit it
+	Commands []CommandInfo `json:"commands,omitempty"` // operator-defined task types, also listed in TaskTypes
+}
+
+// CommandInfo describes a custom command a probe's operator defined, so
+// clients know which target and parameters it takes
+type CommandInfo struct {
+	Name        string         `json:"name"` // task type
+	Description string         `json:"description,omitempty"`
+	Target      bool           `json:"target"` // whether the command takes a target
+	Params      []CommandParam `json:"params,omitempty"`
+}
+
+// Command parameter types
+const (
+	ParamIP     = "ip"     // IPv4 or IPv6 address
+	ParamPrefix = "prefix" // CIDR prefix
+	ParamHost   = "host"   // IP address or hostname
+	ParamName   = "name"   // identifier such as a BIRD protocol or interface name
+	ParamInt    = "int"    // integer between Min and Max
+	ParamEnum   = "enum"   // one of Values
+)
+
+// CommandParam is a typed parameter of a custom command
+type CommandParam struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Optional    bool     `json:"optional,omitempty"`
+	Values      []string `json:"values,omitempty"` // enum only
+	Min         *int     `json:"min,omitempty"`    // int only
+	Max         *int     `json:"max,omitempty"`    // int only
 }
 
 // MessageType defines the type of WebSocket message
@@ -23,8 +102,13 @@ const (
 	MsgTypeHeartbeat   MessageType = "heartbeat"
 	MsgTypeProbeList   MessageType = "probe_list"
 	MsgTypeTaskCreate  MessageType = "task_create"
+	MsgTypeTaskCreated MessageType = "task_created"
 	MsgTypeTaskStream  MessageType = "task_stream"
 	MsgTypeTaskEnd     MessageType = "task_end"
+	MsgTypeTaskStatus  MessageType = "task_status"
+	MsgTypeTaskAck     MessageType = "task_ack"
+	MsgTypeQuota       MessageType = "quota"
+	MsgTypeShutdown    MessageType = "shutdown"
 	MsgTypeError       MessageType = "error"
 )
 
@@ -36,45 +120,147 @@ type Message struct {
 
 // RegisterPayload is sent by probe to register with server
 type RegisterPayload struct {
-	Name      string  `json:"name"`
-	Location  string  `json:"location"`
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	Name         string            `json:"name"`
+	Location     string            `json:"location"`
+	Latitude     float64           `json:"latitude"`
+	Longitude    float64           `json:"longitude"`
+	ASN          uint32            `json:"asn,omitempty"`
+	Country      string            `json:"country,omitempty"`
+	Region       string            `json:"region,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Addresses    []string          `json:"addresses,omitempty"` // addresses the probe measures from
+	Capabilities ProbeCapabilities `json:"capabilities"`
+
+	// Sent since protocol version 2; older probes omit them
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	Features        []string `json:"features,omitempty"`
+
+	// Probe ID of the previous connection, whose tasks the probe continues,
+	// and the resume token the server issued with it; only sent to servers
+	// that negotiated the resume feature
+	ResumeID    string `json:"resume_id,omitempty"`
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+// RegisteredPayload is sent by server to probe to accept its registration
+type RegisteredPayload struct {
+	ProbeID string `json:"probe_id"`
+
+	// Only sent to probes speaking protocol version 2 or later
+	ProtocolVersion int      `json:"protocol_version,omitempty"` // version the server speaks with this probe
+	Features        []string `json:"features,omitempty"`         // features both sides support
+
+	// Secret the probe must send with resume_id to continue this connection;
+	// only sent with the resume feature
+	ResumeToken string `json:"resume_token,omitempty"`
 }
 
 // TaskPayload is sent by server to probe to execute a task
 type TaskPayload struct {
-	TaskID  string `json:"task_id"`
-	Type    string `json:"type"` // ping, traceroute, mtr
-	Target  string `json:"target"`
-	Options string `json:"options,omitempty"`
+	TaskID  string            `json:"task_id"`
+	Type    string            `json:"type"` // ping, traceroute, mtr or a custom command
+	Target  string            `json:"target"`
+	Options string            `json:"options,omitempty"`
+	Params  map[string]string `json:"params,omitempty"` // custom commands only
+	Limits  *TaskLimits       `json:"limits,omitempty"` // the server's ceiling, to probes with the task_limits feature
+}
+
+// TaskLimits bound how long a task may run and how much output it may
+// produce on each probe. Zero fields set no limit.
+type TaskLimits struct {
+	Timeout  int `json:"timeout,omitempty"`   // seconds
+	MaxLines int `json:"max_lines,omitempty"` // lines of output
+	MaxBytes int `json:"max_bytes,omitempty"` // bytes of output
 }
 
-// TaskResultPayload is sent by probe to server with task results
+// Output streams
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	StreamMeta   = "meta" // notes added by the probe rather than the tool
+)
+
+// OutputLine is one line of task output with its place in the output and
+// when and where the probe read it
+type OutputLine struct {
+	Seq    uint64    `json:"seq"`    // numbers the lines of a task on one probe from 1
+	Time   time.Time `json:"time"`   // when the probe read the line
+	Stream string    `json:"stream"` // stdout, stderr, meta
+	Text   string    `json:"text"`
+}
+
+// TaskResultPayload is sent by probe to server with task results. With
+// the line_info feature, Output carries the lines since the previous
+// result; otherwise the batch feature puts them in Lines, or Line holds a
+// single one. With the resume feature, Seq numbers the results of a task
+// from 1, so results replayed after a reconnect can be recognized.
 type TaskResultPayload struct {
-	TaskID  string `json:"task_id"`
-	ProbeID string `json:"probe_id"`
-	Line    string `json:"line"`
-	IsEnd   bool   `json:"is_end"`
-	Error   string `json:"error,omitempty"`
+	TaskID  string          `json:"task_id"`
+	ProbeID string          `json:"probe_id"`
+	Line    string          `json:"line"`
+	Lines   []string        `json:"lines,omitempty"`
+	Output  []OutputLine    `json:"output,omitempty"`
+	IsEnd   bool            `json:"is_end"`
+	Error   string          `json:"error,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"` // structured result, with the final result only
+	Seq     uint64          `json:"seq,omitempty"`
+}
+
+// TaskAckPayload is sent by server to probe to acknowledge every result of
+// a task up to and including Seq
+type TaskAckPayload struct {
+	TaskID string `json:"task_id"`
+	Seq    uint64 `json:"seq"`
 }
 
-// TaskCreatePayload is sent by web client to create a new task
+// TaskCreatePayload is sent by web client to create a new task.
+// Probes are chosen from ProbeIDs plus any probes matched by Selectors,
+// e.g. "asn:4242420000", "tag:bird", "region:eu", "any:3" or a free-form
+// "magic" string matched against name, location, country, region and tags.
 type TaskCreatePayload struct {
-	ProbeIDs []string `json:"probe_ids"`
-	Type     string   `json:"type"` // ping, traceroute, mtr
-	Target   string   `json:"target"`
-	Options  string   `json:"options,omitempty"`
+	ProbeIDs  []string          `json:"probe_ids"`
+	Selectors []string          `json:"selectors,omitempty"`
+	Limit     int               `json:"limit,omitempty"`    // max probes chosen from selectors, 0 for all
+	Strategy  string            `json:"strategy,omitempty"` // random (default), load
+	Type      string            `json:"type"`               // ping, traceroute, mtr or a custom command
+	Target    string            `json:"target"`             // may be empty for commands that take none
+	Options   string            `json:"options,omitempty"`
+	Params    map[string]string `json:"params,omitempty"` // custom commands only
+	Limits    *TaskLimits       `json:"limits,omitempty"` // lower than the server's ceiling, if set
 }
 
-// TaskStreamPayload is sent to web client with streaming results
+// TaskStreamPayload is sent to web client with streaming results. Clients
+// that connect with the line_info feature get several lines at once in
+// Output, those with the batch feature in Lines.
+// Dropped counts lines the server dropped because the client fell behind;
+// it comes in a message of its own or with the end of the task.
 type TaskStreamPayload struct {
-	TaskID    string `json:"task_id"`
-	ProbeID   string `json:"probe_id"`
-	ProbeName string `json:"probe_name"`
-	Line      string `json:"line"`
-	IsEnd     bool   `json:"is_end"`
-	Error     string `json:"error,omitempty"`
+	TaskID    string          `json:"task_id"`
+	ProbeID   string          `json:"probe_id"`
+	ProbeName string          `json:"probe_name"`
+	Line      string          `json:"line"`
+	Lines     []string        `json:"lines,omitempty"`
+	Output    []OutputLine    `json:"output,omitempty"`
+	IsEnd     bool            `json:"is_end"`
+	Error     string          `json:"error,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"` // structured result, with the end marker only
+	Dropped   int             `json:"dropped,omitempty"`
+}
+
+// Task status values reported by probes while a task waits or starts
+const (
+	TaskStatusQueued  = "queued"
+	TaskStatusRunning = "running"
+)
+
+// TaskStatusPayload is sent by probe when a task is queued or starts running,
+// and forwarded to the web client with the probe name filled in
+type TaskStatusPayload struct {
+	TaskID        string `json:"task_id"`
+	ProbeID       string `json:"probe_id"`
+	ProbeName     string `json:"probe_name,omitempty"`
+	Status        string `json:"status"`                   // queued, running
+	QueuePosition int    `json:"queue_position,omitempty"` // 1-based, only when queued
 }
 
 // ProbeListPayload contains the list of available probes
@@ -84,5 +270,72 @@ type ProbeListPayload struct {
 
 // ErrorPayload contains error information
 type ErrorPayload struct {
-	Message string `json:"message"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds, set when rate limited
+}
+
+// QuotaPayload tells a web client how much of its daily quota is left.
+// Limit and Remaining are -1 when no quota is configured.
+type QuotaPayload struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	ResetAt   time.Time `json:"reset_at,omitempty"`
+}
+
+// TaskCreatedPayload is sent by server to client when a task has been
+// accepted, before any of its results
+type TaskCreatedPayload struct {
+	TaskID   string   `json:"task_id"`
+	ProbeIDs []string `json:"probe_ids"` // every selected probe, each ends with an is_end task_stream
+}
+
+// Measurement status values
+const (
+	MeasurementInProgress = "in-progress"
+	MeasurementFinished   = "finished"
+	MeasurementFailed     = "failed" // only for per-probe results
+)
+
+// Measurement is a task and the output it produced on every probe
+type Measurement struct {
+	ID        string              `json:"id"`
+	Type      string              `json:"type"`
+	Target    string              `json:"target"`
+	Options   string              `json:"options,omitempty"`
+	Params    map[string]string   `json:"params,omitempty"`
+	Limits    *TaskLimits         `json:"limits,omitempty"` // as sent to probes
+	CreatedAt time.Time           `json:"created_at"`
+	Status    string              `json:"status"` // in-progress, finished
+	Results   []MeasurementResult `json:"results"`
+}
+
+// MeasurementResult is the output of a measurement on one probe
+type MeasurementResult struct {
+	ProbeID   string `json:"probe_id"`
+	ProbeName string `json:"probe_name"`
+	Status    string `json:"status"` // in-progress, finished, failed
+	Output    string `json:"output"`
+	Error     string `json:"error,omitempty"`
+
+	Lines []OutputLine    `json:"lines,omitempty"` // Output line by line, with sequence numbers and timestamps
+	Data  json.RawMessage `json:"data,omitempty"`  // structured result, if the task type has one
+}
+
+// PingSummary is the structured result of a ping task. Round-trip times
+// are in milliseconds and left out when no reply arrived.
+type PingSummary struct {
+	Transmitted int     `json:"transmitted"`
+	Received    int     `json:"received"`
+	Loss        float64 `json:"loss"` // percent of packets lost
+	Min         float64 `json:"min,omitempty"`
+	Avg         float64 `json:"avg,omitempty"`
+	Max         float64 `json:"max,omitempty"`
+	StdDev      float64 `json:"stddev,omitempty"`
+}
+
+// ShutdownPayload is sent by server to clients and probes when it is about
+// to stop. No new tasks are accepted; running tasks may finish until Deadline.
+type ShutdownPayload struct {
+	Message  string    `json:"message"`
+	Deadline time.Time `json:"deadline"`
 }
@@ -0,0 +1,173 @@
+// Package protocol encodes and decodes the JSON messages exchanged over the
+// probe and client WebSockets. Each direction of each connection has a
+// Registry of the message types it may carry and their payload types;
+// payloads are kept raw until the handler asks for its concrete type, and
+// are decoded strictly unless they come from a peer speaking a newer
+// protocol version than this build.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// MaxMessageSize is the largest message accepted on either WebSocket
+const MaxMessageSize = 1 << 20
+
+var (
+	ErrTooLarge       = fmt.Errorf("message exceeds %d bytes", MaxMessageSize)
+	ErrUnknownType    = errors.New("unknown message type")
+	ErrPayloadType    = errors.New("payload type does not match message type")
+	ErrTrailingData   = errors.New("unexpected data after message")
+	errNoPayloadValue = errors.New("message type carries no payload")
+)
+
+// Envelope is a decoded message whose payload has not been parsed yet
+type Envelope struct {
+	Type    model.MessageType `json:"type"`
+	Payload json.RawMessage   `json:"payload"`
+
+	payloadType reflect.Type // registered for Type, nil if it carries none
+	lenient     bool         // ignore unknown fields in the payload
+}
+
+// Registry maps the message types allowed in one direction to their
+// payload types. A nil type means the message carries no payload.
+type Registry map[model.MessageType]reflect.Type
+
+// Registries for every direction of the probe and client WebSockets
+var (
+	ProbeToServer = Registry{
+		model.MsgTypeRegister:   typeOf[model.RegisterPayload](),
+		model.MsgTypeHeartbeat:  nil,
+		model.MsgTypeTaskResult: typeOf[model.TaskResultPayload](),
+		model.MsgTypeTaskStatus: typeOf[model.TaskStatusPayload](),
+	}
+	ServerToProbe = Registry{
+		model.MsgTypeRegister: typeOf[model.RegisteredPayload](),
+		model.MsgTypeTask:     typeOf[model.TaskPayload](),
+		model.MsgTypeTaskAck:  typeOf[model.TaskAckPayload](),
+		model.MsgTypeShutdown: typeOf[model.ShutdownPayload](),
+		model.MsgTypeError:    typeOf[model.ErrorPayload](),
+	}
+	ClientToServer = Registry{
+		model.MsgTypeTaskCreate: typeOf[model.TaskCreatePayload](),
+		model.MsgTypeProbeList:  nil,
+	}
+	ServerToClient = Registry{
+		model.MsgTypeProbeList:   typeOf[model.ProbeListPayload](),
+		model.MsgTypeTaskCreated: typeOf[model.TaskCreatedPayload](),
+		model.MsgTypeTaskStream:  typeOf[model.TaskStreamPayload](),
+		model.MsgTypeTaskStatus:  typeOf[model.TaskStatusPayload](),
+		model.MsgTypeQuota:       typeOf[model.QuotaPayload](),
+		model.MsgTypeShutdown:    typeOf[model.ShutdownPayload](),
+		model.MsgTypeError:       typeOf[model.ErrorPayload](),
+	}
+)
+
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// Decode parses the envelope of a message registered in r, rejecting
+// oversized messages, unknown fields and unknown types
+func (r Registry) Decode(data []byte) (Envelope, error) {
+	return r.decode(data, false)
+}
+
+// DecodeFrom parses a message like Decode, but ignores unknown fields if
+// the peer speaks a newer protocol version than this build: it may add
+// fields this build does not know, which are not errors
+func (r Registry) DecodeFrom(data []byte, peerVersion int) (Envelope, error) {
+	return r.decode(data, PeerVersion(peerVersion) > Version)
+}
+
+// DecodeLenient parses a message like Decode, but always ignores unknown
+// fields. Clients use it, as the server does not announce its version to
+// them and may be newer.
+func (r Registry) DecodeLenient(data []byte) (Envelope, error) {
+	return r.decode(data, true)
+}
+
+func (r Registry) decode(data []byte, lenient bool) (Envelope, error) {
+	var env Envelope
+	if len(data) > MaxMessageSize {
+		return env, ErrTooLarge
+	}
+	if err := unmarshal(data, &env, lenient); err != nil {
+		return env, err
+	}
+	env.lenient = lenient
+	payloadType, ok := r[env.Type]
+	if !ok {
+		return env, fmt.Errorf("%w %q", ErrUnknownType, env.Type)
+	}
+	env.payloadType = payloadType
+	return env, nil
+}
+
+// DecodePayload parses the payload of env into T, which must be the type
+// registered for env.Type
+func DecodePayload[T any](env Envelope) (T, error) {
+	var payload T
+	if env.payloadType == nil {
+		return payload, fmt.Errorf("%s: %w", env.Type, errNoPayloadValue)
+	}
+	if typeOf[T]() != env.payloadType {
+		return payload, fmt.Errorf("%s: %w: got %s, want %s", env.Type, ErrPayloadType, typeOf[T](), env.payloadType)
+	}
+	if err := unmarshal(env.Payload, &payload, env.lenient); err != nil {
+		return payload, fmt.Errorf("%s payload: %w", env.Type, err)
+	}
+	return payload, nil
+}
+
+// Encode marshals msg after checking its payload has the type registered
+// for msg.Type
+func (r Registry) Encode(msg model.Message) ([]byte, error) {
+	payloadType, ok := r[msg.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, msg.Type)
+	}
+	if got := reflect.TypeOf(msg.Payload); got != payloadType {
+		return nil, fmt.Errorf("%s: %w: got %v, want %v", msg.Type, ErrPayloadType, got, payloadType)
+	}
+	return json.Marshal(msg)
+}
+
+// AnnouncedVersion returns the protocol_version in the payload of a
+// register message without validating anything else, or 0 if it has none.
+// The message can then be decoded as strictly as that version allows.
+func AnnouncedVersion(data []byte) int {
+	var msg struct {
+		Payload struct {
+			ProtocolVersion int `json:"protocol_version"`
+		} `json:"payload"`
+	}
+	if len(data) > MaxMessageSize || json.Unmarshal(data, &msg) != nil {
+		return 0
+	}
+	return msg.Payload.ProtocolVersion
+}
+
+// unmarshal decodes exactly one JSON value, rejecting unknown fields
+// unless lenient
+func unmarshal(data []byte, v interface{}, lenient bool) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if !lenient {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return ErrTrailingData
+	}
+	return nil
+}
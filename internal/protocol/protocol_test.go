@@ -0,0 +1,188 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+func TestDecodeRejectsUnknownFields(t *testing.T) {
+	data := []byte(`{"type":"task_result","payload":{"task_id":"t1","line":"x","is_end":false,"future":1}}`)
+	msg, err := ProbeToServer.DecodeFrom(data, Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodePayload[model.TaskResultPayload](msg); err == nil || !strings.Contains(err.Error(), "future") {
+		t.Errorf("err = %v, want unknown field error", err)
+	}
+}
+
+func TestDecodeFromNewerPeerIgnoresUnknownFields(t *testing.T) {
+	data := []byte(`{"type":"register","payload":{"name":"p1","protocol_version":99,"future":{"a":1}},"future":true}`)
+	if v := AnnouncedVersion(data); v != 99 {
+		t.Fatalf("AnnouncedVersion = %d, want 99", v)
+	}
+	msg, err := ProbeToServer.DecodeFrom(data, AnnouncedVersion(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := DecodePayload[model.RegisterPayload](msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Name != "p1" || payload.ProtocolVersion != 99 {
+		t.Errorf("payload = %+v", payload)
+	}
+}
+
+func TestDecodeChecks(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"unknown type", `{"type":"bogus","payload":{}}`, ErrUnknownType},
+		{"trailing data", `{"type":"heartbeat"} {}`, ErrTrailingData},
+		{"too large", `{"type":"heartbeat","payload":"` + strings.Repeat("x", MaxMessageSize) + `"}`, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		if _, err := ProbeToServer.Decode([]byte(tt.data)); !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestDecodePayloadChecksType(t *testing.T) {
+	msg, err := ProbeToServer.Decode([]byte(`{"type":"task_status","payload":{"task_id":"t1","status":"queued"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodePayload[model.TaskResultPayload](msg); !errors.Is(err, ErrPayloadType) {
+		t.Errorf("err = %v, want ErrPayloadType", err)
+	}
+}
+
+// benchResult is a typical streamed result line from a probe
+var benchResult = []byte(`{"type":"task_result","payload":{"task_id":"0b6f1c9e-8a4e-4f0a-9d1e-2c3b4a5d6e7f","probe_id":"p1",` +
+	`"line":"64 bytes from 172.20.0.53: icmp_seq=1 ttl=62 time=12.3 ms","is_end":false}}`)
+
+// BenchmarkDecodeRoundTrip is how messages were decoded before the codec:
+// into a generic Message, then marshalled and unmarshalled again into the
+// payload type
+func BenchmarkDecodeRoundTrip(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var msg model.Message
+		if err := json.Unmarshal(benchResult, &msg); err != nil {
+			b.Fatal(err)
+		}
+		payloadBytes, err := json.Marshal(msg.Payload)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var payload model.TaskResultPayload
+		if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeRaw decodes the same message through the codec, which
+// keeps the payload raw until its type is known
+func BenchmarkDecodeRaw(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg, err := ProbeToServer.Decode(benchResult)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := DecodePayload[model.TaskResultPayload](msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDecodeLenientIgnoresUnknownFields(t *testing.T) {
+	data := []byte(`{"type":"task_created","payload":{"task_id":"t1","probe_ids":["p1"],"future":1},"future":true}`)
+	msg, err := ServerToClient.DecodeLenient(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := DecodePayload[model.TaskCreatedPayload](msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.TaskID != "t1" {
+		t.Errorf("payload = %+v", payload)
+	}
+	if _, err := ServerToClient.DecodeLenient([]byte(`{"type":"future"}`)); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("err = %v, want ErrUnknownType", err)
+	}
+}
+
+// v2RegisterPayload is register as a protocol version 2 server knows it
+type v2RegisterPayload struct {
+	Name         string   `json:"name"`
+	Location     string   `json:"location"`
+	Latitude     float64  `json:"latitude"`
+	Longitude    float64  `json:"longitude"`
+	ASN          uint32   `json:"asn,omitempty"`
+	Country      string   `json:"country,omitempty"`
+	Region       string   `json:"region,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Addresses    []string `json:"addresses,omitempty"`
+	Capabilities struct {
+		TaskTypes      []string `json:"task_types"`
+		IPv4           bool     `json:"ipv4"`
+		IPv6           bool     `json:"ipv6"`
+		Bird           bool     `json:"bird"`
+		Version        string   `json:"version"`
+		MaxConcurrency int      `json:"max_concurrency"`
+		QueueSize      int      `json:"queue_size"`
+	} `json:"capabilities"`
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	Features        []string `json:"features,omitempty"`
+}
+
+func TestRegisterDecodesOnStrictV2Server(t *testing.T) {
+	// A version 2 server decodes strictly unless the probe is newer than 2
+	v2 := Registry{model.MsgTypeRegister: typeOf[v2RegisterPayload]()}
+	decodeV2 := func(data []byte) error {
+		msg, err := v2.decode(data, PeerVersion(AnnouncedVersion(data)) > 2)
+		if err != nil {
+			return err
+		}
+		_, err = DecodePayload[v2RegisterPayload](msg)
+		return err
+	}
+
+	register := model.RegisterPayload{
+		Name: "p1",
+		Capabilities: model.ProbeCapabilities{
+			TaskTypes: []string{"ping", "bird-protocols"},
+			Commands:  []model.CommandInfo{{Name: "bird-protocols"}},
+		},
+		ProtocolVersion: Version,
+		Features:        Features,
+	}
+	data, err := ProbeToServer.Encode(model.Message{Type: model.MsgTypeRegister, Payload: register})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decodeV2(data); err != nil {
+		t.Errorf("v2 server rejected register: %v", err)
+	}
+
+	// Announcing version 2 with commands is what a v2 server refuses
+	register.ProtocolVersion = 2
+	data, err = ProbeToServer.Encode(model.Message{Type: model.MsgTypeRegister, Payload: register})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := decodeV2(data); err == nil || !strings.Contains(err.Error(), "commands") {
+		t.Errorf("err = %v, want unknown field commands", err)
+	}
+}
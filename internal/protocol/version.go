@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions. Version is spoken by this build; peers that send no
+// version in register speak version 1. Servers serve probes from
+// MinVersion up, and newer probes fall back to the server's version.
+//
+// A probe may only send a field its server does not know in a version the
+// server will decode leniently, so every new field in register needs a
+// new version:
+//
+//	1: no protocol_version in register
+//	2: register carries protocol_version and features
+//	3: register carries capabilities.commands
+const (
+	Version    = 3
+	MinVersion = 1
+)
+
+// Optional features negotiated in register. A feature is only used when
+// both sides list it, so either side may lack it.
+const (
+	FeatureTaskStatus = "task_status" // probe reports queued and running tasks
+	FeatureShutdown   = "shutdown"    // probe understands shutdown notices
+	FeatureBatch      = "batch"       // task_result and task_stream carry several lines in lines
+	FeatureResume     = "resume"      // probe numbers its results, replays them after reconnecting, and gets task_ack
+	FeatureLineInfo   = "line_info"   // task_result and task_stream carry output with sequence numbers, timestamps and streams
+	FeatureResultData = "result_data" // final task_result and task_stream carry the task's structured result in data
+	FeatureTaskLimits = "task_limits" // task carries the server's limits on runtime and output in limits
+)
+
+// Features lists every feature this build supports
+var Features = []string{FeatureTaskStatus, FeatureShutdown, FeatureBatch, FeatureResume, FeatureLineInfo, FeatureResultData, FeatureTaskLimits}
+
+// PeerVersion returns the protocol version a peer announced, treating a
+// missing version as 1
+func PeerVersion(announced int) int {
+	if announced <= 0 {
+		return 1
+	}
+	return announced
+}
+
+// Negotiate returns the features offered by a peer that this build supports
+func Negotiate(offered []string) []string {
+	var agreed []string
+	for _, feature := range Features {
+		if HasFeature(offered, feature) {
+			agreed = append(agreed, feature)
+		}
+	}
+	return agreed
+}
+
+// HasFeature reports whether feature is in features
+func HasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// CompareVersions compares two software versions of the form v1.2.3 (the
+// v and trailing components are optional, pre-release suffixes are
+// ignored), returning -1, 0 or 1
+func CompareVersions(a, b string) (int, error) {
+	va, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := range va {
+		if va[i] != vb[i] {
+			if va[i] < vb[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// ParseVersion checks that s is a software version CompareVersions accepts
+func ParseVersion(s string) error {
+	_, err := parseVersion(s)
+	return err
+}
+
+func parseVersion(s string) ([3]int, error) {
+	var v [3]int
+	core, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(s), "v"), "-")
+	parts := strings.Split(core, ".")
+	if core == "" || len(parts) > len(v) {
+		return v, fmt.Errorf("invalid version %q, expected e.g. v1.2.3", s)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q, expected e.g. v1.2.3", s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
@@ -0,0 +1,148 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval controls how often idle buckets are discarded
+const sweepInterval = 10 * time.Minute
+
+// Limiter applies a token-bucket rate limit on task creation and a daily
+// quota measured in probe-tests (one task on one probe) per client identity
+type Limiter struct {
+	rate       float64 // tokens per second
+	burst      float64
+	dailyQuota int // probe-tests per UTC day, 0 for unlimited
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time // the clock, replaced in tests
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	day    time.Time // start of the UTC day the usage belongs to
+	used   int
+}
+
+// Result describes the outcome of a rate limit check
+type Result struct {
+	Allowed bool
+	// RetryAfter is how long to wait before retrying when not allowed
+	RetryAfter time.Duration
+	// QuotaLimit and QuotaRemaining are -1 when no daily quota is configured
+	QuotaLimit     int
+	QuotaRemaining int
+	QuotaReset     time.Time
+}
+
+// New creates a Limiter allowing perMinute task creations per minute with the
+// given burst, and dailyQuota probe-tests per day. perMinute <= 0 disables the
+// rate limit and dailyQuota <= 0 disables the quota.
+func New(perMinute float64, burst int, dailyQuota int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:       perMinute / 60,
+		burst:      float64(burst),
+		dailyQuota: dailyQuota,
+		buckets:    make(map[string]*bucket),
+		now:        time.Now,
+	}
+}
+
+// Allow consumes one token and cost probe-tests for key if both are available.
+// Nothing is consumed when the request is denied.
+func (l *Limiter) Allow(key string, cost int) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b := l.bucket(key, now)
+
+	res := l.quota(b)
+	if l.dailyQuota > 0 && b.used+cost > l.dailyQuota {
+		res.RetryAfter = res.QuotaReset.Sub(now)
+		return res
+	}
+	if l.rate > 0 && b.tokens < 1 {
+		res.RetryAfter = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return res
+	}
+
+	if l.rate > 0 {
+		b.tokens--
+	}
+	b.used += cost
+	res = l.quota(b)
+	res.Allowed = true
+	return res
+}
+
+// Peek returns the current quota state for key without consuming anything
+func (l *Limiter) Peek(key string) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	res := l.quota(l.bucket(key, now))
+	res.Allowed = true
+	return res
+}
+
+// bucket returns the refilled bucket for key, creating it if needed
+func (l *Limiter) bucket(key string, now time.Time) *bucket {
+	day := startOfDay(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now, day: day}
+		l.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if !b.day.Equal(day) {
+		b.day = day
+		b.used = 0
+	}
+	return b
+}
+
+func (l *Limiter) quota(b *bucket) Result {
+	if l.dailyQuota <= 0 {
+		return Result{QuotaLimit: -1, QuotaRemaining: -1}
+	}
+	return Result{
+		QuotaLimit:     l.dailyQuota,
+		QuotaRemaining: l.dailyQuota - b.used,
+		QuotaReset:     b.day.Add(24 * time.Hour),
+	}
+}
+
+// sweep drops buckets that are full again and whose quota day has passed
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	day := startOfDay(now)
+	for key, b := range l.buckets {
+		refilled := l.rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst
+		if refilled && (b.used == 0 || b.day.Before(day)) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestLimiter returns a limiter whose clock starts at start and moves
+// only when the returned function is called
+func newTestLimiter(perMinute float64, burst, dailyQuota int, start time.Time) (*Limiter, func(time.Duration)) {
+	l := New(perMinute, burst, dailyQuota)
+	now := start
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestBucketRefill(t *testing.T) {
+	l, advance := newTestLimiter(60, 2, 0, time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC))
+
+	for i := 0; i < 2; i++ {
+		if res := l.Allow("a", 1); !res.Allowed {
+			t.Fatalf("request %d within the burst denied", i)
+		}
+	}
+	res := l.Allow("a", 1)
+	if res.Allowed {
+		t.Fatal("request past the burst allowed")
+	}
+	if res.RetryAfter != time.Second {
+		t.Errorf("RetryAfter = %s, want 1s", res.RetryAfter)
+	}
+	if res := l.Allow("b", 1); !res.Allowed {
+		t.Error("other key denied")
+	}
+
+	advance(500 * time.Millisecond)
+	if res := l.Allow("a", 1); res.Allowed || res.RetryAfter != 500*time.Millisecond {
+		t.Errorf("half refilled: allowed %v, RetryAfter %s, want denied for 500ms", res.Allowed, res.RetryAfter)
+	}
+	advance(500 * time.Millisecond)
+	if res := l.Allow("a", 1); !res.Allowed {
+		t.Error("refilled token denied")
+	}
+
+	// The bucket never holds more than the burst
+	advance(time.Hour)
+	for i := 0; i < 2; i++ {
+		l.Allow("a", 1)
+	}
+	if res := l.Allow("a", 1); res.Allowed {
+		t.Error("bucket refilled past the burst")
+	}
+}
+
+func TestDailyQuotaReset(t *testing.T) {
+	l, advance := newTestLimiter(0, 1, 10, time.Date(2026, 10, 18, 23, 59, 0, 0, time.UTC))
+	midnight := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+
+	if res := l.Allow("a", 10); !res.Allowed || res.QuotaRemaining != 0 {
+		t.Fatalf("allowed %v, remaining %d, want the whole quota used", res.Allowed, res.QuotaRemaining)
+	}
+	res := l.Allow("a", 1)
+	if res.Allowed {
+		t.Fatal("request over the quota allowed")
+	}
+	if !res.QuotaReset.Equal(midnight) || res.RetryAfter != time.Minute {
+		t.Errorf("reset at %s after %s, want %s after 1m", res.QuotaReset, res.RetryAfter, midnight)
+	}
+
+	advance(time.Minute)
+	res = l.Allow("a", 1)
+	if !res.Allowed || res.QuotaRemaining != 9 {
+		t.Errorf("after midnight: allowed %v, remaining %d, want 9 left", res.Allowed, res.QuotaRemaining)
+	}
+	if !res.QuotaReset.Equal(midnight.Add(24 * time.Hour)) {
+		t.Errorf("reset at %s, want the next midnight", res.QuotaReset)
+	}
+}
+
+func TestMultiProbeCost(t *testing.T) {
+	l, _ := newTestLimiter(0, 1, 10, time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC))
+
+	if res := l.Allow("a", 4); !res.Allowed || res.QuotaRemaining != 6 {
+		t.Fatalf("task on 4 probes: allowed %v, remaining %d, want 6 left", res.Allowed, res.QuotaRemaining)
+	}
+	// A task on more probes than are left is denied and charges nothing
+	if res := l.Allow("a", 7); res.Allowed || res.QuotaRemaining != 6 {
+		t.Errorf("task on 7 probes: allowed %v, remaining %d, want denied with 6 left", res.Allowed, res.QuotaRemaining)
+	}
+	if res := l.Peek("a"); res.QuotaRemaining != 6 {
+		t.Errorf("Peek remaining = %d, want 6", res.QuotaRemaining)
+	}
+	if res := l.Allow("a", 6); !res.Allowed || res.QuotaRemaining != 0 {
+		t.Errorf("task on 6 probes: allowed %v, remaining %d, want the rest used", res.Allowed, res.QuotaRemaining)
+	}
+}
+
+func TestDeniedRequestKeepsTokens(t *testing.T) {
+	l, _ := newTestLimiter(60, 1, 5, time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC))
+
+	// Over the quota: the token must not be spent either
+	if res := l.Allow("a", 6); res.Allowed {
+		t.Fatal("task over the quota allowed")
+	}
+	if res := l.Allow("a", 5); !res.Allowed {
+		t.Error("token spent by a denied request")
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	l, _ := newTestLimiter(0, 0, 0, time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC))
+	for i := 0; i < 100; i++ {
+		res := l.Allow("a", 1000)
+		if !res.Allowed {
+			t.Fatalf("request %d denied without limits", i)
+		}
+		if res.QuotaLimit != -1 || res.QuotaRemaining != -1 {
+			t.Fatalf("quota = %d/%d, want -1 without a quota", res.QuotaRemaining, res.QuotaLimit)
+		}
+	}
+}
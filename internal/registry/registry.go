@@ -0,0 +1,312 @@
+package registry
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Attribute is a single key/value line of a registry object
+type Attribute struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Object is a single RPSL object from the DN42 registry
+type Object struct {
+	Class      string      `json:"class"`
+	Key        string      `json:"key"`
+	Attributes []Attribute `json:"attributes"`
+}
+
+// Get returns the first value of the given attribute
+func (o *Object) Get(key string) string {
+	for _, attr := range o.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// GetAll returns all values of the given attribute
+func (o *Object) GetAll(key string) []string {
+	var values []string
+	for _, attr := range o.Attributes {
+		if attr.Key == key {
+			values = append(values, attr.Value)
+		}
+	}
+	return values
+}
+
+// prefixEntry maps a network prefix to the object describing it
+type prefixEntry struct {
+	prefix netip.Prefix
+	object *Object
+}
+
+// Registry is an in-memory, read-only view of a DN42 registry checkout
+type Registry struct {
+	objects map[string]map[string]*Object // class -> key -> object
+	inetnum []prefixEntry                 // inetnum and inet6num, most specific first
+	routes  []prefixEntry                 // route and route6, most specific first
+}
+
+// referenceAttributes are followed when resolving an object's related objects
+var referenceAttributes = map[string][]string{
+	"mnt-by":  {"mntner"},
+	"admin-c": {"person", "role"},
+	"tech-c":  {"person", "role"},
+	"zone-c":  {"person", "role"},
+	"org":     {"organisation"},
+}
+
+// nameClasses are searched in order for queries that are not addresses or ASNs
+var nameClasses = []string{"mntner", "person", "role", "organisation", "as-set", "route-set", "dns"}
+
+var asnPattern = regexp.MustCompile(`^(?i:AS)?([0-9]+)$`)
+
+// Load parses a registry checkout. dir may point either at the repository
+// root or directly at its data directory.
+func Load(dir string) (*Registry, error) {
+	dataDir := filepath.Join(dir, "data")
+	if info, err := os.Stat(dataDir); err != nil || !info.IsDir() {
+		dataDir = dir
+	}
+
+	classDirs, err := os.ReadDir(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry directory: %w", err)
+	}
+
+	r := &Registry{objects: make(map[string]map[string]*Object)}
+	for _, classDir := range classDirs {
+		if !classDir.IsDir() || strings.HasPrefix(classDir.Name(), ".") {
+			continue
+		}
+		class := classDir.Name()
+		files, err := os.ReadDir(filepath.Join(dataDir, class))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read class %s: %w", class, err)
+		}
+
+		r.objects[class] = make(map[string]*Object, len(files))
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+			obj, err := parseFile(filepath.Join(dataDir, class, file.Name()))
+			if err != nil {
+				log.Printf("Skipping registry object %s/%s: %v", class, file.Name(), err)
+				continue
+			}
+			obj.Class = class
+			obj.Key = file.Name()
+			r.objects[class][obj.Key] = obj
+			r.indexPrefix(obj)
+		}
+	}
+
+	sortMostSpecific(r.inetnum)
+	sortMostSpecific(r.routes)
+	return r, nil
+}
+
+// parseFile reads an RPSL object, joining continuation lines
+func parseFile(path string) (*Object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	obj := &Object{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "%") {
+			continue
+		}
+
+		// Continuation of the previous attribute
+		if line[0] == ' ' || line[0] == '\t' || line[0] == '+' {
+			if len(obj.Attributes) == 0 {
+				return nil, fmt.Errorf("continuation line without attribute")
+			}
+			last := &obj.Attributes[len(obj.Attributes)-1]
+			last.Value = strings.TrimSpace(last.Value + "\n" + strings.TrimSpace(strings.TrimPrefix(line, "+")))
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed line: %q", line)
+		}
+		obj.Attributes = append(obj.Attributes, Attribute{
+			Key:   strings.TrimSpace(key),
+			Value: strings.TrimSpace(value),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(obj.Attributes) == 0 {
+		return nil, fmt.Errorf("empty object")
+	}
+	return obj, nil
+}
+
+// indexPrefix adds address objects to the prefix lookup tables
+func (r *Registry) indexPrefix(obj *Object) {
+	var table *[]prefixEntry
+	switch obj.Class {
+	case "inetnum", "inet6num":
+		table = &r.inetnum
+	case "route", "route6":
+		table = &r.routes
+	default:
+		return
+	}
+
+	// inetnum objects carry a cidr attribute, routes use the class name;
+	// fall back to the file name (e.g. 172.20.0.0_24)
+	candidates := []string{obj.Get("cidr"), obj.Get(obj.Class), strings.Replace(obj.Key, "_", "/", 1)}
+	for _, candidate := range candidates {
+		if prefix, err := netip.ParsePrefix(candidate); err == nil {
+			*table = append(*table, prefixEntry{prefix: prefix.Masked(), object: obj})
+			return
+		}
+	}
+}
+
+func sortMostSpecific(entries []prefixEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].prefix.Bits() > entries[j].prefix.Bits()
+	})
+}
+
+// Len returns the total number of loaded objects
+func (r *Registry) Len() int {
+	n := 0
+	for _, objects := range r.objects {
+		n += len(objects)
+	}
+	return n
+}
+
+// Object returns the object of the given class and key, if present
+func (r *Registry) Object(class, key string) *Object {
+	if objects, ok := r.objects[class]; ok {
+		return objects[key]
+	}
+	return nil
+}
+
+// Lookup resolves a whois query. IPs and prefixes resolve to the most specific
+// inetnum/inet6num (plus the covering route and its origin aut-num), ASNs to
+// aut-num, and anything else to a named object. The primary objects come
+// first, followed by the maintainers and contacts they reference.
+// It returns nil when nothing matches.
+func (r *Registry) Lookup(query string) []*Object {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil
+	}
+
+	var primary []*Object
+	if prefix, ok := parseQueryPrefix(query); ok {
+		if obj := mostSpecific(r.inetnum, prefix); obj != nil {
+			primary = append(primary, obj)
+		}
+		if route := mostSpecific(r.routes, prefix); route != nil {
+			primary = append(primary, route)
+			if autnum := r.autNum(route.Get("origin")); autnum != nil {
+				primary = append(primary, autnum)
+			}
+		}
+	} else if autnum := r.autNum(query); autnum != nil {
+		primary = append(primary, autnum)
+	} else {
+		for _, class := range nameClasses {
+			if obj := r.Object(class, query); obj != nil {
+				primary = append(primary, obj)
+				break
+			}
+			if obj := r.Object(class, strings.ToUpper(query)); obj != nil {
+				primary = append(primary, obj)
+				break
+			}
+		}
+	}
+
+	if len(primary) == 0 {
+		return nil
+	}
+	return r.withReferences(primary)
+}
+
+// withReferences appends the objects referenced by primary, without duplicates
+func (r *Registry) withReferences(primary []*Object) []*Object {
+	seen := make(map[*Object]bool)
+	result := make([]*Object, 0, len(primary))
+	for _, obj := range primary {
+		if !seen[obj] {
+			seen[obj] = true
+			result = append(result, obj)
+		}
+	}
+
+	for _, obj := range primary {
+		for _, attr := range obj.Attributes {
+			classes, ok := referenceAttributes[attr.Key]
+			if !ok {
+				continue
+			}
+			for _, class := range classes {
+				if ref := r.Object(class, attr.Value); ref != nil && !seen[ref] {
+					seen[ref] = true
+					result = append(result, ref)
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
+// autNum resolves "AS4242420000" or "4242420000" to its aut-num object
+func (r *Registry) autNum(query string) *Object {
+	m := asnPattern.FindStringSubmatch(strings.TrimSpace(query))
+	if m == nil {
+		return nil
+	}
+	return r.Object("aut-num", "AS"+m[1])
+}
+
+// parseQueryPrefix accepts either a bare address or a CIDR prefix
+func parseQueryPrefix(query string) (netip.Prefix, bool) {
+	if addr, err := netip.ParseAddr(query); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	if prefix, err := netip.ParsePrefix(query); err == nil {
+		return prefix.Masked(), true
+	}
+	return netip.Prefix{}, false
+}
+
+// mostSpecific returns the most specific entry covering prefix
+func mostSpecific(entries []prefixEntry, prefix netip.Prefix) *Object {
+	for _, entry := range entries {
+		if entry.prefix.Bits() <= prefix.Bits() && entry.prefix.Contains(prefix.Addr()) {
+			return entry.object
+		}
+	}
+	return nil
+}
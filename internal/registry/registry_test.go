@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeRegistry creates a registry checkout from files keyed by
+// "class/name" and loads it
+func writeRegistry(t *testing.T, files map[string]string) *Registry {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, "data", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reg, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func TestParseFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   string
+		want  []Attribute
+		error bool
+	}{
+		{
+			name: "simple",
+			src:  "mntner: FOO-MNT\nauth: ssh-ed25519 AAAA\n",
+			want: []Attribute{{"mntner", "FOO-MNT"}, {"auth", "ssh-ed25519 AAAA"}},
+		},
+		{
+			name: "comments and blank lines",
+			src:  "# header\n% note\nmntner: FOO-MNT\n\nsource: DN42\n",
+			want: []Attribute{{"mntner", "FOO-MNT"}, {"source", "DN42"}},
+		},
+		{
+			name: "continuation lines",
+			src:  "remarks: first\n  second\n+\tthird\nsource: DN42\n",
+			want: []Attribute{{"remarks", "first\nsecond\nthird"}, {"source", "DN42"}},
+		},
+		{
+			name: "multi-valued attribute",
+			src:  "mntner: FOO-MNT\nauth: pgp-fingerprint AAAA\nauth: ssh-ed25519 BBBB\n",
+			want: []Attribute{{"mntner", "FOO-MNT"}, {"auth", "pgp-fingerprint AAAA"}, {"auth", "ssh-ed25519 BBBB"}},
+		},
+		{
+			name: "value containing colons",
+			src:  "inet6num: fd42:d42:d42:: - fd42:d42:d42:ffff:ffff:ffff:ffff:ffff\n",
+			want: []Attribute{{"inet6num", "fd42:d42:d42:: - fd42:d42:d42:ffff:ffff:ffff:ffff:ffff"}},
+		},
+		{name: "leading continuation", src: "  orphan\nmntner: FOO-MNT\n", error: true},
+		{name: "malformed line", src: "mntner FOO-MNT\n", error: true},
+		{name: "empty", src: "# nothing\n", error: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "obj")
+			if err := os.WriteFile(path, []byte(tt.src), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			obj, err := parseFile(path)
+			if tt.error {
+				if err == nil {
+					t.Fatalf("parsed %+v, want an error", obj)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(obj.Attributes, tt.want) {
+				t.Errorf("attributes = %q, want %q", obj.Attributes, tt.want)
+			}
+		})
+	}
+}
+
+func TestObjectGetAll(t *testing.T) {
+	reg := writeRegistry(t, map[string]string{
+		"mntner/FOO-MNT": "mntner: FOO-MNT\nauth: a\nauth: b\n",
+	})
+	obj := reg.Object("mntner", "FOO-MNT")
+	if obj == nil {
+		t.Fatal("FOO-MNT not loaded")
+	}
+	if got := obj.GetAll("auth"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("GetAll(auth) = %q", got)
+	}
+	if got := obj.Get("auth"); got != "a" {
+		t.Errorf("Get(auth) = %q, want the first value", got)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	reg := writeRegistry(t, map[string]string{
+		"inetnum/172.20.0.0_14":           "inetnum: 172.20.0.0 - 172.23.255.255\ncidr: 172.20.0.0/14\n",
+		"inetnum/172.20.0.0_24":           "inetnum: 172.20.0.0 - 172.20.0.255\ncidr: 172.20.0.0/24\nmnt-by: FOO-MNT\n",
+		"inetnum/172.20.0.0_28":           "inetnum: 172.20.0.0 - 172.20.0.15\ncidr: 172.20.0.0/28\n",
+		"route/172.20.0.0_24":             "route: 172.20.0.0/24\norigin: AS4242420000\n",
+		"inet6num/fd00::_8":               "inet6num: fd00:: - fdff:ffff:ffff:ffff:ffff:ffff:ffff:ffff\ncidr: fd00::/8\n",
+		"inet6num/fd42:d42:d42::_48":      "inet6num: fd42:d42:d42:: - fd42:d42:d42:ffff:ffff:ffff:ffff:ffff\ncidr: fd42:d42:d42::/48\n",
+		"route6/fd42:d42:d42::_48":        "route6: fd42:d42:d42::/48\norigin: AS4242420000\n",
+		"aut-num/AS4242420000":            "aut-num: AS4242420000\nmnt-by: FOO-MNT\n",
+		"mntner/FOO-MNT":                  "mntner: FOO-MNT\nadmin-c: FOO-DN42\n",
+		"person/FOO-DN42":                 "person: Foo\nnic-hdl: FOO-DN42\n",
+		"inetnum/not-a-prefix-file-name":  "inetnum: broken\n",
+		"inet6num/fd42:d42:d42:1::_64.md": "# not an object\n",
+	})
+
+	tests := []struct {
+		query string
+		want  []string // class/key of the objects returned, in order
+	}{
+		{"172.20.0.1", []string{"inetnum/172.20.0.0_28", "route/172.20.0.0_24", "aut-num/AS4242420000", "mntner/FOO-MNT"}},
+		{"172.20.0.100", []string{"inetnum/172.20.0.0_24", "route/172.20.0.0_24", "aut-num/AS4242420000", "mntner/FOO-MNT"}},
+		{"172.20.0.0/25", []string{"inetnum/172.20.0.0_24", "route/172.20.0.0_24", "aut-num/AS4242420000", "mntner/FOO-MNT"}},
+		{"172.22.1.1", []string{"inetnum/172.20.0.0_14"}},
+		{"fd42:d42:d42::1", []string{"inet6num/fd42:d42:d42::_48", "route6/fd42:d42:d42::_48", "aut-num/AS4242420000", "mntner/FOO-MNT"}},
+		{"fd42:d42:d43::1", []string{"inet6num/fd00::_8"}},
+		{"fd00::/7", nil},
+		{"10.0.0.1", nil},
+		{"AS4242420000", []string{"aut-num/AS4242420000", "mntner/FOO-MNT"}},
+		{"4242420000", []string{"aut-num/AS4242420000", "mntner/FOO-MNT"}},
+		{"foo-mnt", []string{"mntner/FOO-MNT", "person/FOO-DN42"}},
+		{"NOPE-MNT", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, obj := range reg.Lookup(tt.query) {
+			got = append(got, obj.Class+"/"+obj.Key)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Lookup(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const whoisTimeout = 10 * time.Second
+
+// ServeWhois answers RFC 3912 whois queries on ln until it is closed, and
+// returns nil once it is
+func (r *Registry) ServeWhois(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go r.handleWhois(conn)
+	}
+}
+
+// handleWhois reads a single query line and writes the matching objects
+func (r *Registry) handleWhois(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(whoisTimeout))
+
+	line, err := bufio.NewReader(io.LimitReader(conn, 1024)).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+	query := strings.TrimSpace(line)
+	log.Printf("Whois query from %s: %q", conn.RemoteAddr(), query)
+
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "%% DN42 Globalping whois\n%% Query: %s\n\n", query)
+	objects := r.Lookup(query)
+	if objects == nil {
+		fmt.Fprintf(w, "%% 404 - no entries found\n")
+		return
+	}
+	for _, obj := range objects {
+		WriteObject(w, obj)
+		fmt.Fprintln(w)
+	}
+}
+
+// WriteObject formats obj in the registry's RPSL layout
+func WriteObject(w io.Writer, obj *Object) {
+	for _, attr := range obj.Attributes {
+		lines := strings.Split(attr.Value, "\n")
+		fmt.Fprintf(w, "%-20s%s\n", attr.Key+":", lines[0])
+		for _, cont := range lines[1:] {
+			fmt.Fprintf(w, "%-20s%s\n", "", cont)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package registry
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// whois sends query to addr and returns the whole answer
+func whois(t *testing.T, addr, query string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, query+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(answer)
+}
+
+func TestServeWhois(t *testing.T) {
+	reg := writeRegistry(t, map[string]string{
+		"mntner/FOO-MNT": "mntner: FOO-MNT\nremarks: first\n  second\nsource: DN42\n",
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- reg.ServeWhois(ln) }()
+
+	answer := whois(t, ln.Addr().String(), "FOO-MNT")
+	want := "% DN42 Globalping whois\n% Query: FOO-MNT\n\n" +
+		"mntner:             FOO-MNT\n" +
+		"remarks:            first\n" +
+		"                    second\n" +
+		"source:             DN42\n\n"
+	if answer != want {
+		t.Errorf("answer = %q, want %q", answer, want)
+	}
+	if answer := whois(t, ln.Addr().String(), "BAR-MNT"); !strings.Contains(answer, "% 404 - no entries found") {
+		t.Errorf("answer = %q, want no entries found", answer)
+	}
+
+	ln.Close()
+	if err := <-served; err != nil {
+		t.Errorf("ServeWhois returned %v after the listener was closed, want nil", err)
+	}
+}
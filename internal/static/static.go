@@ -0,0 +1,189 @@
+// Package static serves the compiled frontend with cache headers,
+// precompressed variants and a single-page-app fallback.
+package static
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Vite puts content-hashed files under assets/, so they never change
+	immutableCache = "public, max-age=31536000, immutable"
+	revalidate     = "no-cache"
+)
+
+// encodings lists precompressed variants in order of preference
+var encodings = []struct {
+	name, ext string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// apiPrefixes are never answered with index.html, so unknown API routes
+// return a proper 404
+var apiPrefixes = []string{"/api/", "/ws/"}
+
+// Server serves files from a file system, usually web/dist
+type Server struct {
+	fsys  fs.FS
+	etags sync.Map // file path -> ETag
+}
+
+// New creates a Server for fsys
+func New(fsys fs.FS) *Server {
+	return &Server{fsys: fsys}
+}
+
+// HasIndex reports whether fsys contains index.html, i.e. the frontend was built
+func (s *Server) HasIndex() bool {
+	_, err := fs.Stat(s.fsys, "index.html")
+	return err == nil
+}
+
+// Handle serves the requested file, or index.html for unknown paths that
+// look like frontend routes. Use it as the router's NoRoute handler.
+func (s *Server) Handle(c *gin.Context) {
+	urlPath := c.Request.URL.Path
+	for _, prefix := range apiPrefixes {
+		if strings.HasPrefix(urlPath, prefix) || urlPath == strings.TrimSuffix(prefix, "/") {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+	}
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "method not allowed"})
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	if s.serveFile(c, name) {
+		return
+	}
+
+	// Paths with an extension are missing files, not frontend routes
+	if path.Ext(name) != "" || !s.serveFile(c, "index.html") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+	}
+}
+
+// serveFile writes name, or its best precompressed variant the client
+// accepts, and reports false if name does not exist
+func (s *Server) serveFile(c *gin.Context, name string) bool {
+	info, err := fs.Stat(s.fsys, name)
+	if err != nil || info.IsDir() {
+		return false
+	}
+
+	if strings.HasPrefix(name, "assets/") {
+		c.Header("Cache-Control", immutableCache)
+	} else {
+		c.Header("Cache-Control", revalidate)
+	}
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		c.Header("Content-Type", ctype)
+	}
+	c.Header("Vary", "Accept-Encoding")
+
+	served := name
+	accept := c.GetHeader("Accept-Encoding")
+	for _, enc := range encodings {
+		if !acceptsEncoding(accept, enc.name) {
+			continue
+		}
+		if _, err := fs.Stat(s.fsys, name+enc.ext); err == nil {
+			served = name + enc.ext
+			c.Header("Content-Encoding", enc.name)
+			break
+		}
+	}
+
+	content, modTime, err := s.open(served)
+	if err != nil {
+		return false
+	}
+	if closer, ok := content.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if modTime.IsZero() {
+		if tag := s.etag(served, content); tag != "" {
+			c.Header("ETag", tag)
+		}
+	}
+	http.ServeContent(c.Writer, c.Request, name, modTime, content)
+	return true
+}
+
+// open returns a seekable reader for name. Embedded files and files on
+// disk are seekable already; anything else is read into memory.
+func (s *Server) open(name string) (io.ReadSeeker, time.Time, error) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+	if rs, ok := f.(io.ReadSeeker); ok {
+		return rs, info.ModTime(), nil
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return bytes.NewReader(data), info.ModTime(), nil
+}
+
+// etag returns a content hash for name, computed once. It is only used for
+// embedded files, which have no modification time and never change.
+func (s *Server) etag(name string, content io.ReadSeeker) string {
+	if tag, ok := s.etags.Load(name); ok {
+		return tag.(string)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		return ""
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return ""
+	}
+	tag := `"` + base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16]) + `"`
+	s.etags.Store(name, tag)
+	return tag
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows enc
+func acceptsEncoding(header, enc string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), enc) {
+			continue
+		}
+		q, found := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !found {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+// Package store keeps finished and running measurements so they can be
+// fetched by ID after the WebSocket stream has ended.
+package store
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/bingxin666/dn42-globalping/internal/model"
+)
+
+// Store records measurements as their results arrive
+type Store interface {
+	// Create adds a measurement; its Results list every selected probe
+	Create(m model.Measurement)
+	// Append adds lines of output from a probe
+	Append(id, probeID string, lines ...model.OutputLine)
+	// Finish marks a probe's result done, failed if errMsg is not empty,
+	// and keeps its structured result if any
+	Finish(id, probeID, errMsg string, data json.RawMessage)
+	// Get returns a copy of a measurement
+	Get(id string) (model.Measurement, bool)
+}
+
+// Memory keeps the most recent measurements in memory
+type Memory struct {
+	mu    sync.RWMutex
+	max   int
+	byID  map[string]*model.Measurement
+	order []string // IDs, oldest first
+}
+
+// NewMemory creates a Memory store keeping at most max measurements
+func NewMemory(max int) *Memory {
+	return &Memory{
+		max:  max,
+		byID: make(map[string]*model.Measurement),
+	}
+}
+
+// Create adds a measurement, evicting the oldest ones beyond the limit
+func (s *Memory) Create(m model.Measurement) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m.Results = append([]model.MeasurementResult(nil), m.Results...)
+	s.byID[m.ID] = &m
+	s.order = append(s.order, m.ID)
+	for len(s.order) > s.max {
+		delete(s.byID, s.order[0])
+		s.order = s.order[1:]
+	}
+	updateStatus(&m)
+}
+
+// Append adds lines of output from a probe
+func (s *Memory) Append(id, probeID string, lines ...model.OutputLine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r := s.result(id, probeID); r != nil && r.Status == model.MeasurementInProgress {
+		for _, line := range lines {
+			r.Output += line.Text + "\n"
+		}
+		r.Lines = append(r.Lines, lines...)
+	}
+}
+
+// Finish marks a probe's result done
+func (s *Memory) Finish(id, probeID, errMsg string, data json.RawMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.result(id, probeID)
+	if r == nil || r.Status != model.MeasurementInProgress {
+		return
+	}
+	r.Status = model.MeasurementFinished
+	r.Data = data
+	if errMsg != "" {
+		r.Status = model.MeasurementFailed
+		r.Error = errMsg
+	}
+	updateStatus(s.byID[id])
+}
+
+// Get returns a copy of a measurement
+func (s *Memory) Get(id string) (model.Measurement, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, ok := s.byID[id]
+	if !ok {
+		return model.Measurement{}, false
+	}
+	copied := *m
+	copied.Results = append([]model.MeasurementResult(nil), m.Results...)
+	return copied, true
+}
+
+// result finds a probe's result; callers hold mu
+func (s *Memory) result(id, probeID string) *model.MeasurementResult {
+	m, ok := s.byID[id]
+	if !ok {
+		return nil
+	}
+	for i := range m.Results {
+		if m.Results[i].ProbeID == probeID {
+			return &m.Results[i]
+		}
+	}
+	return nil
+}
+
+// updateStatus marks a measurement finished once every probe is done
+func updateStatus(m *model.Measurement) {
+	for _, r := range m.Results {
+		if r.Status == model.MeasurementInProgress {
+			m.Status = model.MeasurementInProgress
+			return
+		}
+	}
+	m.Status = model.MeasurementFinished
+}
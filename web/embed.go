@@ -0,0 +1,20 @@
+//go:build !noembed
+
+// Package web holds the compiled frontend so the server binary can serve it
+// without a web/dist directory next to it. Build the frontend with
+// `npm run build` before `go build`; build with -tags noembed to leave it out.
+package web
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:dist
+var dist embed.FS
+
+// Dist returns the embedded contents of web/dist
+func Dist() fs.FS {
+	sub, _ := fs.Sub(dist, "dist")
+	return sub
+}
@@ -0,0 +1,11 @@
+//go:build noembed
+
+package web
+
+import "io/fs"
+
+// Dist returns nil when the frontend is not embedded; the server then
+// needs -static-dir
+func Dist() fs.FS {
+	return nil
+}
@@ -1,8 +1,48 @@
 import { defineConfig } from 'vite'
 import vue from '@vitejs/plugin-vue'
+import { brotliCompressSync, gzipSync, constants } from 'node:zlib'
+import { readdirSync, readFileSync, statSync, writeFileSync } from 'node:fs'
+import { join } from 'node:path'
+
+// Files worth compressing; smaller ones are served as they are
+const compressible = /\.(js|css|html|svg|json|txt|map)$/
+const minSize = 1024
+
+function walk(dir) {
+  return readdirSync(dir).flatMap((name) => {
+    const path = join(dir, name)
+    return statSync(path).isDirectory() ? walk(path) : [path]
+  })
+}
+
+// precompress writes .br and .gz next to every compressible file in dist, so
+// the server can send them without compressing on each request. It also
+// restores dist/.gitkeep, which go:embed needs when dist has not been built.
+function precompress() {
+  let outDir
+  return {
+    name: 'precompress',
+    apply: 'build',
+    configResolved(config) {
+      outDir = config.build.outDir
+    },
+    closeBundle() {
+      for (const file of walk(outDir)) {
+        if (!compressible.test(file)) continue
+        const data = readFileSync(file)
+        if (data.length < minSize) continue
+        writeFileSync(file + '.gz', gzipSync(data, { level: 9 }))
+        writeFileSync(file + '.br', brotliCompressSync(data, {
+          params: { [constants.BROTLI_PARAM_QUALITY]: constants.BROTLI_MAX_QUALITY }
+        }))
+      }
+      writeFileSync(join(outDir, '.gitkeep'), '')
+    }
+  }
+}
 
 export default defineConfig({
-  plugins: [vue()],
+  plugins: [vue(), precompress()],
   server: {
     proxy: {
       '/api': {